@@ -2,8 +2,11 @@ package api
 
 import (
 	"catalog/configuration"
+	"catalog/currency"
 	"catalog/db"
+	"catalog/ratelimit"
 	"catalog/validation"
+	"sync"
 
 	"github.com/labstack/echo/v4"
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -17,43 +20,96 @@ type ApiHandler struct {
 	conf       *configuration.Configuration
 	validation *validation.Validation
 	tracer     trace.Tracer
+	rates      currency.RateProvider
+	// Write request limiters, per route group
+	limiters map[string]*ratelimit.Limiter
+	// The rebuild of the price projection, one at a time
+	rebuildMutex  sync.Mutex
+	rebuildStatus RebuildStatus
 }
 
-func NewApiHandler(dbh db.DbHandler, amqp *amqp.Connection, conf *configuration.Configuration) *ApiHandler {
+func NewApiHandler(dbh db.DbHandler, amqp *amqp.Connection, conf *configuration.Configuration, validation *validation.Validation) *ApiHandler {
 	handler := ApiHandler{
 		dbh:        dbh,
 		amqp:       amqp,
 		conf:       conf,
-		validation: validation.New(conf),
+		validation: validation,
 		tracer:     otel.Tracer(conf.OtelServiceName),
+		rates:      currency.NewDbRateProvider(dbh),
+		limiters:   make(map[string]*ratelimit.Limiter),
+	}
+
+	for group, limit := range map[string]configuration.RateLimit{
+		"ingredient": conf.IngredientRateLimit,
+		"shop":       conf.ShopRateLimit,
+		"price":      conf.PriceRateLimit,
+	} {
+		if limit.PerMinute > 0 {
+			handler.limiters[group] = ratelimit.New(float64(limit.PerMinute)/60, limit.Burst)
+		}
 	}
 	return &handler
 }
 
 func (api *ApiHandler) Register(v1 *echo.Group) {
 
+	// The health routes are the only public ones
 	health := v1.Group("/health")
 	health.GET("/alive", api.getAliveStatus)
 	health.GET("/live", api.getAliveStatus)
 	health.GET("/ready", api.getReadyStatus)
 
-	ingredient := v1.Group("/ingredient")
-	ingredient.POST("", api.postIngredient)
+	// Every authenticated client can read, writes require a higher role
+	ingredient := v1.Group("/ingredient", api.Authenticate, api.Authorize(RoleReader), api.RateLimit("ingredient"))
+	ingredient.POST("", api.postIngredient, api.Authorize(RoleContributor))
 	ingredient.GET("", api.getIngredients)
-	ingredient.PUT("/:id", api.putIngredient)
+	ingredient.GET("/search", api.searchIngredients)
+	ingredient.POST("/import", api.importIngredients, api.Authorize(RoleAdmin))
+	ingredient.GET("/export", api.exportIngredients)
+	ingredient.PUT("/:id", api.putIngredient, api.Authorize(RoleAdmin))
+	ingredient.PATCH("/:id", api.patchIngredient, api.Authorize(RoleAdmin))
+	ingredient.DELETE("/:id", api.deleteIngredient, api.Authorize(RoleAdmin))
+	ingredient.POST("/:id/restore", api.restoreIngredient, api.Authorize(RoleAdmin))
+	ingredient.DELETE("/:id/purge", api.purgeIngredient, api.Authorize(RoleAdmin))
 	ingredient.GET("/:id", api.getIngredientByID)
 	ingredient.GET("/type/:type", api.getIngredientByType)
 	ingredient.GET("/name/:name", api.getIngredientByName)
 
-	shop := v1.Group("/shop")
-	shop.POST("", api.createShop)
+	shop := v1.Group("/shop", api.Authenticate, api.Authorize(RoleReader), api.RateLimit("shop"))
+	shop.POST("", api.createShop, api.Authorize(RoleAdmin))
 	shop.GET("", api.getShops)
+	shop.GET("/nearby", api.getNearbyShops)
 	shop.GET("/:id", api.getShop)
-	shop.PUT("/:id", api.updateShop)
-	shop.DELETE("/:id", api.deleteShop)
+	shop.PUT("/:id", api.updateShop, api.Authorize(RoleAdmin))
+	shop.PATCH("/:id", api.patchShop, api.Authorize(RoleAdmin))
+	shop.DELETE("/:id", api.deleteShop, api.Authorize(RoleAdmin))
 
-	price := v1.Group("/price")
-	price.POST("", api.createPrice)
+	price := v1.Group("/price", api.Authenticate, api.Authorize(RoleReader), api.RateLimit("price"))
+	price.POST("", api.createPrice, api.Authorize(RoleContributor))
+	price.POST("/batch", api.createPrices, api.Authorize(RoleContributor))
 	price.GET("", api.getPrices)
 	price.GET("/last/:shopId/:productId", api.getLastUpdatedPrice)
+	price.GET("/at", api.getPriceAt)
+	price.GET("/at/catalog", api.getCatalogPricesAt)
+	price.GET("/history/:shopId/:productId", api.getPriceHistory)
+
+	rate := v1.Group("/rate", api.Authenticate, api.Authorize(RoleReader))
+	rate.POST("", api.createExchangeRate, api.Authorize(RoleAdmin))
+	rate.GET("", api.getExchangeRates)
+	rate.POST("/import", api.importExchangeRates, api.Authorize(RoleAdmin))
+	rate.GET("/:id", api.getExchangeRate)
+	rate.PUT("/:id", api.updateExchangeRate, api.Authorize(RoleAdmin))
+	rate.DELETE("/:id", api.deleteExchangeRate, api.Authorize(RoleAdmin))
+
+	basket := v1.Group("/basket", api.Authenticate, api.Authorize(RoleReader))
+	basket.POST("/optimize", api.optimizeBasket)
+
+	apiKey := v1.Group("/apikey", api.Authenticate, api.Authorize(RoleAdmin))
+	apiKey.POST("", api.createAPIKey)
+	apiKey.GET("", api.getAPIKeys)
+	apiKey.DELETE("/:id", api.revokeAPIKey)
+
+	projection := v1.Group("/projection", api.Authenticate, api.Authorize(RoleAdmin))
+	projection.POST("/rebuild", api.rebuildProjection)
+	projection.GET("/rebuild", api.getRebuildStatus)
 }
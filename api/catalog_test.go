@@ -1,23 +1,48 @@
 package api
 
 import (
+	"bytes"
+	"catalog/bulk"
 	"catalog/configuration"
 	"catalog/db"
+	"catalog/money"
+	"catalog/patch"
+	"catalog/units"
+	"catalog/validation"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
 	dockertest "github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var (
@@ -25,7 +50,10 @@ var (
 	mongoPool           *dockertest.Pool
 	mongoResource       *dockertest.Resource
 	once                sync.Once
-	CollectionsToCreate = []string{"ingredient", "price", "shop"}
+	eventStoreResource  *dockertest.Resource
+	eventStoreOnce      sync.Once
+	EventStoreURI       string
+	CollectionsToCreate = []string{"ingredient", "price", "shop", "exchange_rate"}
 	DBName              = "catalog"
 	DBUser              = "root"
 	DBPassword          = "password"
@@ -38,7 +66,7 @@ func SeedDatabase(mongo *mongo.Client) {
 	// Create the recipe database and collection
 	recipeDB := mongo.Database(DBName)
 	for _, collection := range CollectionsToCreate {
-		err := recipeDB.RunCommand(context.Background(), bson.D{{"create", collection}}).Err()
+		err := recipeDB.RunCommand(context.Background(), bson.D{{Key: "create", Value: collection}}).Err()
 		if err != nil {
 			logger.Warnf("Failed to create collection %s: %v", collection, err)
 		}
@@ -121,6 +149,169 @@ func InitTestMongo() (*mongo.Client, error) {
 	return mongoClient, initErr
 }
 
+// InitTestEventStore starts a single in-memory EventStoreDB for the tests of
+// the prices stored as events, on first use
+func InitTestEventStore() (string, error) {
+	var initErr error
+	eventStoreOnce.Do(func() {
+		if mongoPool == nil {
+			initErr = fmt.Errorf("docker pool not initialized")
+			return
+		}
+		resource, err := mongoPool.RunWithOptions(&dockertest.RunOptions{
+			Repository: "eventstore/eventstore",
+			Tag:        "24.10",
+			Env: []string{
+				"EVENTSTORE_INSECURE=true",
+				"EVENTSTORE_MEM_DB=true",
+				"EVENTSTORE_CLUSTER_SIZE=1",
+			},
+		}, func(config *docker.HostConfig) {
+			config.AutoRemove = true
+			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+		})
+		if err != nil {
+			initErr = fmt.Errorf("could not start resource: %w", err)
+			return
+		}
+		eventStoreResource = resource
+		uri := fmt.Sprintf("esdb://%s:%s?tls=false", DBHost, resource.GetPort("2113/tcp"))
+
+		initErr = mongoPool.Retry(func() error {
+			client, err := newEventStoreClient(uri)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			stream, err := client.ReadAll(context.Background(), esdb.ReadAllOptions{From: esdb.Start{}}, 1)
+			if err != nil {
+				return err
+			}
+			stream.Close()
+			return nil
+		})
+		if initErr == nil {
+			EventStoreURI = uri
+		}
+	})
+	if EventStoreURI == "" && initErr == nil {
+		initErr = fmt.Errorf("EventStoreDB failed to start")
+	}
+	return EventStoreURI, initErr
+}
+
+func newEventStoreClient(uri string) (*esdb.Client, error) {
+	settings, err := esdb.ParseConnectionString(uri)
+	if err != nil {
+		return nil, err
+	}
+	return esdb.NewClient(settings)
+}
+
+// setupEventStoreTest returns an API handler storing the prices as events,
+// with the Mongo handler of its read models and a client of the event store
+func setupEventStoreTest(t *testing.T) (*ApiHandler, *db.MongoHandler, *esdb.Client, func()) {
+	t.Helper()
+	uri, err := InitTestEventStore()
+	if err != nil {
+		t.Fatalf("Could not start EventStoreDB: %v", err)
+	}
+
+	api, cleanup := setupTest(t)
+	mh := api.dbh.(*db.MongoHandler)
+	api.conf.EventStoreURI = uri
+	eh, err := db.NewEventHandler(api.conf)
+	if err != nil {
+		t.Fatalf("Failed to create event handler: %v", err)
+	}
+	api.dbh = db.NewMixedHandler(mh, eh)
+	client, err := newEventStoreClient(uri)
+	if err != nil {
+		t.Fatalf("Failed to create event store client: %v", err)
+	}
+	return api, mh, client, func() {
+		client.Close()
+		cleanup()
+	}
+}
+
+// readStream returns the events of the stream, in order
+func readStream(t *testing.T, client *esdb.Client, stream string) []*esdb.RecordedEvent {
+	t.Helper()
+	read, err := client.ReadStream(context.Background(), stream, esdb.ReadStreamOptions{From: esdb.Start{}}, 1000)
+	if err != nil {
+		t.Fatalf("Failed to read stream %s: %v", stream, err)
+	}
+	defer read.Close()
+	events := make([]*esdb.RecordedEvent, 0)
+	for {
+		event, err := read.Recv()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Failed to read stream %s: %v", stream, err)
+		}
+		events = append(events, event.OriginalEvent())
+	}
+}
+
+// The secret of the HS256 tokens of the tests
+const testJWTSecret = "test-secret"
+
+func newTestValidation(t *testing.T, conf *configuration.Configuration) *validation.Validation {
+	t.Helper()
+	val, err := validation.New(conf)
+	if err != nil {
+		t.Fatalf("Failed to create the validation: %v", err)
+	}
+	return val
+}
+
+// newTestApiHandler returns an API handler without database, for the
+// middlewares
+func newTestApiHandler(t *testing.T, conf *configuration.Configuration) *ApiHandler {
+	return NewApiHandler(nil, nil, conf, newTestValidation(t, conf))
+}
+
+// newTestServer serves the routes of the API handler, as main does
+func newTestServer(api *ApiHandler) *echo.Echo {
+	e := New(api.validation)
+	api.Register(e.Group("/v1"))
+	return e
+}
+
+// testToken returns a bearer token of the subject, granting the roles
+func testToken(t *testing.T, subject string, roles ...Role) string {
+	t.Helper()
+	claims := &Claims{
+		StandardClaims: jwt.StandardClaims{Subject: subject, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		Roles:          roles,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+// serve serves the request, authenticated with the token if any
+func serve(e *echo.Echo, method, path, token, contentType, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if len(token) > 0 {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	if len(contentType) > 0 {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
 // CleanupDatabase removes all data from the test database
 func CleanupDatabase(t *testing.T, client *mongo.Client) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -158,14 +349,19 @@ func setupTest(t *testing.T) (*ApiHandler, func()) {
 
 	// Create API handler
 	conf := &configuration.Configuration{
-		ListenAddress:             "localhost",
-		ListenPort:                "3000",
-		LogLevel:                  logrus.DebugLevel,
-		DBURI:                     DBUri,
-		DBName:                    DBName,
-		IngredientsCollectionName: "ingredient",
-		PricesColletionName:       "price",
-		ShopsCollectionName:       "shop",
+		ListenAddress:              "localhost",
+		ListenPort:                 "3000",
+		LogLevel:                   logrus.DebugLevel,
+		DBURI:                      DBUri,
+		DBName:                     DBName,
+		IngredientsCollectionName:  "ingredient",
+		PricesColletionName:        "price",
+		ShopsCollectionName:        "shop",
+		RatesCollectionName:        "exchange_rate",
+		APIKeysCollectionName:      "api_key",
+		LatestPricesCollectionName: "latest_price",
+		CheckpointsCollectionName:  "checkpoint",
+		JWTSecret:                  testJWTSecret,
 	}
 
 	t.Log("DBUri", DBUri)
@@ -173,7 +369,7 @@ func setupTest(t *testing.T) (*ApiHandler, func()) {
 	if err != nil {
 		t.Fatalf("Failed to create DB handler: %v", err)
 	}
-	api := NewApiHandler(dbh, nil, conf)
+	api := NewApiHandler(dbh, nil, conf, newTestValidation(t, conf))
 
 	// Return cleanup function
 	return api, func() {
@@ -200,6 +396,9 @@ func TestMain(m *testing.M) {
 	if mongoPool != nil && mongoResource != nil {
 		_ = mongoPool.Purge(mongoResource)
 	}
+	if mongoPool != nil && eventStoreResource != nil {
+		_ = mongoPool.Purge(eventStoreResource)
+	}
 
 	os.Exit(code)
 }
@@ -218,7 +417,7 @@ func TestDB(t *testing.T) {
 				defer cleanup()
 				l := logrus.WithField("test", "Insert ingredient in the DB")
 				price := &db.Price{
-					Price:     10.0,
+					Price:     money.MustParse("10"),
 					Devise:    "EUR",
 					ProductID: primitive.NewObjectID().Hex(),
 					ShopID:    primitive.NewObjectID().Hex(),
@@ -228,7 +427,7 @@ func TestDB(t *testing.T) {
 					t.Fatalf("Failed to insert price: %v", err)
 				}
 
-				if priceInserted.Price != 10.0 || priceInserted.Devise != "EUR" {
+				if priceInserted.Price != money.MustParse("10") || priceInserted.Devise != "EUR" {
 					t.Fatalf("Price not inserted: %v", priceInserted)
 				}
 
@@ -236,13 +435,19 @@ func TestDB(t *testing.T) {
 					t.Fatalf("ProductID or ShopID not valid: %v", priceInserted)
 				}
 
-				priceInserted.Price = 20.0
+				priceInserted.Price = money.MustParse("20")
 				priceInserted.Devise = "USD"
-				priceUpdated, err := api.dbh.UpdatePrice(l, priceInserted)
+				priceUpdated, err := api.dbh.UpdatePrice(l, priceInserted, priceInserted.Version)
 				if err != nil {
 					t.Fatalf("Failed to update price: %v", err)
 				}
-				if priceUpdated.Price != 20.0 || priceUpdated.Devise != "USD" {
+				if priceUpdated.Version != priceInserted.Version+1 {
+					t.Fatalf("Version not incremented: %v", priceUpdated)
+				}
+				if _, err := api.dbh.UpdatePrice(l, priceInserted, priceInserted.Version); err != db.ErrVersionMismatch {
+					t.Fatalf("Expected a version mismatch, got %v", err)
+				}
+				if priceUpdated.Price != money.MustParse("20") || priceUpdated.Devise != "USD" {
 					t.Fatalf("Price not updated: %v", priceUpdated)
 				}
 				if priceUpdated.ProductID != price.ProductID || priceUpdated.ShopID != price.ShopID {
@@ -264,7 +469,7 @@ func TestDB(t *testing.T) {
 					t.Fatalf("Failed to get prices: %v", err)
 				}
 
-				if price.Price != 20.0 || price.Devise != "USD" {
+				if price.Price != money.MustParse("20") || price.Devise != "USD" {
 					t.Fatalf("Price not updated: %v", price)
 				}
 
@@ -279,7 +484,7 @@ func TestDB(t *testing.T) {
 				defer cleanup()
 				l := logrus.WithField("test", "Find the latest price by date")
 				price := &db.Price{
-					Price:     10.0,
+					Price:     money.MustParse("10"),
 					Devise:    "EUR",
 					ProductID: primitive.NewObjectID().Hex(),
 					ShopID:    primitive.NewObjectID().Hex(),
@@ -289,7 +494,7 @@ func TestDB(t *testing.T) {
 				productId, _ := primitive.ObjectIDFromHex(price.ProductID)
 				shopId, _ := primitive.ObjectIDFromHex(price.ShopID)
 				price2 := &db.Price{
-					Price:     20.0,
+					Price:     money.MustParse("20"),
 					Devise:    "USD",
 					ProductID: productId.Hex(),
 					ShopID:    shopId.Hex(),
@@ -313,12 +518,851 @@ func TestDB(t *testing.T) {
 					t.Fatalf("Failed to get price: %v", err)
 				}
 
-				if getPrice.Price != 20.0 || getPrice.Devise != "USD" {
+				if getPrice.Price != money.MustParse("20") || getPrice.Devise != "USD" {
 					t.Fatalf("Latest price doesn't correspond: %v", getPrice)
 				}
 
 			},
 		},
+		{
+			name: "Filter the prices with a query",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Filter the prices with a query")
+				shopID := primitive.NewObjectID().Hex()
+				for _, p := range []string{"5", "10", "15"} {
+					price := &db.Price{
+						Price:     money.MustParse(p),
+						Devise:    "EUR",
+						ProductID: primitive.NewObjectID().Hex(),
+						ShopID:    shopID,
+						CreatedAt: time.Now(),
+						UpdatedAt: time.Now(),
+					}
+					if _, err := api.dbh.CreatePrice(l, price); err != nil {
+						t.Fatalf("Failed to insert price: %v", err)
+					}
+				}
+				other := &db.Price{
+					Price:     money.MustParse("10"),
+					Devise:    "EUR",
+					ProductID: primitive.NewObjectID().Hex(),
+					ShopID:    primitive.NewObjectID().Hex(),
+				}
+				if _, err := api.dbh.CreatePrice(l, other); err != nil {
+					t.Fatalf("Failed to insert price: %v", err)
+				}
+
+				minPrice, maxPrice := money.MustParse("6"), money.MustParse("20")
+				prices, err := api.dbh.GetPrices(l, &db.PriceQuery{
+					ShopID:   shopID,
+					MinPrice: &minPrice,
+					MaxPrice: &maxPrice,
+				}, nil)
+				if err != nil {
+					t.Fatalf("Failed to get prices: %v", err)
+				}
+
+				if len(prices.Items) != 2 {
+					t.Fatalf("Expected 2 prices, got %d: %v", len(prices.Items), prices)
+				}
+				for _, p := range prices.Items {
+					if p.ShopID != shopID || p.Price.Cmp(minPrice) < 0 {
+						t.Fatalf("Price doesn't match the query: %v", p)
+					}
+				}
+			},
+		},
+		{
+			name: "Normalize the prices with the densities of their products",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Normalize the prices with the densities of their products")
+
+				oil := &db.Ingredient{ID: api.dbh.NewID(), Name: "Oil-" + primitive.NewObjectID().Hex(), ImageURL: "oil.png", Type: "oil", Density: 0.9}
+				if err := api.dbh.InsertOne(l, oil); err != nil {
+					t.Fatalf("Failed to insert ingredient: %v", err)
+				}
+				shop := primitive.NewObjectID().Hex()
+				for _, product := range []string{oil.ID.Hex(), primitive.NewObjectID().Hex(), "not-an-id"} {
+					price := &db.Price{ShopID: shop, ProductID: product, Price: money.MustParse("9"), Devise: "EUR", Quantity: 1, Unit: units.Litre}
+					if _, err := api.dbh.CreatePrice(l, price); err != nil {
+						t.Fatalf("Failed to insert price: %v", err)
+					}
+				}
+				found, err := api.dbh.FindIngredientsByIDs(l, []string{oil.ID.Hex(), primitive.NewObjectID().Hex(), "not-an-id"})
+				if err != nil || len(*found) != 1 || (*found)[0].ID != oil.ID {
+					t.Fatalf("Expected the existing ingredient only, got %+v, %v", found, err)
+				}
+
+				// The products missing have no density, their prices no unit price
+				e := newTestServer(api)
+				rec := serve(e, http.MethodGet, "/v1/price?shopId="+shop+"&unit=kg", testToken(t, "reader", RoleReader), "", "", nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to get prices: %d %s", rec.Code, rec.Body)
+				}
+				var prices db.Page[db.Price]
+				if err := json.Unmarshal(rec.Body.Bytes(), &prices); err != nil {
+					t.Fatalf("Failed to decode the prices: %v", err)
+				}
+				if len(prices.Items) != 3 {
+					t.Fatalf("Expected 3 prices, got %+v", prices.Items)
+				}
+				for _, price := range prices.Items {
+					if price.ProductID == oil.ID.Hex() {
+						if price.UnitPrice == nil || price.UnitPrice.Price != money.MustParse("10") {
+							t.Fatalf("Expected the unit price of the oil, got %+v", price.UnitPrice)
+						}
+					} else if price.UnitPrice != nil {
+						t.Fatalf("Expected no unit price without density, got %+v", price)
+					}
+				}
+			},
+		},
+		{
+			name: "Paginate the shops sorted by name",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Paginate the shops sorted by name")
+				for _, name := range []string{"Lidl", "Aldi", "Coop", "Migros", "Denner"} {
+					if _, err := api.dbh.CreateShop(l, &db.Shop{Name: name}); err != nil {
+						t.Fatalf("Failed to insert shop: %v", err)
+					}
+				}
+
+				var names []string
+				page := &db.Pagination{Limit: 2, Sort: "name", WithTotal: true}
+				for {
+					shops, err := api.dbh.GetShops(l, page)
+					if err != nil {
+						t.Fatalf("Failed to get shops: %v", err)
+					}
+					if shops.Total == nil || *shops.Total != 5 {
+						t.Fatalf("Total not set: %v", shops.Total)
+					}
+					for _, shop := range shops.Items {
+						names = append(names, shop.Name)
+					}
+					if shops.NextCursor == "" {
+						break
+					}
+					page.Cursor = shops.NextCursor
+				}
+
+				expected := []string{"Aldi", "Coop", "Denner", "Lidl", "Migros"}
+				if fmt.Sprint(names) != fmt.Sprint(expected) {
+					t.Fatalf("Expected %v, got %v", expected, names)
+				}
+			},
+		},
+		{
+			name: "Paginate the API keys in descending order of a missing field",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Paginate the API keys in descending order of a missing field")
+				prefix := primitive.NewObjectID().Hex()
+				used := time.Now().Truncate(time.Millisecond)
+				for i, name := range []string{"unused-1", "early", "unused-2", "late"} {
+					key, err := api.dbh.CreateAPIKey(l, &db.APIKey{Name: prefix + name, Hash: prefix + name, Scopes: []string{"reader"}})
+					if err != nil {
+						t.Fatalf("Failed to insert API key: %v", err)
+					}
+					if !strings.HasPrefix(name, "unused") {
+						if err := api.dbh.RecordAPIKeyUsage(l, key.ID, used.Add(time.Duration(i)*time.Minute)); err != nil {
+							t.Fatalf("Failed to record the usage: %v", err)
+						}
+					}
+				}
+
+				var names []string
+				page := &db.Pagination{Limit: 1, Sort: "-lastUsedAt"}
+				for {
+					keys, err := api.dbh.GetAPIKeys(l, page)
+					if err != nil {
+						t.Fatalf("Failed to get API keys: %v", err)
+					}
+					for _, key := range keys.Items {
+						if strings.HasPrefix(key.Name, prefix) {
+							names = append(names, strings.TrimPrefix(key.Name, prefix))
+						}
+					}
+					if keys.NextCursor == "" {
+						break
+					}
+					page.Cursor = keys.NextCursor
+				}
+
+				// The keys never used come last, the latest inserted first
+				expected := []string{"late", "early", "unused-2", "unused-1"}
+				if fmt.Sprint(names) != fmt.Sprint(expected) {
+					t.Fatalf("Expected %v, got %v", expected, names)
+				}
+			},
+		},
+		{
+			name: "Import an ECB file skipping the retired currencies",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Import an ECB file skipping the retired currencies")
+
+				e := newTestServer(api)
+				rec := serve(e, http.MethodPost, "/v1/rate/import", testToken(t, "admin", RoleAdmin), "text/csv",
+					"Date, USD, CYP, JPY,\n1999-01-04, 1.1789, 0.58231, 133.73,\n", nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to import the file: %d %s", rec.Code, rec.Body)
+				}
+				if body := strings.TrimSpace(rec.Body.String()); body != `{"imported":2,"read":3,"skipped":["CYP"]}` {
+					t.Fatalf("Unexpected response: %s", body)
+				}
+				at := time.Date(1999, time.January, 4, 0, 0, 0, 0, time.UTC)
+				if _, err := api.dbh.FindExchangeRate(l, "EUR", "JPY", at); err != nil {
+					t.Fatalf("Failed to find the imported rate: %v", err)
+				}
+				if _, err := api.dbh.FindExchangeRate(l, "EUR", "CYP", at); err != mongo.ErrNoDocuments {
+					t.Fatalf("Expected the retired currency skipped, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Find the shops near a position",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Find the shops near a position")
+				shops := []*db.Shop{
+					{Name: "Basel", Coordinates: db.NewGeoPoint(47.5596, 7.5886)},
+					{Name: "Weil am Rhein", Coordinates: db.NewGeoPoint(47.5947, 7.6108)},
+					{Name: "Zurich", Coordinates: db.NewGeoPoint(47.3769, 8.5417)},
+					{Name: "Nowhere"},
+				}
+				for _, shop := range shops {
+					if _, err := api.dbh.CreateShop(l, shop); err != nil {
+						t.Fatalf("Failed to insert shop: %v", err)
+					}
+				}
+
+				nearby, err := api.dbh.GetShopsNear(l, db.NewGeoPoint(47.5580, 7.5870), 10000, 10)
+				if err != nil {
+					t.Fatalf("Failed to get nearby shops: %v", err)
+				}
+				if len(*nearby) != 2 {
+					t.Fatalf("Expected 2 shops, got %v", nearby)
+				}
+				if (*nearby)[0].Name != "Basel" || (*nearby)[0].Distance > (*nearby)[1].Distance {
+					t.Fatalf("Shops not sorted by distance: %v", nearby)
+				}
+			},
+		},
+		{
+			name: "Authenticate with an API key until it is revoked",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Authenticate with an API key until it is revoked")
+
+				key, err := generateAPIKey()
+				if err != nil {
+					t.Fatalf("Failed to generate API key: %v", err)
+				}
+				inserted, err := api.dbh.CreateAPIKey(l, NewInsertAPIKey(&InsertAPIKey{Name: "scraper", Scopes: []string{"contributor"}}, key))
+				if err != nil {
+					t.Fatalf("Failed to insert API key: %v", err)
+				}
+
+				claims, err := api.authenticateAPIKey(l, key)
+				if err != nil {
+					t.Fatalf("Failed to authenticate: %v", err)
+				}
+				if !claims.HasRole(RoleContributor) || claims.HasRole(RoleAdmin) || claims.APIKeyID != inserted.ID.Hex() {
+					t.Fatalf("Unexpected claims: %+v", claims)
+				}
+
+				stored, err := api.dbh.FindAPIKeyByHash(l, HashAPIKey(key))
+				if err != nil {
+					t.Fatalf("Failed to find API key: %v", err)
+				}
+				if stored.UsageCount != 1 || stored.LastUsedAt == nil {
+					t.Fatalf("Usage not recorded: %+v", stored)
+				}
+
+				e := newTestServer(api)
+				withKey := func(key string) http.Header {
+					header := http.Header{}
+					header.Set(HeaderAPIKey, key)
+					return header
+				}
+				if rec := serve(e, http.MethodGet, "/v1/ingredient/type/vegetable", "", "", "", withKey(key)); rec.Code != http.StatusOK {
+					t.Fatalf("Expected the API key to be accepted, got %d %s", rec.Code, rec.Body)
+				}
+				rec := serve(e, http.MethodDelete, "/v1/ingredient/"+primitive.NewObjectID().Hex(), "", "", "", withKey(key))
+				if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), CodeInsufficientRole) {
+					t.Fatalf("Expected the scopes of the API key to be enforced, got %d %s", rec.Code, rec.Body)
+				}
+				rec = serve(e, http.MethodGet, "/v1/ingredient/type/vegetable", "", "", "", withKey(apiKeyPrefix+"unknown"))
+				if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), CodeInvalidAPIKey) {
+					t.Fatalf("Expected an unknown API key to be rejected, got %d %s", rec.Code, rec.Body)
+				}
+
+				if err := api.dbh.RevokeAPIKey(l, inserted.ID); err != nil {
+					t.Fatalf("Failed to revoke API key: %v", err)
+				}
+				if _, err := api.authenticateAPIKey(l, key); err == nil {
+					t.Fatal("Revoked API key accepted")
+				}
+				rec = serve(e, http.MethodGet, "/v1/ingredient/type/vegetable", "", "", "", withKey(key))
+				if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), CodeInvalidAPIKey) {
+					t.Fatalf("Expected the revoked API key to be rejected, got %d %s", rec.Code, rec.Body)
+				}
+			},
+		},
+		{
+			name: "Soft-delete, restore and purge an ingredient",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Soft-delete, restore and purge an ingredient")
+
+				ingredient := &db.Ingredient{ID: api.dbh.NewID(), Name: "Rutabaga", ImageURL: "rutabaga.png", Type: "vegetable"}
+				if err := api.dbh.InsertOne(l, ingredient); err != nil {
+					t.Fatalf("Failed to insert ingredient: %v", err)
+				}
+
+				if err := api.dbh.DeleteIngredient(l, ingredient.ID, ingredient.Version+1, nil); err != db.ErrVersionMismatch {
+					t.Fatalf("Expected a version mismatch, got %v", err)
+				}
+				if err := api.dbh.DeleteIngredient(l, ingredient.ID, ingredient.Version, nil); err != nil {
+					t.Fatalf("Failed to delete ingredient: %v", err)
+				}
+				if _, err := api.dbh.FindByID(l, ingredient.ID.Hex()); err != mongo.ErrNoDocuments {
+					t.Fatalf("Deleted ingredient found by ID: %v", err)
+				}
+				if _, err := api.dbh.FindByName(l, "Rutabaga"); err != mongo.ErrNoDocuments {
+					t.Fatalf("Deleted ingredient found by name: %v", err)
+				}
+				if err := api.dbh.DeleteIngredient(l, ingredient.ID, db.AnyVersion, nil); err != mongo.ErrNoDocuments {
+					t.Fatalf("Expected the ingredient to be already deleted, got %v", err)
+				}
+
+				restored, err := api.dbh.RestoreIngredient(l, ingredient.ID)
+				if err != nil {
+					t.Fatalf("Failed to restore ingredient: %v", err)
+				}
+				if restored.DeletedAt != nil || restored.Name != "Rutabaga" {
+					t.Fatalf("Unexpected restored ingredient: %+v", restored)
+				}
+				if err := api.dbh.PurgeIngredient(l, ingredient.ID, nil); err != mongo.ErrNoDocuments {
+					t.Fatalf("Expected only deleted ingredients to be purged, got %v", err)
+				}
+
+				if err := api.dbh.DeleteIngredient(l, ingredient.ID, db.AnyVersion, nil); err != nil {
+					t.Fatalf("Failed to delete ingredient: %v", err)
+				}
+				if err := api.dbh.PurgeIngredient(l, ingredient.ID, nil); err != nil {
+					t.Fatalf("Failed to purge ingredient: %v", err)
+				}
+				if _, err := api.dbh.RestoreIngredient(l, ingredient.ID); err != mongo.ErrNoDocuments {
+					t.Fatalf("Purged ingredient restored: %v", err)
+				}
+			},
+		},
+		{
+			name: "Keep an ingredient failing its removal check",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Keep an ingredient failing its removal check")
+
+				name := "Salsify-" + primitive.NewObjectID().Hex()
+				ingredient := &db.Ingredient{ID: api.dbh.NewID(), Name: name, ImageURL: "salsify.png", Type: "vegetable"}
+				if err := api.dbh.InsertOne(l, ingredient); err != nil {
+					t.Fatalf("Failed to insert ingredient: %v", err)
+				}
+
+				// The check runs while the ingredient is still live
+				errReferenced := errors.New("referenced")
+				referenced := func() error {
+					if _, err := api.dbh.FindByID(l, ingredient.ID.Hex()); err != nil {
+						t.Fatalf("Expected the check to run before the ingredient is deleted, got %v", err)
+					}
+					return errReferenced
+				}
+				if err := api.dbh.DeleteIngredient(l, ingredient.ID, ingredient.Version, referenced); err != errReferenced {
+					t.Fatalf("Expected the check error, got %v", err)
+				}
+				kept, err := api.dbh.FindByID(l, ingredient.ID.Hex())
+				if err != nil || kept.Version != ingredient.Version {
+					t.Fatalf("Expected the ingredient untouched, got %+v, %v", kept, err)
+				}
+				if err := api.dbh.DeleteIngredient(l, ingredient.ID, ingredient.Version+1, referenced); !errors.Is(err, db.ErrVersionMismatch) {
+					t.Fatalf("Expected a version mismatch before the check, got %v", err)
+				}
+
+				if err := api.dbh.DeleteIngredient(l, ingredient.ID, ingredient.Version, nil); err != nil {
+					t.Fatalf("Failed to delete ingredient: %v", err)
+				}
+				if err := api.dbh.PurgeIngredient(l, ingredient.ID, func() error { return errReferenced }); err != errReferenced {
+					t.Fatalf("Expected the check error, got %v", err)
+				}
+				if err := api.dbh.PurgeIngredient(l, api.dbh.NewID(), func() error { return errReferenced }); err != mongo.ErrNoDocuments {
+					t.Fatalf("Expected a missing ingredient before the check, got %v", err)
+				}
+
+				// The name was taken while the ingredient was deleted
+				taken := &db.Ingredient{ID: api.dbh.NewID(), Name: name, ImageURL: "salsify.png", Type: "vegetable"}
+				if err := api.dbh.InsertOne(l, taken); err != nil {
+					t.Fatalf("Failed to insert ingredient: %v", err)
+				}
+				if _, err := api.dbh.RestoreIngredient(l, ingredient.ID); !errors.Is(err, db.ErrDuplicateName) {
+					t.Fatalf("Expected a duplicate name, got %v", err)
+				}
+				e := newTestServer(api)
+				rec := serve(e, http.MethodPost, "/v1/ingredient/"+ingredient.ID.Hex()+"/restore", testToken(t, "admin", RoleAdmin), "", "", nil)
+				if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), CodeIngredientDuplicateName) {
+					t.Fatalf("Expected a duplicate name conflict, got %d %s", rec.Code, rec.Body)
+				}
+
+				if err := api.dbh.DeleteIngredient(l, taken.ID, db.AnyVersion, nil); err != nil {
+					t.Fatalf("Failed to delete ingredient: %v", err)
+				}
+				if _, err := api.dbh.RestoreIngredient(l, ingredient.ID); err != nil {
+					t.Fatalf("Failed to restore the ingredient kept by the purge: %v", err)
+				}
+			},
+		},
+		{
+			name: "Import and export ingredients",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Import and export ingredients")
+
+				existing := &db.Ingredient{ID: api.dbh.NewID(), Name: "Parsnip", ImageURL: "parsnip.png", Type: "vegetable"}
+				if err := api.dbh.InsertOne(l, existing); err != nil {
+					t.Fatalf("Failed to insert ingredient: %v", err)
+				}
+
+				imported := []db.IngredientImport{
+					{Ingredient: db.Ingredient{ID: existing.ID, Name: "Parsnip", ImageURL: "parsnip-root.png", Type: "vegetable", Names: map[string]string{"fr": "Panais"}}, Fields: []string{"density", "names.fr"}},
+					{Ingredient: db.Ingredient{ID: api.dbh.NewID(), Name: "Celeriac", ImageURL: "celeriac.png", Type: "vegetable", Density: 0.6}, Fields: []string{"density"}},
+				}
+				for _, ingredient := range imported {
+					if err := api.validation.Validate.Struct(&ingredient.Ingredient); err != nil {
+						t.Fatalf("Invalid fixture %s: %v", ingredient.Ingredient.Name, err)
+					}
+				}
+				if err := api.dbh.ImportIngredients(l, imported); err != nil {
+					t.Fatalf("Failed to import ingredients: %v", err)
+				}
+
+				found, err := api.dbh.FindIngredientsByNames(l, []string{"Parsnip", "Celeriac", "Kohlrabi"})
+				if err != nil {
+					t.Fatalf("Failed to find ingredients: %v", err)
+				}
+				if len(*found) != 2 {
+					t.Fatalf("Expected 2 ingredients, got %d", len(*found))
+				}
+				updated, err := api.dbh.FindByID(l, existing.ID.Hex())
+				if err != nil {
+					t.Fatalf("Failed to find the updated ingredient: %v", err)
+				}
+				if updated.ImageURL != "parsnip-root.png" || updated.Names["fr"] != "Panais" || updated.Version != existing.Version+1 {
+					t.Fatalf("Unexpected updated ingredient: %+v", updated)
+				}
+				// The localized name given alone by the file is indexed with the stored ones
+				if byName, err := api.dbh.FindByName(l, "Panais"); err != nil || byName.ID != existing.ID {
+					t.Fatalf("Expected to find the ingredient by its imported localized name, got %+v, %v", byName, err)
+				}
+
+				// The imported names are searched, with a typo
+				results, err := api.dbh.SearchIngredients(l, "panias", db.DefaultSearchLimit)
+				if err != nil || len(*results) == 0 || (*results)[0].ID != existing.ID {
+					t.Fatalf("Expected to search the ingredient by its imported localized name, got %+v, %v", results, err)
+				}
+				if results, err := api.dbh.SearchIngredients(l, "  ", db.DefaultSearchLimit); err != nil || len(*results) != 0 {
+					t.Fatalf("Expected no result for an empty query, got %+v, %v", results, err)
+				}
+
+				// A file without the optional columns keeps them
+				e := newTestServer(api)
+				rec := serve(e, http.MethodPost, "/v1/ingredient/import", testToken(t, "admin", RoleAdmin), bulk.MIMECSV,
+					"name,type,image_url\nCeleriac,vegetable,celeriac-2.png\n", nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to import the file: %d %s", rec.Code, rec.Body)
+				}
+				// The format of an uploaded file is given by its extension
+				upload := func(filename, content string) *httptest.ResponseRecorder {
+					var body bytes.Buffer
+					form := multipart.NewWriter(&body)
+					part, err := form.CreateFormFile("file", filename)
+					if err != nil {
+						t.Fatalf("Failed to create the form file: %v", err)
+					}
+					if _, err := part.Write([]byte(content)); err != nil {
+						t.Fatalf("Failed to write the form file: %v", err)
+					}
+					if err := form.Close(); err != nil {
+						t.Fatalf("Failed to close the form: %v", err)
+					}
+					return serve(e, http.MethodPost, "/v1/ingredient/import?dryRun=true", testToken(t, "admin", RoleAdmin), form.FormDataContentType(), body.String(), nil)
+				}
+				if rec := upload("ingredients.xlsx", "name,type\nSalsify,vegetable\n"); rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), CodeUnsupportedMediaType) {
+					t.Fatalf("Expected an unsupported media type, got %d %s", rec.Code, rec.Body)
+				}
+				if rec := upload("ingredients.csv", "name,type\nSalsify,vegetable\n"); rec.Code != http.StatusOK {
+					t.Fatalf("Failed to upload the file: %d %s", rec.Code, rec.Body)
+				}
+
+				celeriac, err := api.dbh.FindByName(l, "Celeriac")
+				if err != nil {
+					t.Fatalf("Failed to find the imported ingredient: %v", err)
+				}
+				if celeriac.ImageURL != "celeriac-2.png" || celeriac.Density != 0.6 {
+					t.Fatalf("Expected the density kept, got %+v", celeriac)
+				}
+
+				locales, err := api.dbh.IngredientLocales(l)
+				if err != nil {
+					t.Fatalf("Failed to list locales: %v", err)
+				}
+				if len(locales) != 1 || locales[0] != "fr" {
+					t.Fatalf("Unexpected locales: %v", locales)
+				}
+
+				names := make([]string, 0)
+				err = api.dbh.ExportIngredients(l, func(ingredient *db.Ingredient) error {
+					names = append(names, ingredient.Name)
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("Failed to export ingredients: %v", err)
+				}
+				if !sort.StringsAreSorted(names) || len(names) < 2 {
+					t.Fatalf("Unexpected export: %v", names)
+				}
+			},
+		},
+		{
+			name: "Save a batch of prices",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Save a batch of prices")
+
+				newPrice := func(productID, amount string) *db.Price {
+					return &db.Price{ProductID: productID, ShopID: "batch-shop", Price: money.MustParse(amount), Devise: "EUR", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+				}
+				writes, err := api.savePrices(l, []*db.Price{newPrice("p1", "1.5"), newPrice("p2", "3"), newPrice("p1", "1.5")})
+				if err != nil {
+					t.Fatalf("Failed to save prices: %v", err)
+				}
+				if writes[0] != writes[2] || writes[0].Refresh || writes[1].Refresh {
+					t.Fatalf("Expected two new prices, got %+v", writes)
+				}
+
+				writes, err = api.savePrices(l, []*db.Price{newPrice("p1", "1.5"), newPrice("p2", "4")})
+				if err != nil {
+					t.Fatalf("Failed to save prices: %v", err)
+				}
+				if !writes[0].Refresh || writes[0].Price.Version != 2 || writes[1].Refresh {
+					t.Fatalf("Expected a refreshed and a new price, got %+v %+v", writes[0], writes[1])
+				}
+				last, err := api.dbh.GetLastUpdatedPrice(l, "batch-shop", "p2")
+				if err != nil {
+					t.Fatalf("Failed to get last updated price: %v", err)
+				}
+				if last.Price != money.MustParse("4") {
+					t.Fatalf("Expected the new price to be the last one, got %v", last.Price)
+				}
+			},
+		},
+		{
+			name: "Project the latest prices",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Project the latest prices")
+				mh := api.dbh.(*db.MongoHandler)
+
+				newPrice := func(amount string, version int64) *db.Price {
+					return &db.Price{ProductID: "projected-product", ShopID: "projected-shop", Price: money.MustParse(amount), Devise: "EUR", UpdatedAt: time.Now(), Version: version}
+				}
+				for _, price := range []*db.Price{newPrice("1", 1), newPrice("2", 2), newPrice("1", 1), newPrice("2", 2)} {
+					if err := mh.ProjectPrice(l, price); err != nil {
+						t.Fatalf("Failed to project price: %v", err)
+					}
+				}
+
+				prices, err := mh.GetProjectedLatestPrices(l, []string{"projected-product"})
+				if err != nil {
+					t.Fatalf("Failed to get projected prices: %v", err)
+				}
+				if len(*prices) != 1 || (*prices)[0].Price != money.MustParse("2") || (*prices)[0].Version != 2 {
+					t.Fatalf("Expected the latest version only, got %+v", *prices)
+				}
+
+				if _, err := mh.GetCheckpoint(l, "projected"); err != mongo.ErrNoDocuments {
+					t.Fatalf("Expected no checkpoint, got %v", err)
+				}
+				if err := mh.SaveCheckpoint(l, &db.Checkpoint{Name: "projected", Commit: 42, Prepare: 42}); err != nil {
+					t.Fatalf("Failed to save checkpoint: %v", err)
+				}
+				checkpoint, err := mh.GetCheckpoint(l, "projected")
+				if err != nil || checkpoint.Commit != 42 {
+					t.Fatalf("Unexpected checkpoint %+v, %v", checkpoint, err)
+				}
+			},
+		},
+		{
+			name: "Report a failed rebuild without its cause",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				// The Mongo handler fails the rebuild, having no event store
+				api.conf.EventStoreURI = "esdb://localhost:2113"
+				e := newTestServer(api)
+				token := testToken(t, "admin", RoleAdmin)
+
+				rec := serve(e, http.MethodPost, "/v1/projection/rebuild", token, "", "", nil)
+				if rec.Code != http.StatusAccepted {
+					t.Fatalf("Failed to start the rebuild: %d %s", rec.Code, rec.Body)
+				}
+				var status RebuildStatus
+				for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+					rec = serve(e, http.MethodGet, "/v1/projection/rebuild", token, "", "", nil)
+					if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+						t.Fatalf("Failed to decode the status: %v", err)
+					}
+					if !status.Running {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("The rebuild didn't end")
+					}
+				}
+				if status.Error != CodeRebuildFailed || strings.Contains(rec.Body.String(), db.ErrNoProjection.Error()) {
+					t.Fatalf("Expected the failure code only, got %s", rec.Body)
+				}
+			},
+		},
+		{
+			name: "Rebuild the projection from a position",
+			test: func(t *testing.T) {
+				api, mh, client, cleanup := setupEventStoreTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Rebuild the projection from a position")
+
+				product := primitive.NewObjectID().Hex()
+				older := &db.Price{ProductID: product, ShopID: "older-shop", Price: money.MustParse("1"), Devise: "EUR"}
+				newer := &db.Price{ProductID: product, ShopID: "newer-shop", Price: money.MustParse("2"), Devise: "EUR"}
+				for _, price := range []*db.Price{older, newer} {
+					created, err := api.dbh.CreatePrice(l, price)
+					if err != nil {
+						t.Fatalf("Failed to create price: %v", err)
+					}
+					if err := mh.ProjectPrice(l, created); err != nil {
+						t.Fatalf("Failed to project price: %v", err)
+					}
+				}
+				events := readStream(t, client, "price-newer-shop-"+product)
+				position := events[len(events)-1].Position
+				if err := mh.SaveCheckpoint(l, &db.Checkpoint{Name: "latest-prices", Commit: position.Commit, Prepare: position.Prepare}); err != nil {
+					t.Fatalf("Failed to save checkpoint: %v", err)
+				}
+
+				report, err := api.dbh.RebuildPriceProjection(l, &db.RebuildOptions{
+					From: &db.Position{Commit: position.Commit, Prepare: position.Prepare},
+				}, nil)
+				if err != nil {
+					t.Fatalf("Failed to rebuild the projection: %v", err)
+				}
+				if !report.Swapped || report.Seeded < 2 {
+					t.Fatalf("Expected the projection seeded and swapped, got %+v", report)
+				}
+
+				prices, err := mh.GetProjectedLatestPrices(l, []string{product})
+				if err != nil {
+					t.Fatalf("Failed to get projected prices: %v", err)
+				}
+				shops := make([]string, 0)
+				for _, price := range *prices {
+					shops = append(shops, price.ShopID)
+				}
+				sort.Strings(shops)
+				if len(shops) != 2 || shops[0] != "newer-shop" || shops[1] != "older-shop" {
+					t.Fatalf("Expected the prices before the position to survive, got %v", shops)
+				}
+			},
+		},
+		{
+			name: "Patch an ingredient to remove its optional fields",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				e := newTestServer(api)
+				token := testToken(t, "admin", RoleAdmin)
+
+				name := "patched-" + primitive.NewObjectID().Hex()
+				rec := serve(e, http.MethodPost, "/v1/ingredient", token, echo.MIMEApplicationJSON,
+					`{"name":"`+name+`","image_url":"https://example.com/flour.png","type":"cereals","density":0.6,"names":{"fr":"farine"}}`, nil)
+				if rec.Code != http.StatusCreated {
+					t.Fatalf("Failed to create ingredient: %d %s", rec.Code, rec.Body)
+				}
+				var created db.Ingredient
+				if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+					t.Fatalf("Failed to decode ingredient: %v", err)
+				}
+				path := "/v1/ingredient/" + created.ID.Hex()
+
+				read := func() map[string]any {
+					rec := serve(e, http.MethodGet, path, token, "", "", nil)
+					if rec.Code != http.StatusOK {
+						t.Fatalf("Failed to get ingredient: %d %s", rec.Code, rec.Body)
+					}
+					var stored map[string]any
+					if err := json.Unmarshal(rec.Body.Bytes(), &stored); err != nil {
+						t.Fatalf("Failed to decode ingredient: %v", err)
+					}
+					return stored
+				}
+
+				rec = serve(e, http.MethodPatch, path, token, patch.MIMEMergePatch, `{"density":null}`, nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to merge patch ingredient: %d %s", rec.Code, rec.Body)
+				}
+				if stored := read(); stored["density"] != nil || stored["names"] == nil {
+					t.Fatalf("Expected the density removed and the names kept, got %v", stored)
+				}
+
+				rec = serve(e, http.MethodPatch, path, token, patch.MIMEJSONPatch, `[{"op":"remove","path":"/names"}]`, nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to JSON patch ingredient: %d %s", rec.Code, rec.Body)
+				}
+				if stored := read(); stored["names"] != nil || stored["name"] != name {
+					t.Fatalf("Expected the names removed, got %v", stored)
+				}
+				if _, err := api.dbh.FindByName(logrus.WithField("test", "patch"), "farine"); err != mongo.ErrNoDocuments {
+					t.Fatalf("Expected the removed localized name not to be found, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Process a redelivered price message once",
+			test: func(t *testing.T) {
+				api, _, client, cleanup := setupEventStoreTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Process a redelivered price message once")
+
+				product := primitive.NewObjectID().Hex()
+				body := `{"productId":"` + product + `","shopId":"redelivered-shop","price":"3.20","devise":"EUR","date":"2024-03-01T10:00:00Z"}`
+				msg := amqp.Delivery{MessageId: "message-" + product, UserId: "scanner", Body: []byte(body)}
+				for i := 0; i < 2; i++ {
+					if err := api.processAddPriceMessage(context.Background(), l, msg); err != nil {
+						t.Fatalf("Failed to process message: %v", err)
+					}
+				}
+				stream := "price-redelivered-shop-" + product
+				events := readStream(t, client, stream)
+				if len(events) != 1 {
+					t.Fatalf("Expected a single event, got %d", len(events))
+				}
+				var metadata db.EventMetadata
+				if err := json.Unmarshal(events[0].UserMetadata, &metadata); err != nil {
+					t.Fatalf("Failed to read metadata: %v", err)
+				}
+				if metadata.CausationID != msg.MessageId || metadata.Actor != "scanner" || metadata.Source != db.SourceAMQP {
+					t.Fatalf("Unexpected metadata %+v", metadata)
+				}
+
+				// Another message of the same price only refreshes it
+				msg.MessageId = "other-" + product
+				if err := api.processAddPriceMessage(context.Background(), l, msg); err != nil {
+					t.Fatalf("Failed to process message: %v", err)
+				}
+				events = readStream(t, client, stream)
+				if len(events) != 2 || events[1].EventType != db.PriceUpdatedEventType {
+					t.Fatalf("Expected the price refreshed, got %d events", len(events))
+				}
+			},
+		},
+		{
+			name: "Get the prices in effect at a date",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				l := logrus.WithField("test", "Get the prices in effect at a date")
+
+				day := func(d int) time.Time {
+					return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC)
+				}
+				// Received on the 5th, observed on the 2nd and refreshed on the 20th
+				prices := []*db.Price{
+					{ProductID: "at-product", ShopID: "at-shop", Price: money.MustParse("1"), Devise: "EUR", CreatedAt: day(5), UpdatedAt: day(2)},
+					{ProductID: "at-product", ShopID: "at-shop", Price: money.MustParse("2"), Devise: "EUR", CreatedAt: day(10), UpdatedAt: day(20)},
+					{ProductID: "at-product", ShopID: "other-shop", Price: money.MustParse("3"), Devise: "EUR", CreatedAt: day(1), UpdatedAt: day(1)},
+				}
+				for _, price := range prices {
+					if _, err := api.dbh.CreatePrice(l, price); err != nil {
+						t.Fatalf("Failed to create price: %v", err)
+					}
+				}
+
+				if _, err := api.dbh.GetPriceAt(l, "at-shop", "at-product", day(1)); err != mongo.ErrNoDocuments {
+					t.Fatalf("Expected no price before the first one, got %v", err)
+				}
+				price, err := api.dbh.GetPriceAt(l, "at-shop", "at-product", day(3))
+				if err != nil || price.Price != money.MustParse("1") {
+					t.Fatalf("Expected the observed price, got %+v, %v", price, err)
+				}
+				price, err = api.dbh.GetPriceAt(l, "at-shop", "at-product", day(15))
+				if err != nil || price.Price != money.MustParse("2") {
+					t.Fatalf("Expected the second price, got %+v, %v", price, err)
+				}
+
+				catalog, err := api.dbh.GetPricesAt(l, "", "at-product", day(3))
+				if err != nil {
+					t.Fatalf("Failed to get the catalog prices: %v", err)
+				}
+				if len(*catalog) != 2 || (*catalog)[0].ShopID != "at-shop" || (*catalog)[1].Price != money.MustParse("3") {
+					t.Fatalf("Unexpected catalog prices: %+v", *catalog)
+				}
+			},
+		},
+		{
+			name: "Return a problem for a missing ingredient",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				e := newTestServer(api)
+				token := testToken(t, "admin", RoleAdmin)
+
+				missing := primitive.NewObjectID().Hex()
+				requests := []struct {
+					method, path, body string
+				}{
+					{http.MethodPut, "/v1/ingredient/" + missing, `{"name":"missing","image_url":"https://example.com/missing.png","type":"vegetable"}`},
+					{http.MethodGet, "/v1/ingredient/" + missing, ""},
+					{http.MethodGet, "/v1/ingredient/name/missing-" + missing, ""},
+				}
+				for _, r := range requests {
+					rec := serve(e, r.method, r.path, token, echo.MIMEApplicationJSON, r.body, nil)
+					if rec.Code != http.StatusNotFound || rec.Header().Get(echo.HeaderContentType) != MIMEProblemJSON {
+						t.Fatalf("Expected a not found problem for %s %s, got %d %s", r.method, r.path, rec.Code, rec.Body)
+					}
+					var problem Problem
+					if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+						t.Fatalf("Failed to decode problem: %v", err)
+					}
+					if problem.Code != CodeIngredientNotFound || problem.Instance != r.path || problem.Detail != genericDetails[http.StatusNotFound] {
+						t.Fatalf("Unexpected problem for %s %s: %+v", r.method, r.path, problem)
+					}
+				}
+			},
+		},
 	}
 	for _, tt := range tests {
 		tt := tt // capture range variable
@@ -328,3 +1372,377 @@ func TestDB(t *testing.T) {
 		})
 	}
 }
+
+func TestCorrelate(t *testing.T) {
+	api := newTestApiHandler(t, &configuration.Configuration{JWTSecret: testJWTSecret})
+	e := echo.New()
+	e.Use(Correlate)
+	var ec db.EventContext
+	handler := func(c echo.Context) error {
+		ec = db.EventContextFrom(c.Request().Context())
+		return c.NoContent(http.StatusNoContent)
+	}
+	e.GET("/public", handler)
+	e.GET("/private", handler, api.Authenticate)
+
+	header := http.Header{}
+	header.Set(echo.HeaderXRequestID, "request-1")
+	header.Set(HeaderCorrelationID, "correlation-1")
+	rec := serve(e, http.MethodGet, "/public", "", "", "", header)
+	if ec != (db.EventContext{CorrelationID: "correlation-1", CausationID: "request-1", Source: db.SourceAPI}) {
+		t.Fatalf("Unexpected event context %+v", ec)
+	}
+	if rec.Header().Get(HeaderCorrelationID) != "correlation-1" {
+		t.Fatalf("Expected the correlation ID in the response, got %q", rec.Header().Get(HeaderCorrelationID))
+	}
+
+	// Without headers, the request gets an ID which also correlates it
+	rec = serve(e, http.MethodGet, "/public", "", "", "", nil)
+	if _, err := uuid.Parse(ec.CausationID); err != nil {
+		t.Fatalf("Expected a generated request ID, got %q", ec.CausationID)
+	}
+	if ec.CorrelationID != ec.CausationID || rec.Header().Get(HeaderCorrelationID) != ec.CorrelationID {
+		t.Fatalf("Expected the request ID as correlation ID, got %+v", ec)
+	}
+
+	rec = serve(e, http.MethodGet, "/private", testToken(t, "alice", RoleReader), "", "", header)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Failed to authenticate: %d %s", rec.Code, rec.Body)
+	}
+	if ec.Actor != "alice" || ec.CorrelationID != "correlation-1" {
+		t.Fatalf("Expected the subject of the token as actor, got %+v", ec)
+	}
+}
+
+func TestMessageEventContext(t *testing.T) {
+	body := []byte(`{"price":"1"}`)
+	sum := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		msg      amqp.Delivery
+		expected db.EventContext
+	}{
+		{
+			name:     "With IDs",
+			msg:      amqp.Delivery{MessageId: "m1", CorrelationId: "c1", UserId: "user", AppId: "app", Body: body},
+			expected: db.EventContext{CorrelationID: "c1", CausationID: "m1", Actor: "user", Source: db.SourceAMQP},
+		},
+		{
+			name:     "Without IDs",
+			msg:      amqp.Delivery{AppId: "app", Body: body},
+			expected: db.EventContext{CorrelationID: bodyHash, CausationID: bodyHash, Actor: "app", Source: db.SourceAMQP},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ec := messageEventContext(tt.msg); ec != tt.expected {
+				t.Fatalf("Expected %+v, got %+v", tt.expected, ec)
+			}
+		})
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	e := New(newTestValidation(t, &configuration.Configuration{TranslateValidation: true}))
+	driverError := mongo.CommandError{Code: 11600, Message: "interrupted at shutdown on 10.0.0.7:27017"}
+	e.GET("/driver", func(c echo.Context) error {
+		return NewNotFoundError(CodeIngredientNotFound, driverError)
+	})
+	e.GET("/mismatch", func(c echo.Context) error {
+		return NewPreconditionFailedError(CodeVersionMismatch, db.ErrVersionMismatch)
+	})
+	e.GET("/client", func(c echo.Context) error {
+		return NewBadRequestError(CodeInvalidID, clientErrorf("Invalid ID"))
+	})
+	e.GET("/internal", func(c echo.Context) error {
+		return NewInternalServerError(driverError)
+	})
+	e.GET("/unexpected", func(c echo.Context) error {
+		return driverError
+	})
+	e.GET("/validation", func(c echo.Context) error {
+		return NewUnprocessableEntityError(CodeValidationFailed, c.Validate(&db.Ingredient{}))
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		code   string
+		detail string
+	}{
+		{"/driver", http.StatusNotFound, CodeIngredientNotFound, genericDetails[http.StatusNotFound]},
+		{"/mismatch", http.StatusPreconditionFailed, CodeVersionMismatch, db.ErrVersionMismatch.Error()},
+		{"/client", http.StatusBadRequest, CodeInvalidID, "Invalid ID"},
+		{"/internal", http.StatusInternalServerError, CodeInternal, ""},
+		{"/unexpected", http.StatusInternalServerError, CodeInternal, ""},
+		{"/validation", http.StatusUnprocessableEntity, CodeValidationFailed, "The request has invalid fields"},
+		{"/unknown", http.StatusNotFound, CodeRouteNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(e, http.MethodGet, tt.path, "", "", "", nil)
+			if rec.Code != tt.status || rec.Header().Get(echo.HeaderContentType) != MIMEProblemJSON {
+				t.Fatalf("Expected a %d problem, got %d %s", tt.status, rec.Code, rec.Header().Get(echo.HeaderContentType))
+			}
+			if strings.Contains(rec.Body.String(), "10.0.0.7") {
+				t.Fatalf("The problem leaks the driver error: %s", rec.Body)
+			}
+			var problem Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("Failed to decode problem: %v", err)
+			}
+			if problem.Status != tt.status || problem.Code != tt.code || problem.Detail != tt.detail || problem.Instance != tt.path {
+				t.Fatalf("Unexpected problem %+v", problem)
+			}
+			if problem.Type != problemTypePrefix+strings.ReplaceAll(strings.ToLower(tt.code), "_", "-") {
+				t.Fatalf("Unexpected problem type %q", problem.Type)
+			}
+			if tt.code == CodeValidationFailed && (len(problem.Errors) == 0 || problem.Errors[0].Rule != "required") {
+				t.Fatalf("Expected the invalid fields, got %+v", problem.Errors)
+			}
+		})
+	}
+
+	t.Run("Translated fields", func(t *testing.T) {
+		header := http.Header{}
+		header.Set(HeaderAcceptLanguage, "de-CH, fr;q=0.8")
+		rec := serve(e, http.MethodGet, "/validation", "", "", "", header)
+		if rec.Header().Get(HeaderContentLanguage) != "de" {
+			t.Fatalf("Expected the German messages, got %q", rec.Header().Get(HeaderContentLanguage))
+		}
+		var problem Problem
+		if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("Failed to decode problem: %v", err)
+		}
+		if len(problem.Errors) == 0 || problem.Errors[0].Message != "name ist ein Pflichtfeld" {
+			t.Fatalf("Unexpected fields %+v", problem.Errors)
+		}
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	api := newTestApiHandler(t, &configuration.Configuration{JWTSecret: testJWTSecret})
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.GET("/private", func(c echo.Context) error {
+		claims, _ := ClaimsFromContext(c.Request().Context())
+		return c.String(http.StatusOK, claims.Subject)
+	}, api.Authenticate)
+
+	sign := func(claims jwt.Claims, method jwt.SigningMethod, key interface{}) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return token
+	}
+	expired := sign(&Claims{StandardClaims: jwt.StandardClaims{Subject: "alice", ExpiresAt: time.Now().Add(-time.Minute).Unix()}},
+		jwt.SigningMethodHS256, []byte(testJWTSecret))
+	otherSecret := sign(&Claims{StandardClaims: jwt.StandardClaims{Subject: "alice"}}, jwt.SigningMethodHS256, []byte("other-secret"))
+	unsigned := sign(&Claims{StandardClaims: jwt.StandardClaims{Subject: "alice"}}, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType)
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		code          string
+		challenge     string
+	}{
+		{"Valid token", "Bearer " + testToken(t, "alice", RoleReader), http.StatusOK, "", ""},
+		{"Lower case scheme", "bearer " + testToken(t, "alice"), http.StatusOK, "", ""},
+		{"Missing header", "", http.StatusUnauthorized, CodeMissingToken, "Bearer"},
+		{"Other scheme", "Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized, CodeMissingToken, "Bearer"},
+		{"Empty token", "Bearer ", http.StatusUnauthorized, CodeMissingToken, "Bearer"},
+		{"Malformed token", "Bearer not.a.token", http.StatusUnauthorized, CodeInvalidToken, `Bearer error="invalid_token"`},
+		{"Expired token", "Bearer " + expired, http.StatusUnauthorized, CodeInvalidToken, `Bearer error="invalid_token"`},
+		{"Other secret", "Bearer " + otherSecret, http.StatusUnauthorized, CodeInvalidToken, `Bearer error="invalid_token"`},
+		{"Unsigned token", "Bearer " + unsigned, http.StatusUnauthorized, CodeInvalidToken, `Bearer error="invalid_token"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if len(tt.authorization) > 0 {
+				header.Set(echo.HeaderAuthorization, tt.authorization)
+			}
+			rec := serve(e, http.MethodGet, "/private", "", "", "", header)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected %d, got %d %s", tt.status, rec.Code, rec.Body)
+			}
+			if tt.status == http.StatusOK {
+				if rec.Body.String() != "alice" {
+					t.Fatalf("Expected the subject of the token, got %q", rec.Body)
+				}
+				return
+			}
+			var problem Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil || problem.Code != tt.code {
+				t.Fatalf("Expected a %s problem, got %s", tt.code, rec.Body)
+			}
+			if challenge := rec.Header().Get(echo.HeaderWWWAuthenticate); challenge != tt.challenge {
+				t.Fatalf("Expected the challenge %q, got %q", tt.challenge, challenge)
+			}
+		})
+	}
+
+	t.Run("Not configured", func(t *testing.T) {
+		api := newTestApiHandler(t, &configuration.Configuration{})
+		e := echo.New()
+		e.HTTPErrorHandler = HTTPErrorHandler
+		e.GET("/private", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }, api.Authenticate)
+		rec := serve(e, http.MethodGet, "/private", testToken(t, "alice"), "", "", nil)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), CodeAuthenticationMissing) {
+			t.Fatalf("Expected the authentication to be missing, got %d %s", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	api := newTestApiHandler(t, &configuration.Configuration{JWTSecret: testJWTSecret})
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	// Stands for the span of the request started by Trace
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx, span := tracer.Start(c.Request().Context(), "request")
+			defer span.End()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	})
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }
+	e.GET("/reader", ok, api.Authenticate, api.Authorize(RoleReader))
+	e.GET("/contributor", ok, api.Authenticate, api.Authorize(RoleContributor))
+	e.GET("/admin", ok, api.Authenticate, api.Authorize(RoleAdmin))
+	e.GET("/unauthenticated", ok, api.Authorize(RoleReader))
+
+	tests := []struct {
+		name    string
+		roles   []Role
+		granted []string
+	}{
+		{"No role", nil, []string{"/reader"}},
+		{"Reader", []Role{RoleReader}, []string{"/reader"}},
+		{"Contributor", []Role{RoleContributor}, []string{"/reader", "/contributor"}},
+		{"Admin", []Role{RoleAdmin}, []string{"/reader", "/contributor", "/admin"}},
+		{"Reader and admin", []Role{RoleReader, RoleAdmin}, []string{"/reader", "/contributor", "/admin"}},
+		{"Admin among unknown roles", []Role{"owner", RoleAdmin}, []string{"/reader", "/contributor", "/admin"}},
+		{"Only unknown roles", []Role{"owner", "superuser"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := testToken(t, "alice", tt.roles...)
+			for _, path := range []string{"/reader", "/contributor", "/admin"} {
+				granted := false
+				for _, p := range tt.granted {
+					granted = granted || p == path
+				}
+				rec := serve(e, http.MethodGet, path, token, "", "", nil)
+				if granted && rec.Code != http.StatusNoContent {
+					t.Fatalf("Expected %s to be granted, got %d %s", path, rec.Code, rec.Body)
+				}
+				if !granted && (rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), CodeInsufficientRole)) {
+					t.Fatalf("Expected %s to be forbidden, got %d %s", path, rec.Code, rec.Body)
+				}
+			}
+		})
+	}
+
+	rec := serve(e, http.MethodGet, "/unauthenticated", "", "", "", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the request without claims to be rejected, got %d", rec.Code)
+	}
+
+	// The decision tags the span of the request, without a span of its own
+	before := len(recorder.Ended())
+	serve(e, http.MethodGet, "/admin", testToken(t, "bob", RoleContributor), "", "", nil)
+	spans := recorder.Ended()[before:]
+	if len(spans) != 1 || spans[0].Name() != "request" {
+		t.Fatalf("Expected only the request span, got %d spans", len(spans))
+	}
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans[0].Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	if attributes["auth.subject"].AsString() != "bob" || attributes["auth.required_role"].AsString() != string(RoleAdmin) ||
+		attributes["auth.granted"].AsBool() {
+		t.Fatalf("Unexpected span attributes %v", spans[0].Attributes())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	api := newTestApiHandler(t, &configuration.Configuration{
+		JWTSecret:      testJWTSecret,
+		PriceRateLimit: configuration.RateLimit{PerMinute: 1, Burst: 2},
+	})
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }
+	e.POST("/price", ok, api.Authenticate, api.RateLimit("price"))
+	e.GET("/price", ok, api.Authenticate, api.RateLimit("price"))
+	e.POST("/shop", ok, api.Authenticate, api.RateLimit("shop"))
+
+	alice := testToken(t, "alice")
+	for i := 0; i < 2; i++ {
+		rec := serve(e, http.MethodPost, "/price", alice, "", "", nil)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("Expected request %d within the burst, got %d %s", i, rec.Code, rec.Body)
+		}
+		if remaining := rec.Header().Get(HeaderRateLimitRemaining); remaining != strconv.Itoa(1-i) {
+			t.Fatalf("Expected %d remaining requests, got %q", 1-i, remaining)
+		}
+	}
+
+	rec := serve(e, http.MethodPost, "/price", alice, "", "", nil)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get(echo.HeaderContentType) != MIMEProblemJSON {
+		t.Fatalf("Expected a rate limited problem, got %d %s", rec.Code, rec.Body)
+	}
+	retryAfter, err := strconv.Atoi(rec.Header().Get(echo.HeaderRetryAfter))
+	if err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Fatalf("Expected a Retry-After within a minute, got %q", rec.Header().Get(echo.HeaderRetryAfter))
+	}
+	var problem Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil || problem.Code != CodeRateLimited {
+		t.Fatalf("Expected a %s problem, got %s", CodeRateLimited, rec.Body)
+	}
+
+	// The reads, the other clients and the groups without limit are not limited
+	if rec := serve(e, http.MethodGet, "/price", alice, "", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the reads not to be limited, got %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/price", testToken(t, "bob"), "", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected another client not to be limited, got %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/shop", alice, "", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected a group without limit not to be limited, got %d", rec.Code)
+	}
+}
+
+func TestPriceQueryRanges(t *testing.T) {
+	e := newTestServer(newTestApiHandler(t, &configuration.Configuration{JWTSecret: testJWTSecret}))
+	token := testToken(t, "reader", RoleReader)
+
+	tests := []struct {
+		query  string
+		detail string
+	}{
+		{"minPrice=5&maxPrice=1", "invalid price query: minPrice is above maxPrice"},
+		{"startDate=2024-03-02T00:00:00Z&endDate=2024-03-01T00:00:00Z", "invalid price query: startDate is after endDate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := serve(e, http.MethodGet, "/v1/price?"+tt.query, token, "", "", nil)
+			var problem Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("Failed to decode problem: %v", err)
+			}
+			if rec.Code != http.StatusBadRequest || problem.Code != CodeInvalidQuery || problem.Detail != tt.detail {
+				t.Fatalf("Expected an invalid query, got %d %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
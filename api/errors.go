@@ -1,86 +1,350 @@
 package api
 
 import (
+	"catalog/bulk"
+	"catalog/currency"
+	"catalog/db"
+	"catalog/money"
+	"catalog/patch"
+	"catalog/units"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"time"
+	"strings"
 
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type EchoError struct {
-	Code     int       `json:"code"`
-	Message  string    `json:"message"`
-	Error    string    `json:"error"`
-	IssuedAt time.Time `json:"issued_at"`
+// MIMEProblemJSON is the content type of the error responses, see RFC 7807
+const MIMEProblemJSON = "application/problem+json"
+
+// The validation messages are translated in the language of the client
+const (
+	HeaderAcceptLanguage  = "Accept-Language"
+	HeaderContentLanguage = "Content-Language"
+)
+
+// Lists the patch formats accepted by the PATCH routes, see RFC 5789
+const HeaderAcceptPatch = "Accept-Patch"
+
+// The type of a problem is a relative URI built from its code
+const problemTypePrefix = "/problems/"
+
+// Stable error codes, meant to be matched by the clients
+const (
+	CodeInternal                = "INTERNAL_ERROR"
+	CodeInvalidRequest          = "INVALID_REQUEST"
+	CodeValidationFailed        = "VALIDATION_FAILED"
+	CodeInvalidID               = "INVALID_ID"
+	CodeInvalidPagination       = "INVALID_PAGINATION"
+	CodeInvalidQuery            = "INVALID_QUERY"
+	CodeInvalidCurrency         = "INVALID_CURRENCY"
+	CodeInvalidUnit             = "INVALID_UNIT"
+	CodeInvalidPatch            = "INVALID_PATCH"
+	CodePatchTestFailed         = "PATCH_TEST_FAILED"
+	CodeUnsupportedMediaType    = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRouteNotFound           = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed        = "METHOD_NOT_ALLOWED"
+	CodeMissingToken            = "MISSING_TOKEN"
+	CodeInvalidToken            = "INVALID_TOKEN"
+	CodeInvalidAPIKey           = "INVALID_API_KEY"
+	CodeAuthenticationMissing   = "AUTHENTICATION_NOT_CONFIGURED"
+	CodeInsufficientRole        = "INSUFFICIENT_ROLE"
+	CodeRateLimited             = "RATE_LIMITED"
+	CodeVersionMismatch         = "VERSION_MISMATCH"
+	CodeIngredientNotFound      = "INGREDIENT_NOT_FOUND"
+	CodeIngredientDuplicateName = "INGREDIENT_DUPLICATE_NAME"
+	CodeIngredientReferenced    = "INGREDIENT_REFERENCED"
+	CodeShopNotFound            = "SHOP_NOT_FOUND"
+	CodeShopDuplicateName       = "SHOP_DUPLICATE_NAME"
+	CodePriceNotFound           = "PRICE_NOT_FOUND"
+	CodePriceDuplicate          = "PRICE_DUPLICATE"
+	CodeExchangeRateNotFound    = "EXCHANGE_RATE_NOT_FOUND"
+	CodeExchangeRateDuplicate   = "EXCHANGE_RATE_DUPLICATE"
+	CodeInvalidRatesFile        = "INVALID_RATES_FILE"
+	CodeInvalidImportFile       = "INVALID_IMPORT_FILE"
+	CodeAPIKeyNotFound          = "API_KEY_NOT_FOUND"
+	CodeProjectionNotFound      = "PROJECTION_NOT_FOUND"
+	CodeRebuildRunning          = "REBUILD_RUNNING"
+	CodeRebuildFailed           = "REBUILD_FAILED"
+)
+
+// Problem is an RFC 7807 problem detail, extended with a stable code, the
+// invalid fields and the trace ID of the request.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	TraceID  string       `json:"traceId,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	// The cause, logged but never sent to the client
+	err error
+	// Kept to translate the messages in the language of the client
+	validationErrors validator.ValidationErrors
 }
 
-type ValidationErrors struct {
-	Code     int       `json:"code"`
-	Message  string    `json:"message"`
-	Error    string    `json:"error"`
-	IssuedAt time.Time `json:"issued_at"`
-	Errors   []string  `json:"errors"`
+// FieldError describes why a field of the request is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
 }
 
-func NewInternalServerError(err error) error {
-	jsonError := EchoError{
-		Code:     http.StatusInternalServerError,
-		Message:  "Internal Server Error",
-		Error:    err.Error(),
-		IssuedAt: time.Now(),
+func (p *Problem) Error() string {
+	if p.err != nil {
+		return p.Code + ": " + p.err.Error()
 	}
-	return echo.NewHTTPError(jsonError.Code, jsonError)
+	return p.Code
 }
 
-func NewConflictError(err error) error {
-	jsonError := EchoError{
-		Code:     http.StatusConflict,
-		Message:  "Conflict Error",
-		Error:    err.Error(),
-		IssuedAt: time.Now(),
+func (p *Problem) Unwrap() error {
+	return p.err
+}
+
+// The errors whose message is written for the client, kept as the detail of
+// their problem
+var clientErrors = []error{
+	ErrMissingToken, ErrInvalidToken, ErrAuthenticationMissing, ErrForbidden, ErrInvalidAPIKey, ErrRateLimited,
+	db.ErrInvalidPagination, db.ErrVersionMismatch, db.ErrDuplicateName, db.ErrInvalidPosition, db.ErrNoProjection,
+	db.ErrInvalidPriceQuery,
+	money.ErrInvalidAmount, currency.ErrRateNotFound,
+	units.ErrUnknownUnit, units.ErrIncompatibleUnits, units.ErrMissingDensity,
+	bulk.ErrUnknownFormat, bulk.ErrInvalidHeader,
+	patch.ErrUnsupportedMediaType, patch.ErrInvalidPatch, patch.ErrPathNotFound, patch.ErrTestFailed,
+}
+
+// clientError is an error raised by the API itself, its message is written
+// for the client
+type clientError struct {
+	err error
+}
+
+func (e *clientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *clientError) Unwrap() error {
+	return e.err
+}
+
+// clientErrorf formats an error meant for the client. It must only wrap
+// errors whose message is safe to show.
+func clientErrorf(format string, a ...any) error {
+	return &clientError{fmt.Errorf(format, a...)}
+}
+
+// isClientError reports whether the message of the error is meant for the
+// client. The other errors, such as the ones of the database driver, may leak
+// internals.
+func isClientError(err error) bool {
+	var ce *clientError
+	if errors.As(err, &ce) {
+		return true
+	}
+	for _, target := range clientErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// The details of the problems whose cause is not meant for the client
+var genericDetails = map[int]string{
+	http.StatusBadRequest:           "The request is invalid",
+	http.StatusUnauthorized:         "The request is not authenticated",
+	http.StatusForbidden:            "The request is not allowed",
+	http.StatusNotFound:             "The resource does not exist",
+	http.StatusConflict:             "The request conflicts with the current state of the resource",
+	http.StatusPreconditionFailed:   "The resource was modified since it was read",
+	http.StatusUnsupportedMediaType: "The content type is not supported",
+	http.StatusUnprocessableEntity:  "The request content is invalid",
+	http.StatusTooManyRequests:      "Too many requests, retry later",
+}
+
+// newProblem builds the problem, keeping the detail of the client errors only.
+// The other errors, logged, get a generic detail.
+func newProblem(status int, code string, err error) *Problem {
+	problem := &Problem{
+		Type:   problemTypePrefix + strings.ReplaceAll(strings.ToLower(code), "_", "-"),
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		err:    err,
+	}
+
+	var validationErrors validator.ValidationErrors
+	var httpError *echo.HTTPError
+	switch {
+	case err == nil:
+	case errors.As(err, &validationErrors):
+		problem.Detail = "The request has invalid fields"
+		if _, ok := err.(validator.ValidationErrors); !ok {
+			problem.Detail = err.Error()
+		}
+		problem.validationErrors = validationErrors
+		problem.Errors = newFieldErrors(validationErrors, defaultTranslator())
+	case errors.As(err, &httpError):
+		// Raised by echo, when binding the request
+		problem.Detail = fmt.Sprint(httpError.Message)
+	case isClientError(err):
+		problem.Detail = err.Error()
+	default:
+		problem.Detail = genericDetails[status]
 	}
-	return echo.NewHTTPError(jsonError.Code, jsonError)
+	return problem
 }
 
-func NewNotFoundError(err error) error {
-	jsonError := EchoError{
-		Code:     http.StatusNotFound,
-		Message:  "Not Found Error",
-		Error:    err.Error(),
-		IssuedAt: time.Now(),
+func newFieldErrors(errs validator.ValidationErrors, trans ut.Translator) []FieldError {
+	fields := make([]FieldError, len(errs))
+	for i, e := range errs {
+		// Drop the name of the validated struct from the path
+		field := e.Namespace()
+		if _, path, found := strings.Cut(field, "."); found {
+			field = path
+		}
+		message := e.Error()
+		if trans != nil {
+			message = e.Translate(trans)
+		}
+		fields[i] = FieldError{Field: field, Rule: e.Tag(), Message: message}
 	}
-	return echo.NewHTTPError(jsonError.Code, jsonError)
+	return fields
 }
 
-func NewUnauthorizedError(err error) error {
-	jsonError := EchoError{
-		Code:     http.StatusUnauthorized,
-		Message:  "Unauthorized Error",
-		Error:    err.Error(),
-		IssuedAt: time.Now(),
+func defaultTranslator() ut.Translator {
+	if validations == nil {
+		return nil
 	}
-	return echo.NewHTTPError(jsonError.Code, jsonError)
+	return validations.Trans
 }
 
-func NewBadRequestError(err error) error {
-	jsonError := EchoError{
-		Code:     http.StatusBadRequest,
-		Message:  "Bad Request Error",
-		Error:    err.Error(),
-		IssuedAt: time.Now(),
+// requestTranslator returns the translator of the language of the client
+func requestTranslator(c echo.Context) ut.Translator {
+	if validations == nil {
+		return nil
 	}
-	return echo.NewHTTPError(jsonError.Code, jsonError)
+	return validations.Translator(c.Request().Header.Get(HeaderAcceptLanguage))
+}
+
+// Internal errors are sanitized, only the trace ID identifies them
+func NewInternalServerError(err error) error {
+	return newProblem(http.StatusInternalServerError, CodeInternal, err)
 }
 
-func NewUnprocessableEntityError(err error) error {
-	jsonError := EchoError{
-		Code:     http.StatusUnprocessableEntity,
-		Message:  "Unprocessable Entity Error",
-		Error:    err.Error(),
-		IssuedAt: time.Now(),
+func NewConflictError(code string, err error) error {
+	return newProblem(http.StatusConflict, code, err)
+}
+
+func NewNotFoundError(code string, err error) error {
+	return newProblem(http.StatusNotFound, code, err)
+}
+
+func NewUnauthorizedError(code string, err error) error {
+	return newProblem(http.StatusUnauthorized, code, err)
+}
+
+func NewForbiddenError(code string, err error) error {
+	return newProblem(http.StatusForbidden, code, err)
+}
+
+func NewTooManyRequestsError(code string, err error) error {
+	return newProblem(http.StatusTooManyRequests, code, err)
+}
+
+func NewBadRequestError(code string, err error) error {
+	return newProblem(http.StatusBadRequest, code, err)
+}
+
+func NewUnprocessableEntityError(code string, err error) error {
+	return newProblem(http.StatusUnprocessableEntity, code, err)
+}
+
+func NewPreconditionFailedError(code string, err error) error {
+	return newProblem(http.StatusPreconditionFailed, code, err)
+}
+
+func NewUnsupportedMediaTypeError(code string, err error) error {
+	return newProblem(http.StatusUnsupportedMediaType, code, err)
+}
+
+// HTTPErrorHandler writes every error as a problem. The errors raised by echo
+// itself, such as unknown routes, are converted with a code based on their status.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var problem *Problem
+	var httpError *echo.HTTPError
+	var validationErrors validator.ValidationErrors
+	switch {
+	case errors.As(err, &problem):
+	case errors.As(err, &validationErrors):
+		problem = newProblem(http.StatusUnprocessableEntity, CodeValidationFailed, err)
+	case errors.As(err, &httpError):
+		problem = newProblem(httpError.Code, statusCode(httpError.Code), nil)
+		if message, ok := httpError.Message.(string); ok && message != problem.Title {
+			problem.Detail = message
+		}
+	default:
+		problem = newProblem(http.StatusInternalServerError, CodeInternal, err)
+	}
+
+	if problem.Status >= http.StatusInternalServerError {
+		problem.Detail = ""
+		logger.WithContext(c.Request().Context()).WithError(err).Error("Internal error")
+	}
+	if problem.validationErrors != nil {
+		if trans := requestTranslator(c); trans != nil {
+			problem.Errors = newFieldErrors(problem.validationErrors, trans)
+			c.Response().Header().Set(HeaderContentLanguage, trans.Locale())
+		}
+	}
+	problem.Instance = c.Request().URL.Path
+	if spanContext := trace.SpanContextFromContext(c.Request().Context()); spanContext.HasTraceID() {
+		problem.TraceID = spanContext.TraceID().String()
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(problem.Status)
+	} else {
+		var body []byte
+		if body, err = json.Marshal(problem); err == nil {
+			err = c.Blob(problem.Status, MIMEProblemJSON, body)
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to send the error response")
+	}
+}
+
+// statusCode returns the code of the errors only known by their status
+func statusCode(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return CodeRouteNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusUnauthorized:
+		return CodeMissingToken
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
 	}
-	return echo.NewHTTPError(jsonError.Code, jsonError)
+	return CodeInvalidRequest
 }
 
 // Show the log and return true if there was an error
@@ -1,15 +1,17 @@
 package api
 
 import (
+	"catalog/db"
 	"catalog/messages"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 )
@@ -150,7 +152,7 @@ func (api *ApiHandler) processAddPriceMessage(ctx context.Context, l *logrus.Ent
 	span.SetAttributes(
 		attribute.String("price.productId", price.ProductID),
 		attribute.String("price.shopId", price.ShopID),
-		attribute.Float64("price.price", price.Price),
+		attribute.String("price.price", price.Price.String()),
 		attribute.String("price.devise", price.Devise),
 		attribute.String("price.date", price.Date.GoString()),
 	)
@@ -161,10 +163,9 @@ func (api *ApiHandler) processAddPriceMessage(ctx context.Context, l *logrus.Ent
 		return fmt.Errorf("failed to validate message: %w", err)
 	}
 
-	// We retrieve the last updated price for the product and associated shop
-	// If the price is the same, we update the updatedAt field
-	// Otherwise, we insert a new price
-	dbCtx, dbSpan := api.tracer.Start(ctx, "retrieveAndUpdatePrice")
+	// The price is deduped against the last price of the product and shop:
+	// if it is the same, only the updatedAt of the last price is bumped
+	dbCtx, dbSpan := api.tracer.Start(db.WithEventContext(ctx, messageEventContext(msg)), "retrieveAndUpdatePrice")
 	l = l.WithContext(dbCtx).WithFields(
 		logrus.Fields{
 			"shopId":    price.ShopID,
@@ -173,43 +174,43 @@ func (api *ApiHandler) processAddPriceMessage(ctx context.Context, l *logrus.Ent
 		},
 	)
 	defer dbSpan.End()
-	lastPrice, err := api.dbh.GetLastUpdatedPrice(l, price.ShopID, price.ProductID)
-
-	if err != nil && err != mongo.ErrNoDocuments {
+	writes, err := api.savePrices(l, []*db.Price{messages.NewPrice(&price)})
+	if err != nil {
 		dbSpan.RecordError(err)
-		dbSpan.SetStatus(codes.Error, "Failed to get last updated price")
-		return fmt.Errorf("failed to get last updated price: %w", err)
+		dbSpan.SetStatus(codes.Error, "Failed to save price")
+		return err
 	}
-
-	if lastPrice != nil {
-
-		if lastPrice.Price == price.Price && lastPrice.Devise == price.Devise {
-			l.Info("Price is the same, updating the price in the DB")
-			lastPrice.UpdatedAt = price.Date
-			_, err := api.dbh.UpdatePrice(l, lastPrice)
-
-			if err != nil {
-				span.RecordError(err)
-				span.SetStatus(codes.Error, "Failed to update price")
-				return fmt.Errorf("failed to update price: %w", err)
-			}
-
-			return nil
-		}
+	if writes[0].Applied {
+		l.Info("Price already saved by this message")
+	} else if writes[0].Refresh {
+		l.Info("Price is the same, updated the last price")
 	} else {
-		l.Debug("No price found for the given shop and product")
+		l.Info("Inserted new price")
 	}
+	return nil
+}
 
-	dbPrice := messages.NewPrice(&price)
-	l.WithFields(logrus.Fields{
-		"shopId":    dbPrice.ShopID,
-		"productId": dbPrice.ProductID,
-		"price":     fmt.Sprintf("%v %v", dbPrice.Price, dbPrice.Devise),
-	}).Info("Inserting new price")
-	if _, err = api.dbh.CreatePrice(l, dbPrice); err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "Failed to insert new price")
-		return fmt.Errorf("failed to insert new price: %w", err)
+// messageEventContext returns the event context of a message. Its events are
+// caused by the message ID, or by its body without ID, so a redelivered
+// message appends them once.
+func messageEventContext(msg amqp.Delivery) db.EventContext {
+	causationID := msg.MessageId
+	if len(causationID) < 1 {
+		sum := sha256.Sum256(msg.Body)
+		causationID = hex.EncodeToString(sum[:])
+	}
+	correlationID := msg.CorrelationId
+	if len(correlationID) < 1 {
+		correlationID = causationID
+	}
+	actor := msg.UserId
+	if len(actor) < 1 {
+		actor = msg.AppId
+	}
+	return db.EventContext{
+		CorrelationID: correlationID,
+		CausationID:   causationID,
+		Actor:         actor,
+		Source:        db.SourceAMQP,
 	}
-	return nil
 }
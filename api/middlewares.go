@@ -1 +1,375 @@
 package api
+
+import (
+	"catalog/db"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace starts the span of the request, continuing the trace of the caller
+// if any. The handler spans are its children, and the error responses
+// carry its trace ID.
+func Trace(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		request := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := otel.Tracer("catalog/api").Start(ctx, request.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("http.route", c.Path()),
+			),
+		)
+		defer span.End()
+		c.SetRequest(request.WithContext(ctx))
+
+		err := next(c)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	}
+}
+
+// HeaderCorrelationID carries the ID shared by the requests and messages of
+// the same operation. The events appended by the request record it.
+const HeaderCorrelationID = "X-Correlation-ID"
+
+// Correlate exposes the event context of the request to the handlers: the
+// correlation ID of the caller, or a new one, and the request ID as the cause
+// of the events. A client retrying a request with the same X-Request-ID
+// appends its events once.
+func Correlate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		request := c.Request()
+		requestID := request.Header.Get(echo.HeaderXRequestID)
+		if len(requestID) < 1 {
+			requestID = uuid.NewString()
+		}
+		correlationID := request.Header.Get(HeaderCorrelationID)
+		if len(correlationID) < 1 {
+			correlationID = requestID
+		}
+		c.Response().Header().Set(HeaderCorrelationID, correlationID)
+
+		ctx := db.WithEventContext(request.Context(), db.EventContext{
+			CorrelationID: correlationID,
+			CausationID:   requestID,
+			Source:        db.SourceAPI,
+		})
+		c.SetRequest(request.WithContext(ctx))
+		return next(c)
+	}
+}
+
+type Role string
+
+// Each role is granted the permissions of the roles before it
+const (
+	RoleReader      Role = "reader"
+	RoleContributor Role = "contributor"
+	RoleAdmin       Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleReader:      1,
+	RoleContributor: 2,
+	RoleAdmin:       3,
+}
+
+// Claims are the claims of the bearer tokens accepted by the API, or the
+// ones built from an API key.
+type Claims struct {
+	jwt.StandardClaims
+	Roles []Role `json:"roles,omitempty"`
+	// Set when authenticated with an API key
+	APIKeyID string `json:"-"`
+}
+
+// UnknownRoles returns the roles of the claims which the API doesn't define,
+// they grant nothing
+func (c *Claims) UnknownRoles() []Role {
+	var unknown []Role
+	for _, r := range c.Roles {
+		if _, ok := roleLevels[r]; !ok {
+			unknown = append(unknown, r)
+		}
+	}
+	return unknown
+}
+
+// HasRole reports whether the claims grant the role, directly or through a
+// higher one. Tokens without any role are readers.
+func (c *Claims) HasRole(role Role) bool {
+	if len(c.Roles) < 1 {
+		return role == RoleReader
+	}
+	for _, r := range c.Roles {
+		if roleLevels[r] >= roleLevels[role] {
+			return true
+		}
+	}
+	return false
+}
+
+type claimsContextKey struct{}
+
+// ClaimsContextKey is the key of the Claims in the echo context
+const ClaimsContextKey = "claims"
+
+var (
+	ErrMissingToken          = errors.New("missing bearer token")
+	ErrInvalidToken          = errors.New("invalid bearer token")
+	ErrAuthenticationMissing = errors.New("authentication is not configured")
+	ErrForbidden             = errors.New("insufficient role")
+	ErrInvalidAPIKey         = errors.New("invalid API key")
+)
+
+// HeaderAPIKey carries the API key of the machine clients
+const HeaderAPIKey = "X-API-Key"
+
+// apiKeyPrefix makes the keys easy to spot, e.g. by secret scanners
+const apiKeyPrefix = "ck_"
+
+// ClaimsFromContext returns the claims of the authenticated request, if any
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(*Claims)
+	return claims, ok
+}
+
+// Authenticate rejects the requests without a valid HS256 or RS256 bearer
+// token, and exposes the claims of the token in the echo and request contexts.
+func (api *ApiHandler) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		l := logger.WithContext(c.Request().Context()).WithField("middleware", "Authenticate")
+
+		if key := c.Request().Header.Get(HeaderAPIKey); len(key) > 0 {
+			claims, err := api.authenticateAPIKey(l, key)
+			if err != nil {
+				return err
+			}
+			return next(withClaims(c, claims))
+		}
+
+		if len(api.conf.JWTSecret) < 1 && api.conf.JWTPublicKey == nil {
+			return NewUnauthorizedError(CodeAuthenticationMissing, ErrAuthenticationMissing)
+		}
+
+		scheme, token, found := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || len(token) < 1 {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return NewUnauthorizedError(CodeMissingToken, ErrMissingToken)
+		}
+
+		claims := new(Claims)
+		if _, err := jwt.ParseWithClaims(token, claims, api.jwtKey); err != nil {
+			l.WithError(err).Debug("Rejected bearer token")
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return NewUnauthorizedError(CodeInvalidToken, fmt.Errorf("%w: %v", ErrInvalidToken, err))
+		}
+
+		return next(withClaims(c, claims))
+	}
+}
+
+// withClaims exposes the claims in the echo and request contexts, their
+// subject being the actor of the events
+func withClaims(c echo.Context, claims *Claims) echo.Context {
+	c.Set(ClaimsContextKey, claims)
+	ctx := context.WithValue(c.Request().Context(), claimsContextKey{}, claims)
+	ec := db.EventContextFrom(ctx)
+	ec.Actor = claims.Subject
+	ctx = db.WithEventContext(ctx, ec)
+	c.SetRequest(c.Request().WithContext(ctx))
+	return c
+}
+
+// authenticateAPIKey looks the key up by its hash, and returns the claims
+// granting its scopes. The usage is recorded on success.
+func (api *ApiHandler) authenticateAPIKey(l *logrus.Entry, key string) (*Claims, error) {
+	apiKey, err := api.dbh.FindAPIKeyByHash(l, HashAPIKey(key))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, NewUnauthorizedError(CodeInvalidAPIKey, ErrInvalidAPIKey)
+		}
+		return nil, NewInternalServerError(err)
+	}
+
+	now := time.Now()
+	if apiKey.Expired(now) {
+		return nil, NewUnauthorizedError(CodeInvalidAPIKey, fmt.Errorf("%w: expired or revoked", ErrInvalidAPIKey))
+	}
+
+	// A failure to record the usage must not reject the request
+	if err := api.dbh.RecordAPIKeyUsage(l, apiKey.ID, now); err != nil {
+		l.WithError(err).WithField("apiKey", apiKey.ID.Hex()).Warn("Failed to record API key usage")
+	}
+
+	claims := &Claims{
+		StandardClaims: jwt.StandardClaims{Subject: "apikey:" + apiKey.ID.Hex()},
+		Roles:          make([]Role, len(apiKey.Scopes)),
+		APIKeyID:       apiKey.ID.Hex(),
+	}
+	for i, scope := range apiKey.Scopes {
+		claims.Roles[i] = Role(scope)
+	}
+	return claims, nil
+}
+
+// HashAPIKey returns the hexadecimal SHA-256 of the key, as stored
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random key, with 256 bits of entropy
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// jwtKey returns the key verifying the token, restricting the algorithms to
+// the ones configured, so a token can't pick its own verification method.
+func (api *ApiHandler) jwtKey(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		if len(api.conf.JWTSecret) > 0 {
+			return []byte(api.conf.JWTSecret), nil
+		}
+	case jwt.SigningMethodRS256.Alg():
+		if api.conf.JWTPublicKey != nil {
+			return api.conf.JWTPublicKey, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+}
+
+// Authorize rejects the authenticated requests whose claims don't grant the
+// role, or only hold unknown roles. It must run after Authenticate, and tags
+// the span of the request with the decision.
+func (api *ApiHandler) Authorize(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+			span := trace.SpanFromContext(ctx)
+			l := logger.WithContext(ctx).WithField("middleware", "Authorize")
+
+			claims, ok := ClaimsFromContext(ctx)
+			if !ok {
+				return NewUnauthorizedError(CodeMissingToken, ErrMissingToken)
+			}
+
+			roles := make([]string, len(claims.Roles))
+			for i, r := range claims.Roles {
+				roles[i] = string(r)
+			}
+			unknown := claims.UnknownRoles()
+			granted := claims.HasRole(role)
+			span.SetAttributes(
+				attribute.String("auth.subject", claims.Subject),
+				attribute.StringSlice("auth.roles", roles),
+				attribute.String("auth.required_role", string(role)),
+				attribute.Bool("auth.granted", granted),
+			)
+
+			fields := logrus.Fields{"subject": claims.Subject, "role": role}
+			if len(unknown) > 0 {
+				l.WithFields(fields).WithField("unknownRoles", unknown).Warn("Unknown roles in the claims")
+			}
+			if len(claims.Roles) > 0 && len(unknown) == len(claims.Roles) {
+				return NewForbiddenError(CodeInsufficientRole, fmt.Errorf("%w: no known role in %v", ErrForbidden, roles))
+			}
+			if !granted {
+				l.WithFields(fields).Info("Access denied")
+				return NewForbiddenError(CodeInsufficientRole, fmt.Errorf("%w: %s required", ErrForbidden, role))
+			}
+			return next(c)
+		}
+	}
+}
+
+// Rate limit headers, as drafted by the IETF httpapi working group
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimit limits the write requests of each client with the limiter of the
+// route group. The clients are identified by API key, then by token subject,
+// then by IP. It must run after Authenticate.
+func (api *ApiHandler) RateLimit(group string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limiter, ok := api.limiters[group]
+			if !ok {
+				return next(c)
+			}
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+
+			key := rateLimitKey(c)
+			result := limiter.Allow(key, time.Now())
+			header := c.Response().Header()
+			header.Set(HeaderRateLimitLimit, strconv.Itoa(result.Limit))
+			header.Set(HeaderRateLimitRemaining, strconv.Itoa(result.Remaining))
+			header.Set(HeaderRateLimitReset, strconv.Itoa(seconds(result.Reset)))
+
+			if !result.Allowed {
+				logger.WithContext(c.Request().Context()).WithFields(logrus.Fields{
+					"middleware": "RateLimit",
+					"group":      group,
+					"client":     key,
+				}).Warn("Rate limit exceeded")
+				header.Set(echo.HeaderRetryAfter, strconv.Itoa(seconds(result.RetryAfter)))
+				return NewTooManyRequestsError(CodeRateLimited, fmt.Errorf("%w, retry in %ds", ErrRateLimited, seconds(result.RetryAfter)))
+			}
+			return next(c)
+		}
+	}
+}
+
+func rateLimitKey(c echo.Context) string {
+	if claims, ok := ClaimsFromContext(c.Request().Context()); ok {
+		if len(claims.APIKeyID) > 0 {
+			return "apikey:" + claims.APIKeyID
+		}
+		if len(claims.Subject) > 0 {
+			return "sub:" + claims.Subject
+		}
+	}
+	return "ip:" + c.RealIP()
+}
+
+// seconds rounds the duration up to a whole number of seconds
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -2,7 +2,13 @@ package api
 
 import (
 	"catalog/db"
+	"catalog/money"
+	"catalog/units"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -10,6 +16,51 @@ type FindIngredientByTypeRequest struct {
 	Type string `query:"type" json:"type" validate:"required,oneof=vegetable fruit meat fish dairy spice sugar cereals nuts other"`
 }
 
+type SearchIngredientRequest struct {
+	Query string `query:"q" validate:"required"`
+	Limit int    `query:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+// ExpectedVersion parses the If-Match header of a write into the version the
+// resource must have. Without the header, or with "*", any version is accepted.
+// The weak tags never match, as If-Match uses the strong comparison.
+func ExpectedVersion(c echo.Context) (int64, error) {
+	header := strings.TrimSpace(c.Request().Header.Get(HeaderIfMatch))
+	if header == "" || header == "*" {
+		return db.AnyVersion, nil
+	}
+
+	versions := make([]int64, 0, 1)
+	for _, tag := range strings.Split(header, ",") {
+		value, err := strconv.Unquote(strings.TrimSpace(tag))
+		if err != nil {
+			continue
+		}
+		if version, err := strconv.ParseInt(value, 10, 64); err == nil && version >= 0 {
+			versions = append(versions, version)
+		}
+	}
+	switch len(versions) {
+	case 0:
+		return 0, NewPreconditionFailedError(CodeVersionMismatch, db.ErrVersionMismatch)
+	case 1:
+		return versions[0], nil
+	}
+	return 0, NewBadRequestError(CodeInvalidRequest, clientErrorf("If-Match must hold a single entity tag"))
+}
+
+// DeleteIngredientRequest is the request of the ingredient deletion and purge.
+// Force removes the ingredient even when prices still reference it.
+type DeleteIngredientRequest struct {
+	ID    string `param:"id" validate:"required,mongodb"`
+	Force bool   `query:"force"`
+}
+
+type Coordinates struct {
+	Latitude  float64 `json:"lat" validate:"latitude"`
+	Longitude float64 `json:"lng" validate:"longitude"`
+}
+
 type InsertShop struct {
 	ID       string `json:"id" validate:"omitempty"`
 	Name     string `json:"name" validate:"required,min=3"`
@@ -19,6 +70,7 @@ type InsertShop struct {
 		Country    string `json:"country" validate:"required"`
 		City       string `json:"city" validate:"required"`
 	} `json:"location" validate:"required"`
+	Coordinates *Coordinates `json:"coordinates" validate:"omitempty"`
 }
 
 type UpdateShop struct {
@@ -26,11 +78,61 @@ type UpdateShop struct {
 	InsertShop `json:",inline"`
 }
 
-type InsertPrice struct {
+type NearbyShopsRequest struct {
+	Latitude  *float64 `validate:"required,latitude"`
+	Longitude *float64 `validate:"required,longitude"`
+	Radius    *float64 `validate:"required,gt=0"`
+	Limit     int      `validate:"min=1,max=100"`
+}
+
+type BasketItem struct {
 	ProductID string  `json:"productId" validate:"required"`
-	ShopID    string  `json:"shopId" validate:"required"`
-	Price     float64 `json:"price" validate:"required"`
-	Devise    string  `json:"devise" validate:"required,oneof=EUR USD"`
+	Quantity  float64 `json:"quantity" validate:"required,gt=0"`
+}
+
+type OptimizeBasketRequest struct {
+	Items    []BasketItem `json:"items" validate:"required,min=1,dive"`
+	Mode     string       `json:"mode" validate:"omitempty,oneof=single split"`
+	MaxShops int          `json:"maxShops" validate:"omitempty,min=1,max=10"`
+	Devise   string       `json:"devise" validate:"omitempty,iso4217"`
+}
+
+type PriceHistoryRequest struct {
+	ShopID    string     `validate:"required"`
+	ProductID string     `validate:"required"`
+	From      *time.Time `validate:"omitempty"`
+	To        *time.Time `validate:"omitempty"`
+	Interval  string     `validate:"omitempty,oneof=day week month"`
+}
+
+// PriceAtRequest is the price of a product in a shop in effect at a date
+type PriceAtRequest struct {
+	ShopID    string     `validate:"required"`
+	ProductID string     `validate:"required"`
+	Date      *time.Time `validate:"required"`
+}
+
+// CatalogPricesAtRequest is the price of every shop and product in effect at
+// a date, optionally only for a shop or a product
+type CatalogPricesAtRequest struct {
+	ShopID    string
+	ProductID string
+	Date      *time.Time `validate:"required"`
+}
+
+type InsertPrice struct {
+	ProductID string       `json:"productId" validate:"required"`
+	ShopID    string       `json:"shopId" validate:"required"`
+	Price     money.Amount `json:"price" validate:"required,gt=0"`
+	Devise    string       `json:"devise" validate:"required,iso4217"`
+	Quantity  float64      `json:"quantity" validate:"omitempty,gt=0"`
+	Unit      units.Unit   `json:"unit" validate:"required_with=Quantity,omitempty,unit"`
+}
+
+// InsertPrices is a batch of up to 100 prices, a long receipt. The prices are
+// validated one by one, so only the invalid ones are rejected.
+type InsertPrices struct {
+	Prices []InsertPrice `json:"prices" validate:"required,min=1,max=100"`
 }
 
 type UpdatePrice struct {
@@ -38,12 +140,63 @@ type UpdatePrice struct {
 	InsertPrice `json:",inline"`
 }
 
+type InsertAPIKey struct {
+	Name      string     `json:"name" validate:"required"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1,dive,oneof=reader contributor admin"`
+	ExpiresAt *time.Time `json:"expiresAt" validate:"omitempty,gt"`
+}
+
+type InsertExchangeRate struct {
+	Base  string    `json:"base" validate:"required,iso4217"`
+	Quote string    `json:"quote" validate:"required,iso4217,nefield=Base"`
+	Rate  float64   `json:"rate" validate:"required,gt=0"`
+	Date  time.Time `json:"date" validate:"required"`
+}
+
+type UpdateExchangeRate struct {
+	ID                 string `param:"id" validate:"required"`
+	InsertExchangeRate `json:",inline"`
+}
+
+func NewInsertExchangeRate(rate *InsertExchangeRate) *db.ExchangeRate {
+	return &db.ExchangeRate{
+		Base:  rate.Base,
+		Quote: rate.Quote,
+		Rate:  rate.Rate,
+		Date:  rate.Date,
+	}
+}
+
+func NewUpdateExchangeRate(rate *UpdateExchangeRate) (*db.ExchangeRate, error) {
+	id, err := primitive.ObjectIDFromHex(rate.ID)
+	if err != nil {
+		return nil, err
+	}
+	dbRate := NewInsertExchangeRate(&rate.InsertExchangeRate)
+	dbRate.ID = id
+	return dbRate, nil
+}
+
+// NewInsertAPIKey builds the stored key from the request and the generated key
+func NewInsertAPIKey(apiKey *InsertAPIKey, key string) *db.APIKey {
+	return &db.APIKey{
+		Name:      apiKey.Name,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Hash:      HashAPIKey(key),
+		Scopes:    apiKey.Scopes,
+		ExpiresAt: apiKey.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+}
+
 func NewInsertPrice(price *InsertPrice) *db.Price {
 	return &db.Price{
 		ProductID: price.ProductID,
 		ShopID:    price.ShopID,
 		Price:     price.Price,
 		Devise:    price.Devise,
+		Quantity:  price.Quantity,
+		Unit:      price.Unit,
 	}
 }
 
@@ -58,9 +211,18 @@ func NewUpdatePrice(price *UpdatePrice) (*db.Price, error) {
 		ShopID:    price.ShopID,
 		Price:     price.Price,
 		Devise:    price.Devise,
+		Quantity:  price.Quantity,
+		Unit:      price.Unit,
 	}, nil
 }
 
+func NewGeoPoint(coordinates *Coordinates) *db.GeoPoint {
+	if coordinates == nil {
+		return nil
+	}
+	return db.NewGeoPoint(coordinates.Latitude, coordinates.Longitude)
+}
+
 func NewInsertShop(shop *InsertShop) (*db.Shop, error) {
 	var err error
 
@@ -72,6 +234,7 @@ func NewInsertShop(shop *InsertShop) (*db.Shop, error) {
 			Country:    shop.Location.Country,
 			City:       shop.Location.City,
 		},
+		Coordinates: NewGeoPoint(shop.Coordinates),
 	}
 
 	if shop.ID == "" {
@@ -96,5 +259,187 @@ func NewUpdateShop(shop *UpdateShop) (*db.Shop, error) {
 			Country:    shop.Location.Country,
 			City:       shop.Location.City,
 		},
+		Coordinates: NewGeoPoint(shop.Coordinates),
 	}, nil
 }
+
+// NewShopDocument returns the shop in the format written by the clients, the
+// document patched by PATCH /shop/:id.
+func NewShopDocument(shop *db.Shop) *InsertShop {
+	document := InsertShop{ID: shop.ID.Hex(), Name: shop.Name}
+	document.Location.Street = shop.Location.Street
+	document.Location.PostalCode = shop.Location.PostalCode
+	document.Location.Country = shop.Location.Country
+	document.Location.City = shop.Location.City
+	if shop.Coordinates != nil {
+		document.Coordinates = &Coordinates{
+			Latitude:  shop.Coordinates.Coordinates[1],
+			Longitude: shop.Coordinates.Coordinates[0],
+		}
+	}
+	return &document
+}
+
+// NewPriceQuery parses the filters of the GET /price query string.
+// Prices are parsed as numbers and dates as RFC 3339 timestamps.
+func NewPriceQuery(c echo.Context) (*db.PriceQuery, error) {
+	query := db.PriceQuery{
+		ProductID: c.QueryParam("ingId"),
+		ShopID:    c.QueryParam("shopId"),
+	}
+
+	if id := c.QueryParam("id"); id != "" {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, clientErrorf("invalid id: %w", err)
+		}
+		query.ID = &oid
+	}
+
+	var err error
+	if query.MinPrice, err = parseAmountParam(c, "minPrice"); err != nil {
+		return nil, err
+	}
+	if query.MaxPrice, err = parseAmountParam(c, "maxPrice"); err != nil {
+		return nil, err
+	}
+	if query.StartDate, err = parseTimeParam(c, "startDate"); err != nil {
+		return nil, err
+	}
+	if query.EndDate, err = parseTimeParam(c, "endDate"); err != nil {
+		return nil, err
+	}
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &query, nil
+}
+
+func parseFloatParam(c echo.Context, name string) (*float64, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, clientErrorf("invalid %s: %w", name, err)
+	}
+	return &f, nil
+}
+
+func parseAmountParam(c echo.Context, name string) (*money.Amount, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return nil, nil
+	}
+	a, err := money.Parse(value)
+	if err != nil {
+		return nil, clientErrorf("invalid %s: %w", name, err)
+	}
+	return &a, nil
+}
+
+func parseTimeParam(c echo.Context, name string) (*time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, clientErrorf("invalid %s: %w", name, err)
+	}
+	return &t, nil
+}
+
+// NewNearbyShopsRequest parses the position and radius, in meters, of a
+// GET /shop/nearby query.
+func NewNearbyShopsRequest(c echo.Context) (*NearbyShopsRequest, error) {
+	var err error
+	request := NearbyShopsRequest{Limit: 20}
+	if request.Latitude, err = parseFloatParam(c, "lat"); err != nil {
+		return nil, err
+	}
+	if request.Longitude, err = parseFloatParam(c, "lng"); err != nil {
+		return nil, err
+	}
+	if request.Radius, err = parseFloatParam(c, "radius"); err != nil {
+		return nil, err
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		if request.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, clientErrorf("invalid limit: %w", err)
+		}
+	}
+	return &request, nil
+}
+
+// NewPriceHistoryRequest parses the path and the query of a GET /price/history request
+func NewPriceHistoryRequest(c echo.Context) (*PriceHistoryRequest, error) {
+	var err error
+	request := PriceHistoryRequest{
+		ShopID:    c.Param("shopId"),
+		ProductID: c.Param("productId"),
+		Interval:  c.QueryParam("interval"),
+	}
+	if request.From, err = parseTimeParam(c, "from"); err != nil {
+		return nil, err
+	}
+	if request.To, err = parseTimeParam(c, "to"); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// NewPriceAtRequest parses the query of a GET /price/at request
+func NewPriceAtRequest(c echo.Context) (*PriceAtRequest, error) {
+	request := PriceAtRequest{
+		ShopID:    c.QueryParam("shopId"),
+		ProductID: c.QueryParam("productId"),
+	}
+	var err error
+	if request.Date, err = parseTimeParam(c, "date"); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// NewCatalogPricesAtRequest parses the query of a GET /price/at/catalog request
+func NewCatalogPricesAtRequest(c echo.Context) (*CatalogPricesAtRequest, error) {
+	request := CatalogPricesAtRequest{
+		ShopID:    c.QueryParam("shopId"),
+		ProductID: c.QueryParam("productId"),
+	}
+	var err error
+	if request.Date, err = parseTimeParam(c, "date"); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// NewPagination parses the limit, cursor, sort and total query parameters
+// shared by the list endpoints.
+func NewPagination(c echo.Context) (*db.Pagination, error) {
+	page := db.Pagination{
+		Cursor: c.QueryParam("cursor"),
+		Sort:   c.QueryParam("sort"),
+	}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > db.MaxPageLimit {
+			return nil, clientErrorf("invalid limit: must be between 1 and %d", db.MaxPageLimit)
+		}
+		page.Limit = l
+	}
+
+	if total := c.QueryParam("total"); total != "" {
+		t, err := strconv.ParseBool(total)
+		if err != nil {
+			return nil, clientErrorf("invalid total: %w", err)
+		}
+		page.WithTotal = t
+	}
+
+	return &page, nil
+}
@@ -1,11 +1,28 @@
 package api
 
+import (
+	"catalog/db"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
 const (
 	LiveStatus     = "OK"
 	ReadyStatus    = "READY"
 	NotReadyStatus = "NOT READY"
 )
 
+// The headers of the optimistic concurrency, the versions of the resources
+// are their entity tags
+const (
+	HeaderETag        = "ETag"
+	HeaderIfMatch     = "If-Match"
+	HeaderIfNoneMatch = "If-None-Match"
+)
+
 type HealthResponse struct {
 	Status string `json:"status"`
 }
@@ -15,3 +32,121 @@ func NewHealthResponse(status string) *HealthResponse {
 		Status: status,
 	}
 }
+
+// CreatedAPIKey is the only response holding the API key itself
+type CreatedAPIKey struct {
+	db.APIKey `json:",inline"`
+	Key       string `json:"key"`
+}
+
+// The status of a row of an import
+const (
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportFailed  = "failed"
+)
+
+// ImportReport is the outcome of an ingredient import, row by row. A dry run
+// reports what would be imported, without writing anything.
+type ImportReport struct {
+	DryRun  bool        `json:"dryRun"`
+	Created int         `json:"created"`
+	Updated int         `json:"updated"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+type ImportRow struct {
+	Line   int          `json:"line"`
+	Name   string       `json:"name,omitempty"`
+	Status string       `json:"status"`
+	ID     string       `json:"id,omitempty"`
+	Reason string       `json:"reason,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func (r *ImportReport) add(row ImportRow) {
+	switch row.Status {
+	case ImportCreated:
+		r.Created++
+	case ImportUpdated:
+		r.Updated++
+	case ImportFailed:
+		r.Failed++
+	}
+	r.Rows = append(r.Rows, row)
+}
+
+// The status of an item of a price batch
+const (
+	PriceCreated   = "created"
+	PriceRefreshed = "refreshed"
+	PriceFailed    = "failed"
+)
+
+// PriceBatchReport is the outcome of a price batch, item by item. A price the
+// same as the last one of its shop and product only refreshes its updatedAt.
+type PriceBatchReport struct {
+	Created   int              `json:"created"`
+	Refreshed int              `json:"refreshed"`
+	Failed    int              `json:"failed"`
+	Items     []PriceBatchItem `json:"items"`
+}
+
+type PriceBatchItem struct {
+	Index  int          `json:"index"`
+	Status string       `json:"status"`
+	Price  *db.Price    `json:"price,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func (r *PriceBatchReport) add(item PriceBatchItem) {
+	switch item.Status {
+	case PriceCreated:
+		r.Created++
+	case PriceRefreshed:
+		r.Refreshed++
+	case PriceFailed:
+		r.Failed++
+	}
+	r.Items = append(r.Items, item)
+}
+
+// RebuildStatus is the status of the last rebuild of the price projection
+type RebuildStatus struct {
+	Running  bool                `json:"running"`
+	Progress *db.RebuildProgress `json:"progress,omitempty"`
+	// The code of the failure, its cause is only logged
+	Error string `json:"error,omitempty"`
+}
+
+// ETag returns the strong entity tag of a version of a resource
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// versionedJSON sends the resource with the entity tag of its version. A GET
+// is answered with a 304 when the If-None-Match header holds the tag.
+func versionedJSON(c echo.Context, status int, version int64, resource interface{}) error {
+	etag := ETag(version)
+	c.Response().Header().Set(HeaderETag, etag)
+
+	method := c.Request().Method
+	if (method == http.MethodGet || method == http.MethodHead) &&
+		matchETag(c.Request().Header.Get(HeaderIfNoneMatch), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSON(status, resource)
+}
+
+// matchETag compares the tag with the list of an If-None-Match header, with
+// the weak comparison
+func matchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
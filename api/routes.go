@@ -1,13 +1,27 @@
 package api
 
 import (
+	"catalog/basket"
+	"catalog/bulk"
+	"catalog/currency"
 	"catalog/db"
+	"catalog/patch"
+	"catalog/units"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.opentelemetry.io/otel/attribute"
@@ -49,19 +63,20 @@ func (api *ApiHandler) postIngredient(c echo.Context) error {
 	ingredient := new(db.Ingredient)
 	if err := c.Bind(ingredient); err != nil {
 		FailOnError(l, err, "Request binding failed")
-		return NewInternalServerError(err)
+		return NewBadRequestError(CodeInvalidRequest, err)
 	}
 	// Validate the ingredient
 	if err := c.Validate(ingredient); err != nil {
 		FailOnError(l, err, "Validation failed")
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeValidationFailed, err)
 	}
 	// Insert the ingredient
 	ingredient.ID = api.dbh.NewID()
+	ingredient.DeletedAt = nil
 
 	i, _ := api.dbh.FindByName(l, ingredient.Name)
 	if i != nil {
-		return NewConflictError(errors.New("ingredient already exists"))
+		return NewConflictError(CodeIngredientDuplicateName, clientErrorf("ingredient already exists"))
 	}
 
 	if err := api.dbh.InsertOne(l, ingredient); err != nil {
@@ -69,17 +84,24 @@ func (api *ApiHandler) postIngredient(c echo.Context) error {
 		return NewInternalServerError(err)
 	}
 
-	return c.JSON(http.StatusCreated, ingredient)
+	return versionedJSON(c, http.StatusCreated, ingredient.Version, ingredient)
 
 }
 
 func (api *ApiHandler) getIngredients(c echo.Context) error {
 	l := logger.WithField("request", "getIngredients")
-	recipes, err := api.dbh.FindAllIngredients(l)
+	page, err := NewPagination(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidPagination, err)
+	}
+	ingredients, err := api.dbh.FindAllIngredients(l, page)
 	if err != nil {
-		return NewNotFoundError(err)
+		if errors.Is(err, db.ErrInvalidPagination) {
+			return NewBadRequestError(CodeInvalidPagination, err)
+		}
+		return NewInternalServerError(err)
 	}
-	return c.JSON(http.StatusOK, recipes)
+	return c.JSON(http.StatusOK, ingredients)
 }
 
 func (api *ApiHandler) getIngredientByID(c echo.Context) error {
@@ -90,10 +112,13 @@ func (api *ApiHandler) getIngredientByID(c echo.Context) error {
 	// Find the ingredient
 	ingredient, err := api.dbh.FindByID(l, id)
 	if err != nil {
-		return NewNotFoundError(err)
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeIngredientNotFound, err)
+		}
+		return NewInternalServerError(err)
 	}
 
-	return c.JSON(http.StatusOK, ingredient)
+	return versionedJSON(c, http.StatusOK, ingredient.Version, ingredient)
 
 }
 
@@ -105,10 +130,13 @@ func (api *ApiHandler) getIngredientByName(c echo.Context) error {
 	ingredient, err := api.dbh.FindByName(l, name)
 	if err != nil {
 		WarnOnError(l, err, "Find by name failed")
-		return NewNotFoundError(err)
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeIngredientNotFound, err)
+		}
+		return NewInternalServerError(err)
 	}
 
-	return c.JSON(http.StatusOK, ingredient)
+	return versionedJSON(c, http.StatusOK, ingredient.Version, ingredient)
 }
 
 // Get the ingredient by the type in query parameter
@@ -121,41 +149,488 @@ func (api *ApiHandler) getIngredientByType(c echo.Context) error {
 	// Find the ingredient
 	ingredients, err := api.dbh.FindByType(l, ingredientType)
 	if err != nil {
-		WarnOnError(l, err, "Find by type failed")
-		return NewNotFoundError(err)
+		FailOnError(l, err, "Find by type failed")
+		return NewInternalServerError(err)
 	}
 
 	return c.JSON(http.StatusOK, ingredients)
 }
 
+// Search the ingredients by relevance, ignoring case, accents and typos
+func (api *ApiHandler) searchIngredients(c echo.Context) error {
+	l := logger.WithField("request", "searchIngredients")
+
+	var search SearchIngredientRequest
+	if err := c.Bind(&search); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(search); err != nil {
+		return NewBadRequestError(CodeValidationFailed, err)
+	}
+	if search.Limit == 0 {
+		search.Limit = db.DefaultSearchLimit
+	}
+
+	results, err := api.dbh.SearchIngredients(l, search.Query, search.Limit)
+	if err != nil {
+		WarnOnError(l, err, "Search failed")
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
 func (api *ApiHandler) putIngredient(c echo.Context) error {
 	l := logger.WithField("request", "putIngredient")
 	// Retrieve the ingredient from the body
 	ingredient := new(db.Ingredient)
 	if err := c.Bind(ingredient); err != nil {
 		FailOnError(l, err, "Request binding failed")
-		return NewInternalServerError(err)
+		return NewBadRequestError(CodeInvalidRequest, err)
 	}
 	// Validate the ingredient
 	if err := c.Validate(ingredient); err != nil {
 		FailOnError(l, err, "Validation failed")
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeValidationFailed, err)
 	}
 	// Update the ingredient
 	id, err := primitive.ObjectIDFromHex(c.Param("id"))
 
 	if err != nil {
 		WarnOnError(l, err, "Invalid ID")
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeInvalidID, err)
 	}
 	ingredient.ID = id
+	ingredient.DeletedAt = nil
+	expected, err := ExpectedVersion(c)
+	if err != nil {
+		return err
+	}
 
-	if err := api.dbh.UpsertOne(l, ingredient); err != nil {
+	if err := api.dbh.UpsertOne(l, ingredient, expected); err != nil {
 		FailOnError(l, err, "Insertion failed")
-		return NewNotFoundError(err)
+		if errors.Is(err, db.ErrVersionMismatch) {
+			return NewPreconditionFailedError(CodeVersionMismatch, err)
+		}
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeIngredientNotFound, err)
+		}
+		return NewInternalServerError(err)
+	}
+
+	return versionedJSON(c, http.StatusOK, ingredient.Version, ingredient)
+}
+
+// Patch the ingredient with a JSON Merge Patch or a JSON Patch, the fields
+// left out of the patch are kept
+func (api *ApiHandler) patchIngredient(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "PatchIngredient")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "PatchIngredient")
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return NewBadRequestError(CodeInvalidID, clientErrorf("Invalid ID"))
+	}
+	expected, err := ExpectedVersion(c)
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.String("ingredient_id", id.Hex()))
+	ingredient, err := api.dbh.FindByID(l, id.Hex())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeIngredientNotFound, clientErrorf("Ingredient not found"))
+		}
+		return NewInternalServerError(err)
+	}
+	if expected != db.AnyVersion && expected != ingredient.Version {
+		return NewPreconditionFailedError(CodeVersionMismatch, db.ErrVersionMismatch)
+	}
+
+	patched := new(db.Ingredient)
+	if err := patchDocument(c, ingredient, patched); err != nil {
+		return err
+	}
+	patched.ID, patched.DeletedAt = id, nil
+	if err := c.Validate(patched); err != nil {
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
+	}
+
+	// The patch applies to the version read, so it must not have changed since
+	if err := api.dbh.UpsertOne(l, patched, ingredient.Version); err != nil {
+		if errors.Is(err, db.ErrVersionMismatch) {
+			return NewPreconditionFailedError(CodeVersionMismatch, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to patch ingredient")
+		return NewInternalServerError(err)
+	}
+
+	return versionedJSON(c, http.StatusOK, patched.Version, patched)
+}
+
+// patchDocument applies the patch in the body of the request to the JSON of
+// the document, and decodes the result into patched.
+func patchDocument(c echo.Context, document, patched interface{}) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	original, err := json.Marshal(document)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	result, err := patch.Apply(c.Request().Header.Get(echo.HeaderContentType), original, body)
+	switch {
+	case err == nil:
+	case errors.Is(err, patch.ErrUnsupportedMediaType):
+		c.Response().Header().Set(HeaderAcceptPatch, patch.MIMEMergePatch+", "+patch.MIMEJSONPatch)
+		return NewUnsupportedMediaTypeError(CodeUnsupportedMediaType, err)
+	case errors.Is(err, patch.ErrTestFailed):
+		return NewConflictError(CodePatchTestFailed, err)
+	case errors.Is(err, patch.ErrPathNotFound):
+		return NewUnprocessableEntityError(CodeInvalidPatch, err)
+	default:
+		return NewBadRequestError(CodeInvalidPatch, err)
+	}
+
+	if err := json.Unmarshal(result, patched); err != nil {
+		return NewUnprocessableEntityError(CodeInvalidPatch, err)
+	}
+	return nil
+}
+
+// Soft-delete the ingredient, refused while prices reference it unless forced
+func (api *ApiHandler) deleteIngredient(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "DeleteIngredient")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "DeleteIngredient")
+
+	var request DeleteIngredientRequest
+	if err := c.Bind(&request); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(request); err != nil {
+		return NewBadRequestError(CodeInvalidID, err)
+	}
+	id, _ := primitive.ObjectIDFromHex(request.ID)
+	expected, err := ExpectedVersion(c)
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.String("ingredient_id", request.ID), attribute.Bool("force", request.Force))
+	check := func() error {
+		return api.checkIngredientReferences(l, request.ID, request.Force)
+	}
+	if err := api.dbh.DeleteIngredient(l, id, expected, check); err != nil {
+		var problem *Problem
+		if errors.As(err, &problem) {
+			return err
+		}
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeIngredientNotFound, clientErrorf("Ingredient not found"))
+		}
+		if errors.Is(err, db.ErrVersionMismatch) {
+			return NewPreconditionFailedError(CodeVersionMismatch, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to delete ingredient")
+		return NewInternalServerError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Restore a soft-deleted ingredient
+func (api *ApiHandler) restoreIngredient(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "RestoreIngredient")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "RestoreIngredient")
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return NewBadRequestError(CodeInvalidID, clientErrorf("Invalid ID"))
+	}
+
+	span.SetAttributes(attribute.String("ingredient_id", id.Hex()))
+	ingredient, err := api.dbh.RestoreIngredient(l, id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeIngredientNotFound, clientErrorf("No deleted ingredient with this ID"))
+		}
+		if errors.Is(err, db.ErrDuplicateName) {
+			return NewConflictError(CodeIngredientDuplicateName, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to restore ingredient")
+		return NewInternalServerError(err)
+	}
+
+	return versionedJSON(c, http.StatusOK, ingredient.Version, ingredient)
+}
+
+// Remove for good a soft-deleted ingredient, refused while prices reference it
+// unless forced
+func (api *ApiHandler) purgeIngredient(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "PurgeIngredient")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "PurgeIngredient")
+
+	var request DeleteIngredientRequest
+	if err := c.Bind(&request); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(request); err != nil {
+		return NewBadRequestError(CodeInvalidID, err)
+	}
+	id, _ := primitive.ObjectIDFromHex(request.ID)
+
+	span.SetAttributes(attribute.String("ingredient_id", request.ID), attribute.Bool("force", request.Force))
+	check := func() error {
+		return api.checkIngredientReferences(l, request.ID, request.Force)
+	}
+	if err := api.dbh.PurgeIngredient(l, id, check); err != nil {
+		var problem *Problem
+		if errors.As(err, &problem) {
+			return err
+		}
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeIngredientNotFound, clientErrorf("No deleted ingredient with this ID"))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to purge ingredient")
+		return NewInternalServerError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// checkIngredientReferences returns a conflict when shops still price the
+// ingredient, unless the removal is forced. It runs before the ingredient is
+// removed, which is then left untouched on conflict.
+func (api *ApiHandler) checkIngredientReferences(l *logrus.Entry, id string, force bool) error {
+	if force {
+		return nil
+	}
+	prices, err := api.dbh.GetLatestPrices(l, []string{id})
+	if err != nil {
+		l.WithError(err).Error("Failed to find the prices of the ingredient")
+		return NewInternalServerError(err)
+	}
+	if len(*prices) > 0 {
+		return NewConflictError(CodeIngredientReferenced,
+			clientErrorf("The ingredient is still priced in %d shops, use force=true to remove it anyway", len(*prices)))
+	}
+	return nil
+}
+
+// The largest import, in rows
+const maxImportRows = 10000
+
+var errTooManyRows = fmt.Errorf("the file has more than %d rows", maxImportRows)
+
+// Import a CSV or JSON Lines file of ingredients, upserted by name. Each row
+// is validated on its own, the report tells which ones were created, updated
+// or rejected.
+func (api *ApiHandler) importIngredients(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "ImportIngredients")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "ImportIngredients")
+
+	dryRun := false
+	if param := c.QueryParam("dryRun"); param != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(param); err != nil {
+			return NewBadRequestError(CodeInvalidQuery, clientErrorf("invalid dryRun: %w", err))
+		}
+	}
+
+	var file io.Reader = c.Request().Body
+	var format bulk.Format
+	var err error
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		var header *multipart.FileHeader
+		if header, err = c.FormFile("file"); err != nil {
+			return NewBadRequestError(CodeInvalidRequest, err)
+		}
+		var f multipart.File
+		if f, err = header.Open(); err != nil {
+			return NewBadRequestError(CodeInvalidRequest, err)
+		}
+		defer f.Close()
+		file = f
+		format, err = bulk.FormatFromFilename(header.Filename)
+	} else {
+		format, err = bulk.FormatFromContentType(c.Request().Header.Get(echo.HeaderContentType))
+	}
+	if param := c.QueryParam("format"); param != "" {
+		format, err = bulk.ParseFormat(param)
+	}
+	if err != nil {
+		return NewUnsupportedMediaTypeError(CodeUnsupportedMediaType, err)
+	}
+
+	rows := make([]bulk.Row, 0)
+	err = bulk.Read(file, format, func(row bulk.Row) error {
+		if len(rows) == maxImportRows {
+			return errTooManyRows
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return NewUnprocessableEntityError(CodeInvalidImportFile, clientErrorf("invalid file: %w", err))
+	}
+
+	// Validate the rows, the first row of a name wins
+	report := ImportReport{DryRun: dryRun, Rows: make([]ImportRow, 0, len(rows))}
+	trans := requestTranslator(c)
+	lines := make(map[string]int, len(rows))
+	valid := make([]bulk.Row, 0, len(rows))
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		failed := ImportRow{Line: row.Line, Name: row.Ingredient.Name, Status: ImportFailed}
+		var validationErrors validator.ValidationErrors
+		switch err := api.validation.Validate.Struct(&row.Ingredient); {
+		case row.Err != nil:
+			failed.Reason = row.Err.Error()
+		case errors.As(err, &validationErrors):
+			failed.Reason = "The row has invalid fields"
+			failed.Errors = newFieldErrors(validationErrors, trans)
+		case err != nil:
+			failed.Reason = err.Error()
+		case lines[row.Ingredient.Name] != 0:
+			failed.Reason = fmt.Sprintf("Duplicate of the line %d", lines[row.Ingredient.Name])
+		default:
+			lines[row.Ingredient.Name] = row.Line
+			valid = append(valid, row)
+			names = append(names, row.Ingredient.Name)
+			continue
+		}
+		report.add(failed)
+	}
+
+	existing, err := api.dbh.FindIngredientsByNames(l, names)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to find the imported ingredients")
+		return NewInternalServerError(err)
+	}
+	ids := make(map[string]primitive.ObjectID, len(*existing))
+	for _, ingredient := range *existing {
+		ids[ingredient.Name] = ingredient.ID
+	}
+
+	ingredients := make([]db.IngredientImport, 0, len(valid))
+	imported := make([]ImportRow, 0, len(valid))
+	for _, row := range valid {
+		result := ImportRow{Line: row.Line, Name: row.Ingredient.Name, Status: ImportCreated}
+		if id, ok := ids[row.Ingredient.Name]; ok {
+			result.Status = ImportUpdated
+			result.ID = id.Hex()
+			row.Ingredient.ID = id
+		} else if !dryRun {
+			row.Ingredient.ID = api.dbh.NewID()
+			result.ID = row.Ingredient.ID.Hex()
+		}
+		ingredients = append(ingredients, db.IngredientImport{Ingredient: row.Ingredient, Fields: row.Fields})
+		imported = append(imported, result)
+	}
+
+	if !dryRun {
+		// The rows failing to be written are reported, the others are written
+		var importErr *db.ImportError
+		err := api.dbh.ImportIngredients(l, ingredients)
+		if errors.As(err, &importErr) {
+			for i, writeErr := range importErr.Failed {
+				l.WithError(writeErr).WithField("line", imported[i].Line).Warn("Failed to import ingredient")
+				imported[i] = ImportRow{Line: imported[i].Line, Name: imported[i].Name, Status: ImportFailed, Reason: "Failed to write the ingredient"}
+			}
+		} else if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Failed to import ingredients")
+			return NewInternalServerError(err)
+		}
 	}
+	for _, row := range imported {
+		report.add(row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Line < report.Rows[j].Line })
+
+	span.SetAttributes(
+		attribute.Bool("import.dry_run", dryRun),
+		attribute.Int("import.created", report.Created),
+		attribute.Int("import.updated", report.Updated),
+		attribute.Int("import.failed", report.Failed),
+	)
+	return c.JSON(http.StatusOK, report)
+}
+
+// Stream the whole catalog as CSV, by default, or as JSON Lines
+func (api *ApiHandler) exportIngredients(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "ExportIngredients")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "ExportIngredients")
+
+	format := bulk.CSV
+	if param := c.QueryParam("format"); param != "" {
+		var err error
+		if format, err = bulk.ParseFormat(param); err != nil {
+			return NewBadRequestError(CodeInvalidQuery, err)
+		}
+	}
+
+	var locales []string
+	if format == bulk.CSV {
+		var err error
+		if locales, err = api.dbh.IngredientLocales(l); err != nil {
+			return NewInternalServerError(err)
+		}
+	}
+
+	response := c.Response()
+	writer, err := bulk.NewWriter(response, format, locales)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidQuery, err)
+	}
+	response.Header().Set(echo.HeaderContentType, format.ContentType())
+	response.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="ingredients.%s"`, format))
 
-	return c.JSON(http.StatusOK, ingredient)
+	exported := 0
+	err = api.dbh.ExportIngredients(l, func(ingredient *db.Ingredient) error {
+		if err := writer.Write(ingredient); err != nil {
+			return err
+		}
+		exported++
+		// Send the rows as they are read
+		if exported%100 == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			response.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	span.SetAttributes(attribute.Int("export.count", exported))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to export ingredients")
+		if !response.Committed {
+			response.Header().Del(echo.HeaderContentDisposition)
+			return NewInternalServerError(err)
+		}
+		// The status is already sent, the client gets a truncated file
+		l.WithError(err).Error("Failed to export ingredients")
+		return nil
+	}
+	return nil
 }
 
 // Shop CRUD operations
@@ -167,22 +642,22 @@ func (api *ApiHandler) createShop(c echo.Context) error {
 
 	var shop InsertShop
 	if err := c.Bind(&shop); err != nil {
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeInvalidRequest, err)
 	}
 	if err := c.Validate(shop); err != nil {
-		return NewUnprocessableEntityError(err)
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
 	}
 	dbShop, err := NewInsertShop(&shop)
 
 	if err != nil {
-		return NewUnprocessableEntityError(err)
+		return NewBadRequestError(CodeInvalidID, err)
 	}
 
 	insertedShop, err := api.dbh.CreateShop(l, dbShop)
 
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
-			return NewConflictError(err)
+			return NewConflictError(CodeShopDuplicateName, err)
 		}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to insert shop")
@@ -202,7 +677,7 @@ func (api *ApiHandler) createShop(c echo.Context) error {
 		"location": insertedShop.Location,
 	}).Debug("Shop created")
 
-	return c.JSON(http.StatusCreated, insertedShop)
+	return versionedJSON(c, http.StatusCreated, insertedShop.Version, insertedShop)
 }
 
 func (api *ApiHandler) getShop(c echo.Context) error {
@@ -212,13 +687,13 @@ func (api *ApiHandler) getShop(c echo.Context) error {
 
 	id, err := primitive.ObjectIDFromHex(c.Param("id"))
 	if err != nil {
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeInvalidID, err)
 	}
 
 	shop, err := api.dbh.GetShop(l, id)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return NewNotFoundError(err)
+			return NewNotFoundError(CodeShopNotFound, err)
 		}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to get shop")
@@ -226,7 +701,7 @@ func (api *ApiHandler) getShop(c echo.Context) error {
 		return NewInternalServerError(err)
 	}
 
-	return c.JSON(http.StatusOK, shop)
+	return versionedJSON(c, http.StatusOK, shop.Version, shop)
 }
 
 func (api *ApiHandler) getShops(c echo.Context) error {
@@ -234,8 +709,16 @@ func (api *ApiHandler) getShops(c echo.Context) error {
 	defer span.End()
 	l := logger.WithContext(ctx).WithField("request", "GetShops")
 
-	shops, err := api.dbh.GetShops(l)
+	page, err := NewPagination(c)
 	if err != nil {
+		return NewBadRequestError(CodeInvalidPagination, err)
+	}
+
+	shops, err := api.dbh.GetShops(l, page)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPagination) {
+			return NewBadRequestError(CodeInvalidPagination, err)
+		}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to get shops")
 		l.WithError(err).Error("Failed to get shops")
@@ -245,6 +728,36 @@ func (api *ApiHandler) getShops(c echo.Context) error {
 	return c.JSON(http.StatusOK, shops)
 }
 
+func (api *ApiHandler) getNearbyShops(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetNearbyShops")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetNearbyShops")
+
+	request, err := NewNearbyShopsRequest(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidQuery, err)
+	}
+	if err := c.Validate(request); err != nil {
+		return NewBadRequestError(CodeValidationFailed, err)
+	}
+
+	span.SetAttributes(
+		attribute.Float64("lat", *request.Latitude),
+		attribute.Float64("lng", *request.Longitude),
+		attribute.Float64("radius", *request.Radius),
+	)
+	point := db.NewGeoPoint(*request.Latitude, *request.Longitude)
+	shops, err := api.dbh.GetShopsNear(l, point, *request.Radius, request.Limit)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get nearby shops")
+		l.WithError(err).Error("Failed to get nearby shops")
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, shops)
+}
+
 func (api *ApiHandler) updateShop(c echo.Context) error {
 	ctx, span := api.tracer.Start(c.Request().Context(), "UpdateShop")
 	defer span.End()
@@ -252,22 +765,29 @@ func (api *ApiHandler) updateShop(c echo.Context) error {
 
 	var shop UpdateShop
 	if err := c.Bind(&shop); err != nil {
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeInvalidRequest, err)
 	}
 
 	if err := c.Validate(shop); err != nil {
-		return NewUnprocessableEntityError(err)
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
 	}
 
 	shopDb, err := NewUpdateShop(&shop)
 	if err != nil {
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeInvalidID, err)
+	}
+	expected, err := ExpectedVersion(c)
+	if err != nil {
+		return err
 	}
 
-	shopDb, err = api.dbh.UpdateShop(l, shopDb)
+	shopDb, err = api.dbh.UpdateShop(l, shopDb, expected)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return NewNotFoundError(err)
+			return NewNotFoundError(CodeShopNotFound, err)
+		}
+		if errors.Is(err, db.ErrVersionMismatch) {
+			return NewPreconditionFailedError(CodeVersionMismatch, err)
 		}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to update shop")
@@ -275,7 +795,66 @@ func (api *ApiHandler) updateShop(c echo.Context) error {
 		return NewInternalServerError(err)
 	}
 
-	return c.JSON(http.StatusOK, shopDb)
+	return versionedJSON(c, http.StatusOK, shopDb.Version, shopDb)
+}
+
+// Patch the shop with a JSON Merge Patch or a JSON Patch, applied to the
+// document written by PUT
+func (api *ApiHandler) patchShop(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "PatchShop")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "PatchShop")
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return NewBadRequestError(CodeInvalidID, clientErrorf("Invalid ID"))
+	}
+	expected, err := ExpectedVersion(c)
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.String("shop_id", id.Hex()))
+	shopDb, err := api.dbh.GetShop(l, id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeShopNotFound, clientErrorf("Shop not found"))
+		}
+		return NewInternalServerError(err)
+	}
+	if expected != db.AnyVersion && expected != shopDb.Version {
+		return NewPreconditionFailedError(CodeVersionMismatch, db.ErrVersionMismatch)
+	}
+	version := shopDb.Version
+
+	var shop UpdateShop
+	if err := patchDocument(c, NewShopDocument(shopDb), &shop.InsertShop); err != nil {
+		return err
+	}
+	shop.ID = id.Hex()
+	if err := c.Validate(shop); err != nil {
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
+	}
+
+	if shopDb, err = NewUpdateShop(&shop); err != nil {
+		return NewBadRequestError(CodeInvalidID, err)
+	}
+	// The patch applies to the version read, so it must not have changed since
+	shopDb, err = api.dbh.UpdateShop(l, shopDb, version)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeShopNotFound, err)
+		}
+		if errors.Is(err, db.ErrVersionMismatch) {
+			return NewPreconditionFailedError(CodeVersionMismatch, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to patch shop")
+		l.WithError(err).Error("Failed to patch shop")
+		return NewInternalServerError(err)
+	}
+
+	return versionedJSON(c, http.StatusOK, shopDb.Version, shopDb)
 }
 
 func (api *ApiHandler) deleteShop(c echo.Context) error {
@@ -285,13 +864,21 @@ func (api *ApiHandler) deleteShop(c echo.Context) error {
 
 	id, err := primitive.ObjectIDFromHex(c.Param("id"))
 	if err != nil {
-		return NewBadRequestError(errors.New("Invalid ID"))
+		return NewBadRequestError(CodeInvalidID, clientErrorf("Invalid ID"))
+	}
+
+	expected, err := ExpectedVersion(c)
+	if err != nil {
+		return err
 	}
 
 	span.SetAttributes(attribute.String("shop_id", id.Hex()))
-	if err := api.dbh.DeleteShop(l, id); err != nil {
+	if err := api.dbh.DeleteShop(l, id, expected); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return NewNotFoundError(errors.New("Shop not found"))
+			return NewNotFoundError(CodeShopNotFound, clientErrorf("Shop not found"))
+		}
+		if errors.Is(err, db.ErrVersionMismatch) {
+			return NewPreconditionFailedError(CodeVersionMismatch, err)
 		}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to delete shop")
@@ -305,75 +892,204 @@ func (api *ApiHandler) deleteShop(c echo.Context) error {
 // Price operations
 
 func (api *ApiHandler) createPrice(c echo.Context) error {
-	l := logger.WithField("request", "CreatePrice")
+	ctx, span := api.tracer.Start(c.Request().Context(), "CreatePrice")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "CreatePrice")
 
 	var price InsertPrice
 	if err := c.Bind(&price); err != nil {
-		return NewBadRequestError(err)
+		return NewBadRequestError(CodeInvalidRequest, err)
 	}
 
 	if err := c.Validate(price); err != nil {
-		return NewUnprocessableEntityError(err)
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
 	}
 	ingPrice := NewInsertPrice(&price)
 
 	result, err := api.dbh.CreatePrice(l, ingPrice)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
-			return NewConflictError(err)
+			return NewConflictError(CodePriceDuplicate, err)
 		}
 		l.WithError(err).Error("Failed to insert ingredient price")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to insert price")
 		return NewInternalServerError(err)
 	}
 
+	// The base unit of a dimension never needs a density
+	result.Normalize("", 0)
 	return c.JSON(http.StatusCreated, result)
 }
 
-// TODO ReAdd the query parameters with the EventStore
-func (api *ApiHandler) getPrices(c echo.Context) error {
-	ctx, span := api.tracer.Start(c.Request().Context(), "GetPrices")
+// Create the prices of a batch, such as the lines of a receipt. Each price is
+// deduped against the last price of its shop and product, like the prices
+// received from the queue, and the valid ones are written at once.
+func (api *ApiHandler) createPrices(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "CreatePrices")
 	defer span.End()
-	l := logger.WithContext(ctx).WithField("request", "GetPrices")
-
-	filter := bson.M{}
+	// The batches are imported from receipts and price lists, rather than
+	// entered one by one
+	ec := db.EventContextFrom(ctx)
+	ec.Source = db.SourceImport
+	ctx = db.WithEventContext(ctx, ec)
+	l := logger.WithContext(ctx).WithField("request", "CreatePrices")
+
+	var batch InsertPrices
+	if err := c.Bind(&batch); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(batch); err != nil {
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
+	}
 
-	if id := c.QueryParam("id"); id != "" {
-		oid, err := primitive.ObjectIDFromHex(id)
-		if err != nil {
-			return NewBadRequestError(err)
+	report := PriceBatchReport{Items: make([]PriceBatchItem, len(batch.Prices))}
+	trans := requestTranslator(c)
+	now := time.Now()
+	prices := make([]*db.Price, 0, len(batch.Prices))
+	indexes := make([]int, 0, len(batch.Prices))
+	for i := range batch.Prices {
+		var validationErrors validator.ValidationErrors
+		if err := api.validation.Validate.Struct(&batch.Prices[i]); errors.As(err, &validationErrors) {
+			report.Items[i] = PriceBatchItem{Index: i, Status: PriceFailed, Errors: newFieldErrors(validationErrors, trans)}
+			continue
+		} else if err != nil {
+			return NewInternalServerError(err)
 		}
-		filter["_id"] = oid
+		price := NewInsertPrice(&batch.Prices[i])
+		price.CreatedAt = now
+		price.UpdatedAt = now
+		prices = append(prices, price)
+		indexes = append(indexes, i)
 	}
 
-	if minPrice := c.QueryParam("minPrice"); minPrice != "" {
-		filter["price"] = bson.M{"$gte": minPrice}
-	}
-	if maxPrice := c.QueryParam("maxPrice"); maxPrice != "" {
-		if _, ok := filter["price"]; !ok {
-			filter["price"] = bson.M{}
+	if len(prices) > 0 {
+		writes, err := api.savePrices(l, prices)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Failed to save prices")
+			if errors.Is(err, db.ErrVersionMismatch) {
+				return NewConflictError(CodeVersionMismatch, err)
+			}
+			return NewInternalServerError(err)
 		}
-		filter["price"].(bson.M)["$lte"] = maxPrice
-	}
-	if ingID := c.QueryParam("ingId"); ingID != "" {
-		filter["productId"] = ingID
-	}
-	if shopID := c.QueryParam("shopId"); shopID != "" {
-		filter["shopId"] = shopID
-	}
-	if startDate := c.QueryParam("startDate"); startDate != "" {
-		filter["createdAt"] = bson.M{"$gte": startDate}
-	}
-	if endDate := c.QueryParam("endDate"); endDate != "" {
-		if _, ok := filter["updatedAt"]; !ok {
-			filter["updatedAt"] = bson.M{}
+		// The first price of a new write creates it, the next ones are deduped
+		created := make(map[*db.PriceWrite]bool, len(writes))
+		for j, write := range writes {
+			status := PriceRefreshed
+			if !write.Refresh && !created[write] {
+				created[write] = true
+				status = PriceCreated
+			}
+			report.Items[indexes[j]] = PriceBatchItem{Index: indexes[j], Status: status, Price: write.Price}
 		}
-		filter["updatedAt"].(bson.M)["$lte"] = endDate
 	}
 
-	prices, err := api.dbh.GetPrices(l)
-	if err != nil {
-		l.WithError(err).Error("Failed to get ingredient prices")
-		return NewInternalServerError(err)
+	items := report.Items
+	report.Items = make([]PriceBatchItem, 0, len(items))
+	for _, item := range items {
+		report.add(item)
+	}
+	span.SetAttributes(
+		attribute.Int("batch.created", report.Created),
+		attribute.Int("batch.refreshed", report.Refreshed),
+		attribute.Int("batch.failed", report.Failed),
+	)
+	return c.JSON(http.StatusOK, report)
+}
+
+// Number of times the prices are read and deduped again when a last price
+// changes concurrently
+const maxPriceUpdateAttempts = 3
+
+// savePrices dedupes the prices against the last price of their shop and
+// product, then writes them at once. It returns the write of every price, the
+// prices deduped into the same write share it. The prices whose last price was
+// written by the same request or message, retried or redelivered, are not
+// written again.
+func (api *ApiHandler) savePrices(l *logrus.Entry, prices []*db.Price) ([]*db.PriceWrite, error) {
+	cause := db.EventContextFrom(l.Context).CausationID
+	for attempt := 1; ; attempt++ {
+		last := make([]db.Price, 0)
+		applied := make(map[[2]string]*db.PriceWrite)
+		read := make(map[[2]string]bool)
+		for _, price := range prices {
+			key := [2]string{price.ShopID, price.ProductID}
+			if read[key] {
+				continue
+			}
+			read[key] = true
+			lastPrice, err := api.dbh.GetLastUpdatedPrice(l, price.ShopID, price.ProductID)
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to get last updated price: %w", err)
+			}
+			if len(cause) > 0 && lastPrice.CausationID == cause {
+				applied[key] = &db.PriceWrite{Price: lastPrice, Applied: true}
+				continue
+			}
+			last = append(last, *lastPrice)
+		}
+
+		// The prices are copied, a failed attempt leaves them as is
+		batch := db.NewPriceBatch(last)
+		writes := make([]*db.PriceWrite, len(prices))
+		copies := make([]db.Price, len(prices))
+		for i, price := range prices {
+			if write, ok := applied[[2]string{price.ShopID, price.ProductID}]; ok {
+				writes[i] = write
+				continue
+			}
+			copies[i] = *price
+			writes[i] = batch.Add(&copies[i])
+		}
+		if len(batch.Writes) == 0 {
+			return writes, nil
+		}
+
+		err := api.dbh.WritePrices(l, batch.Writes)
+		if errors.Is(err, db.ErrVersionMismatch) && attempt < maxPriceUpdateAttempts {
+			l.WithField("attempt", attempt).Debug("Price changed concurrently, retrying")
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write prices: %w", err)
+		}
+		return writes, nil
+	}
+}
+
+func (api *ApiHandler) getPrices(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetPrices")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetPrices")
+
+	query, err := NewPriceQuery(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidQuery, err)
+	}
+
+	page, err := NewPagination(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidPagination, err)
+	}
+
+	prices, err := api.dbh.GetPrices(l, query, page)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPagination) {
+			return NewBadRequestError(CodeInvalidPagination, err)
+		}
+		l.WithError(err).Error("Failed to get ingredient prices")
+		return NewInternalServerError(err)
+	}
+
+	if err := api.convertPrices(l, c, prices.Items); err != nil {
+		return err
+	}
+	if err := api.normalizePrices(l, c, prices.Items); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, prices)
@@ -390,11 +1106,622 @@ func (api *ApiHandler) getLastUpdatedPrice(c echo.Context) error {
 	price, err := api.dbh.GetLastUpdatedPrice(l, shopID, productID)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return NewNotFoundError(err)
+			return NewNotFoundError(CodePriceNotFound, err)
 		}
 		l.WithError(err).Error("Failed to get last updated price")
 		return NewInternalServerError(err)
 	}
 
-	return c.JSON(http.StatusOK, price)
+	converted := []db.Price{*price}
+	if err := api.convertPrices(l, c, converted); err != nil {
+		return err
+	}
+	if err := api.normalizePrices(l, c, converted); err != nil {
+		return err
+	}
+
+	return versionedJSON(c, http.StatusOK, converted[0].Version, converted[0])
+}
+
+func (api *ApiHandler) getPriceHistory(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetPriceHistory")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetPriceHistory")
+
+	request, err := NewPriceHistoryRequest(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidQuery, err)
+	}
+	if err := c.Validate(request); err != nil {
+		return NewBadRequestError(CodeValidationFailed, err)
+	}
+	span.SetAttributes(
+		attribute.String("price.shopId", request.ShopID),
+		attribute.String("price.productId", request.ProductID),
+		attribute.String("interval", request.Interval),
+	)
+
+	prices, err := api.dbh.GetPriceHistory(l, request.ShopID, request.ProductID, request.From, request.To)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get price history")
+		l.WithError(err).Error("Failed to get price history")
+		return NewInternalServerError(err)
+	}
+
+	if err := api.convertPrices(l, c, *prices); err != nil {
+		return err
+	}
+	if err := api.normalizePrices(l, c, *prices); err != nil {
+		return err
+	}
+
+	history := db.PriceHistory{
+		ShopID:    request.ShopID,
+		ProductID: request.ProductID,
+		Interval:  db.Interval(request.Interval),
+	}
+	if request.Interval == "" {
+		history.Prices = *prices
+	} else {
+		history.Buckets = db.Downsample(*prices, history.Interval)
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+// Get the price of a product in a shop in effect at a past date, so the
+// reports computed for a date can be computed again
+func (api *ApiHandler) getPriceAt(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetPriceAt")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetPriceAt")
+
+	request, err := NewPriceAtRequest(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidQuery, err)
+	}
+	if err := c.Validate(request); err != nil {
+		return NewBadRequestError(CodeValidationFailed, err)
+	}
+	span.SetAttributes(
+		attribute.String("price.shopId", request.ShopID),
+		attribute.String("price.productId", request.ProductID),
+		attribute.String("price.date", request.Date.Format(time.RFC3339)),
+	)
+
+	price, err := api.dbh.GetPriceAt(l, request.ShopID, request.ProductID, *request.Date)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodePriceNotFound, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get price at date")
+		return NewInternalServerError(err)
+	}
+
+	// Converted at the date, the same report gives the same result
+	prices := []db.Price{*price}
+	if err := api.convertPricesAt(l, c, prices, request.Date); err != nil {
+		return err
+	}
+	if err := api.normalizePrices(l, c, prices); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, prices[0])
+}
+
+// Get the price of every shop and product in effect at a past date
+func (api *ApiHandler) getCatalogPricesAt(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetCatalogPricesAt")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetCatalogPricesAt")
+
+	request, err := NewCatalogPricesAtRequest(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidQuery, err)
+	}
+	if err := c.Validate(request); err != nil {
+		return NewBadRequestError(CodeValidationFailed, err)
+	}
+	span.SetAttributes(attribute.String("price.date", request.Date.Format(time.RFC3339)))
+
+	prices, err := api.dbh.GetPricesAt(l, request.ShopID, request.ProductID, *request.Date)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get prices at date")
+		return NewInternalServerError(err)
+	}
+
+	if err := api.convertPricesAt(l, c, *prices, request.Date); err != nil {
+		return err
+	}
+	if err := api.normalizePrices(l, c, *prices); err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("price.count", len(*prices)))
+	return c.JSON(http.StatusOK, prices)
+}
+
+// convertPrices converts in place the prices to the currency requested by the
+// currency query parameter, with the rate in effect at the date of each price.
+func (api *ApiHandler) convertPrices(l *logrus.Entry, c echo.Context, prices []db.Price) error {
+	return api.convertPricesAt(l, c, prices, nil)
+}
+
+// convertPricesAt converts the prices with the rates in effect at the date,
+// if not nil, rather than at the date of each price
+func (api *ApiHandler) convertPricesAt(l *logrus.Entry, c echo.Context, prices []db.Price, at *time.Time) error {
+	to := c.QueryParam("currency")
+	if to == "" {
+		return nil
+	}
+	if err := api.validation.Validate.Var(to, "iso4217"); err != nil {
+		return NewBadRequestError(CodeInvalidCurrency, clientErrorf("invalid currency %q", to))
+	}
+
+	converter := currency.NewConverter(api.rates)
+	for i := range prices {
+		date := prices[i].UpdatedAt
+		if at != nil {
+			date = *at
+		}
+		converted, err := converter.Convert(l, prices[i].Price, prices[i].Devise, to, date)
+		if err != nil {
+			if errors.Is(err, currency.ErrRateNotFound) {
+				return NewUnprocessableEntityError(CodeExchangeRateNotFound, err)
+			}
+			l.WithError(err).Error("Failed to convert price")
+			return NewInternalServerError(err)
+		}
+		prices[i].Price = converted
+		prices[i].Devise = to
+	}
+	return nil
+}
+
+// normalizePrices computes in place the unit price of the prices, in the unit
+// requested by the unit query parameter, if any, or in their base unit.
+// Prices which can't be converted to the requested unit are left without it.
+func (api *ApiHandler) normalizePrices(l *logrus.Entry, c echo.Context, prices []db.Price) error {
+	var to units.Unit
+	if param := c.QueryParam("unit"); param != "" {
+		var err error
+		if to, err = units.Parse(param); err != nil {
+			return NewBadRequestError(CodeInvalidUnit, err)
+		}
+	}
+
+	// The densities of the products are loaded at once, a missing product has none
+	densities := make(map[string]float64)
+	ids := make([]string, 0)
+	needed := make(map[string]bool)
+	for i := range prices {
+		if prices[i].NeedsDensity(to) && !needed[prices[i].ProductID] {
+			needed[prices[i].ProductID] = true
+			ids = append(ids, prices[i].ProductID)
+		}
+	}
+	if len(ids) > 0 {
+		ingredients, err := api.dbh.FindIngredientsByIDs(l, ids)
+		if err != nil {
+			l.WithError(err).Error("Failed to get ingredient densities")
+			return NewInternalServerError(err)
+		}
+		for _, ingredient := range *ingredients {
+			densities[ingredient.ID.Hex()] = ingredient.Density
+		}
+	}
+
+	for i := range prices {
+		var density float64
+		if prices[i].NeedsDensity(to) {
+			density = densities[prices[i].ProductID]
+		}
+		if err := prices[i].Normalize(to, density); err != nil {
+			l.WithError(err).WithField("productId", prices[i].ProductID).Debug("Failed to normalize price")
+		}
+	}
+	return nil
+}
+
+// Exchange rate operations
+
+func (api *ApiHandler) createExchangeRate(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "CreateExchangeRate")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "CreateExchangeRate")
+
+	var rate InsertExchangeRate
+	if err := c.Bind(&rate); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(rate); err != nil {
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
+	}
+
+	inserted, err := api.dbh.CreateExchangeRate(l, NewInsertExchangeRate(&rate))
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return NewConflictError(CodeExchangeRateDuplicate, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to insert exchange rate")
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusCreated, inserted)
+}
+
+func (api *ApiHandler) getExchangeRates(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetExchangeRates")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetExchangeRates")
+
+	page, err := NewPagination(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidPagination, err)
+	}
+
+	rates, err := api.dbh.GetExchangeRates(l, c.QueryParam("base"), c.QueryParam("quote"), page)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPagination) {
+			return NewBadRequestError(CodeInvalidPagination, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get exchange rates")
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, rates)
+}
+
+func (api *ApiHandler) getExchangeRate(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetExchangeRate")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetExchangeRate")
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return NewBadRequestError(CodeInvalidID, err)
+	}
+
+	rate, err := api.dbh.GetExchangeRate(l, id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeExchangeRateNotFound, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get exchange rate")
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, rate)
+}
+
+func (api *ApiHandler) updateExchangeRate(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "UpdateExchangeRate")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "UpdateExchangeRate")
+
+	var rate UpdateExchangeRate
+	if err := c.Bind(&rate); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(rate); err != nil {
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
+	}
+
+	dbRate, err := NewUpdateExchangeRate(&rate)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidID, err)
+	}
+
+	updated, err := api.dbh.UpdateExchangeRate(l, dbRate)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeExchangeRateNotFound, err)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return NewConflictError(CodeExchangeRateDuplicate, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to update exchange rate")
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, updated)
+}
+
+func (api *ApiHandler) deleteExchangeRate(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "DeleteExchangeRate")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "DeleteExchangeRate")
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return NewBadRequestError(CodeInvalidID, clientErrorf("Invalid ID"))
+	}
+
+	if err := api.dbh.DeleteExchangeRate(l, id); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeExchangeRateNotFound, clientErrorf("Exchange rate not found"))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to delete exchange rate")
+		return NewInternalServerError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Import an ECB reference rates CSV file, sent as the body or as the
+// "file" field of a multipart form.
+func (api *ApiHandler) importExchangeRates(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "ImportExchangeRates")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "ImportExchangeRates")
+
+	var file io.Reader = c.Request().Body
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return NewBadRequestError(CodeInvalidRequest, err)
+		}
+		f, err := header.Open()
+		if err != nil {
+			return NewBadRequestError(CodeInvalidRequest, err)
+		}
+		defer f.Close()
+		file = f
+	}
+
+	rates, err := currency.ParseECBCSV(file)
+	if err != nil {
+		return NewUnprocessableEntityError(CodeInvalidRatesFile, clientErrorf("invalid file: %w", err))
+	}
+	valid := make([]db.ExchangeRate, 0, len(rates))
+	skipped := make([]string, 0)
+	for _, rate := range rates {
+		// The historical files hold the currencies replaced by the euro, such as CYP
+		if err := api.validation.Validate.Var(rate.Quote, "iso4217"); err != nil {
+			if !slices.Contains(skipped, rate.Quote) {
+				skipped = append(skipped, rate.Quote)
+			}
+			continue
+		}
+		if err := api.validation.Validate.Struct(rate); err != nil {
+			return NewUnprocessableEntityError(CodeInvalidRatesFile, clientErrorf("invalid rate %s on %s: %w", rate.Quote, rate.Date.Format(time.DateOnly), err))
+		}
+		valid = append(valid, rate)
+	}
+	if len(skipped) > 0 {
+		l.WithField("currencies", skipped).Warn("Skipped the rates of unknown currencies")
+	}
+
+	imported, err := api.dbh.ImportExchangeRates(l, valid)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to import exchange rates")
+		return NewInternalServerError(err)
+	}
+
+	span.SetAttributes(attribute.Int("rates.read", len(rates)), attribute.Int64("rates.imported", imported), attribute.StringSlice("rates.skipped", skipped))
+	return c.JSON(http.StatusOK, map[string]any{
+		"read":     len(rates),
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
+
+// Basket operations
+
+func (api *ApiHandler) optimizeBasket(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "OptimizeBasket")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "OptimizeBasket")
+
+	var request OptimizeBasketRequest
+	if err := c.Bind(&request); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(request); err != nil {
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
+	}
+	if request.Mode == "" {
+		request.Mode = string(basket.ModeSingleShop)
+	}
+	if request.MaxShops == 0 {
+		request.MaxShops = 2
+	}
+	if request.Devise == "" {
+		request.Devise = "EUR"
+	}
+
+	items := make([]basket.Item, len(request.Items))
+	productIDs := make([]string, len(request.Items))
+	for i, item := range request.Items {
+		items[i] = basket.Item{ProductID: item.ProductID, Quantity: item.Quantity}
+		productIDs[i] = item.ProductID
+	}
+
+	prices, err := api.dbh.GetLatestPrices(l, productIDs)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get latest prices")
+		l.WithError(err).Error("Failed to get latest prices")
+		return NewInternalServerError(err)
+	}
+
+	// Compare the prices in the requested devise, ignoring those without a known rate
+	converter := currency.NewConverter(api.rates)
+	basketPrices := make([]db.Price, 0, len(*prices))
+	for _, price := range *prices {
+		converted, err := converter.Convert(l, price.Price, price.Devise, request.Devise, price.UpdatedAt)
+		if err != nil {
+			WarnOnError(l, err, "Price ignored, unable to convert it")
+			continue
+		}
+		price.Price, price.Devise = converted, request.Devise
+		basketPrices = append(basketPrices, price)
+	}
+
+	plan := basket.Optimize(items, basketPrices, request.Devise, basket.Mode(request.Mode), request.MaxShops)
+	span.SetAttributes(
+		attribute.String("basket.mode", request.Mode),
+		attribute.Int("basket.shops", len(plan.Shops)),
+		attribute.Int("basket.missing", len(plan.Missing)),
+	)
+
+	return c.JSON(http.StatusOK, plan)
+}
+
+// API key operations
+
+func (api *ApiHandler) createAPIKey(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "CreateAPIKey")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "CreateAPIKey")
+
+	var apiKey InsertAPIKey
+	if err := c.Bind(&apiKey); err != nil {
+		return NewBadRequestError(CodeInvalidRequest, err)
+	}
+	if err := c.Validate(apiKey); err != nil {
+		return NewUnprocessableEntityError(CodeValidationFailed, err)
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to generate API key")
+		l.WithError(err).Error("Failed to generate API key")
+		return NewInternalServerError(err)
+	}
+
+	inserted, err := api.dbh.CreateAPIKey(l, NewInsertAPIKey(&apiKey, key))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to create API key")
+		return NewInternalServerError(err)
+	}
+
+	span.SetAttributes(attribute.String("apikey.id", inserted.ID.Hex()))
+	return c.JSON(http.StatusCreated, CreatedAPIKey{APIKey: *inserted, Key: key})
+}
+
+func (api *ApiHandler) getAPIKeys(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "GetAPIKeys")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "GetAPIKeys")
+
+	page, err := NewPagination(c)
+	if err != nil {
+		return NewBadRequestError(CodeInvalidPagination, err)
+	}
+
+	keys, err := api.dbh.GetAPIKeys(l, page)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPagination) {
+			return NewBadRequestError(CodeInvalidPagination, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get API keys")
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, keys)
+}
+
+func (api *ApiHandler) revokeAPIKey(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "RevokeAPIKey")
+	defer span.End()
+	l := logger.WithContext(ctx).WithField("request", "RevokeAPIKey")
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return NewBadRequestError(CodeInvalidID, clientErrorf("Invalid ID"))
+	}
+
+	span.SetAttributes(attribute.String("apikey.id", id.Hex()))
+	if err := api.dbh.RevokeAPIKey(l, id); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return NewNotFoundError(CodeAPIKeyNotFound, clientErrorf("API key not found"))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to revoke API key")
+		return NewInternalServerError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Start the rebuild of the price projection from the event store. The rebuild
+// runs in the background, its progress is polled with getRebuildStatus.
+func (api *ApiHandler) rebuildProjection(c echo.Context) error {
+	_, span := api.tracer.Start(c.Request().Context(), "RebuildProjection")
+	defer span.End()
+	// The rebuild outlives the request, its logs are not tied to its context
+	l := logger.WithField("request", "RebuildProjection")
+
+	if api.conf.EventStoreURI == "" {
+		return NewNotFoundError(CodeProjectionNotFound, db.ErrNoProjection)
+	}
+
+	opts := db.RebuildOptions{}
+	if param := c.QueryParam("fromPosition"); param != "" {
+		from, err := db.ParsePosition(param)
+		if err != nil {
+			return NewBadRequestError(CodeInvalidQuery, err)
+		}
+		opts.From = from
+	}
+	if param := c.QueryParam("dryRun"); param != "" {
+		var err error
+		if opts.DryRun, err = strconv.ParseBool(param); err != nil {
+			return NewBadRequestError(CodeInvalidQuery, clientErrorf("invalid dryRun: %w", err))
+		}
+	}
+
+	api.rebuildMutex.Lock()
+	defer api.rebuildMutex.Unlock()
+	if api.rebuildStatus.Running {
+		return NewConflictError(CodeRebuildRunning, clientErrorf("a rebuild is already running"))
+	}
+	api.rebuildStatus = RebuildStatus{
+		Running:  true,
+		Progress: &db.RebuildProgress{DryRun: opts.DryRun, StartedAt: time.Now()},
+	}
+
+	go func() {
+		progress, err := api.dbh.RebuildPriceProjection(l, &opts, func(progress db.RebuildProgress) {
+			l.WithFields(logrus.Fields{
+				"events": progress.Events,
+				"prices": progress.Prices,
+			}).Info("Rebuilding the price projection")
+			api.rebuildMutex.Lock()
+			api.rebuildStatus.Progress = &progress
+			api.rebuildMutex.Unlock()
+		})
+
+		api.rebuildMutex.Lock()
+		defer api.rebuildMutex.Unlock()
+		api.rebuildStatus.Running = false
+		if progress != nil {
+			api.rebuildStatus.Progress = progress
+		}
+		if err != nil {
+			l.WithError(err).Error("Failed to rebuild the price projection")
+			api.rebuildStatus.Error = CodeRebuildFailed
+		}
+	}()
+
+	c.Response().Header().Set(echo.HeaderLocation, c.Request().URL.Path)
+	return c.JSON(http.StatusAccepted, api.rebuildStatus)
+}
+
+func (api *ApiHandler) getRebuildStatus(c echo.Context) error {
+	api.rebuildMutex.Lock()
+	defer api.rebuildMutex.Unlock()
+	return c.JSON(http.StatusOK, api.rebuildStatus)
 }
@@ -0,0 +1,252 @@
+// Package basket computes the cheapest way to buy a list of products
+// from the latest prices known for each shop.
+package basket
+
+import (
+	"catalog/db"
+	"catalog/money"
+	"slices"
+	"strings"
+)
+
+type Mode string
+
+const (
+	// Buy every product in the same shop
+	ModeSingleShop Mode = "single"
+	// Split the basket across at most MaxShops shops
+	ModeSplit Mode = "split"
+)
+
+// Above this number of shop combinations, the optimizer falls back to a
+// greedy search instead of trying every combination.
+const maxCombinations = 50000
+
+type Item struct {
+	ProductID string
+	Quantity  float64
+}
+
+type Line struct {
+	ProductID string       `json:"productId"`
+	Quantity  float64      `json:"quantity"`
+	UnitPrice money.Amount `json:"unitPrice"`
+	Total     money.Amount `json:"total"`
+}
+
+type ShopPlan struct {
+	ShopID string       `json:"shopId"`
+	Lines  []Line       `json:"lines"`
+	Total  money.Amount `json:"total"`
+}
+
+type Plan struct {
+	Mode   Mode         `json:"mode"`
+	Devise string       `json:"devise"`
+	Shops  []ShopPlan   `json:"shops"`
+	Total  money.Amount `json:"total"`
+	// Products without any known price
+	Missing []string `json:"missing"`
+	// Products priced somewhere, but in none of the selected shops
+	Unavailable []string `json:"unavailable"`
+}
+
+// priceTable holds the unit price of each product, per shop
+type priceTable map[string]map[string]money.Amount
+
+type candidate struct {
+	shops   []string
+	covered int
+	total   money.Amount
+}
+
+// better orders the candidates: most products covered, then cheapest,
+// then the fewest shops to visit.
+func (c *candidate) better(o *candidate) bool {
+	if o == nil {
+		return true
+	}
+	if c.covered != o.covered {
+		return c.covered > o.covered
+	}
+	if c.total != o.total {
+		return c.total.Cmp(o.total) < 0
+	}
+	return len(c.shops) < len(o.shops)
+}
+
+// Optimize returns the cheapest plan to buy the items, using only the prices
+// in the given devise. In single mode maxShops is ignored.
+func Optimize(items []Item, prices []db.Price, devise string, mode Mode, maxShops int) *Plan {
+	table := make(priceTable)
+	for _, p := range prices {
+		if p.Devise != devise {
+			continue
+		}
+		if table[p.ProductID] == nil {
+			table[p.ProductID] = make(map[string]money.Amount)
+		}
+		table[p.ProductID][p.ShopID] = p.Price
+	}
+
+	plan := Plan{
+		Mode:        mode,
+		Devise:      devise,
+		Shops:       make([]ShopPlan, 0),
+		Missing:     make([]string, 0),
+		Unavailable: make([]string, 0),
+	}
+
+	priced := make([]Item, 0, len(items))
+	shopSet := make(map[string]struct{})
+	for _, item := range items {
+		if len(table[item.ProductID]) == 0 {
+			plan.Missing = append(plan.Missing, item.ProductID)
+			continue
+		}
+		priced = append(priced, item)
+		for shopID := range table[item.ProductID] {
+			shopSet[shopID] = struct{}{}
+		}
+	}
+	if len(priced) == 0 {
+		return &plan
+	}
+
+	shops := make([]string, 0, len(shopSet))
+	for shopID := range shopSet {
+		shops = append(shops, shopID)
+	}
+	slices.Sort(shops)
+
+	if mode == ModeSingleShop || maxShops < 1 {
+		maxShops = 1
+	}
+	maxShops = min(maxShops, len(shops))
+
+	var best *candidate
+	if countCombinations(len(shops), maxShops) <= maxCombinations {
+		best = exhaustiveSearch(priced, table, shops, maxShops)
+	} else {
+		best = greedySearch(priced, table, shops, maxShops)
+	}
+
+	plan.fill(priced, table, best.shops)
+	return &plan
+}
+
+// evaluate computes the coverage and the cost of buying the items in the shops
+func evaluate(items []Item, table priceTable, shops []string) *candidate {
+	c := candidate{shops: shops}
+	for _, item := range items {
+		if _, price, ok := cheapestShop(table[item.ProductID], shops); ok {
+			c.covered++
+			c.total = c.total.Add(price.Mul(item.Quantity))
+		}
+	}
+	return &c
+}
+
+func cheapestShop(productPrices map[string]money.Amount, shops []string) (string, money.Amount, bool) {
+	var bestShop string
+	var bestPrice money.Amount
+	found := false
+	for _, shopID := range shops {
+		price, ok := productPrices[shopID]
+		if ok && (!found || price.Cmp(bestPrice) < 0) {
+			bestShop, bestPrice, found = shopID, price, true
+		}
+	}
+	return bestShop, bestPrice, found
+}
+
+func exhaustiveSearch(items []Item, table priceTable, shops []string, maxShops int) *candidate {
+	var best *candidate
+	combination := make([]string, 0, maxShops)
+	var walk func(start int)
+	walk = func(start int) {
+		if len(combination) > 0 {
+			if c := evaluate(items, table, slices.Clone(combination)); c.better(best) {
+				best = c
+			}
+		}
+		if len(combination) == maxShops {
+			return
+		}
+		for i := start; i < len(shops); i++ {
+			combination = append(combination, shops[i])
+			walk(i + 1)
+			combination = combination[:len(combination)-1]
+		}
+	}
+	walk(0)
+	return best
+}
+
+// greedySearch adds, one at a time, the shop improving the plan the most
+func greedySearch(items []Item, table priceTable, shops []string, maxShops int) *candidate {
+	var best *candidate
+	selected := make([]string, 0, maxShops)
+	for len(selected) < maxShops {
+		var next *candidate
+		for _, shopID := range shops {
+			if slices.Contains(selected, shopID) {
+				continue
+			}
+			if c := evaluate(items, table, append(slices.Clone(selected), shopID)); c.better(next) {
+				next = c
+			}
+		}
+		if next == nil || (best != nil && !next.better(best)) {
+			break
+		}
+		best = next
+		selected = next.shops
+	}
+	return best
+}
+
+func countCombinations(n, k int) int {
+	total, current := 0, 1
+	for i := 1; i <= k; i++ {
+		current = current * (n - i + 1) / i
+		total += current
+		if total > maxCombinations {
+			return total
+		}
+	}
+	return total
+}
+
+// fill assigns each item to the cheapest of the selected shops
+func (plan *Plan) fill(items []Item, table priceTable, shops []string) {
+	byShop := make(map[string]*ShopPlan)
+	for _, item := range items {
+		shopID, price, ok := cheapestShop(table[item.ProductID], shops)
+		if !ok {
+			plan.Unavailable = append(plan.Unavailable, item.ProductID)
+			continue
+		}
+		shopPlan, ok := byShop[shopID]
+		if !ok {
+			shopPlan = &ShopPlan{ShopID: shopID, Lines: make([]Line, 0)}
+			byShop[shopID] = shopPlan
+		}
+		line := Line{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			UnitPrice: price,
+			Total:     price.Mul(item.Quantity),
+		}
+		shopPlan.Lines = append(shopPlan.Lines, line)
+		shopPlan.Total = shopPlan.Total.Add(line.Total)
+		plan.Total = plan.Total.Add(line.Total)
+	}
+
+	for _, shopPlan := range byShop {
+		plan.Shops = append(plan.Shops, *shopPlan)
+	}
+	slices.SortFunc(plan.Shops, func(a, b ShopPlan) int {
+		return strings.Compare(a.ShopID, b.ShopID)
+	})
+}
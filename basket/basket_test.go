@@ -0,0 +1,56 @@
+package basket
+
+import (
+	"catalog/db"
+	"catalog/money"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	prices := []db.Price{
+		{ShopID: "lidl", ProductID: "milk", Price: money.MustParse("1.0"), Devise: "EUR"},
+		{ShopID: "lidl", ProductID: "bread", Price: money.MustParse("3.0"), Devise: "EUR"},
+		{ShopID: "lidl", ProductID: "eggs", Price: money.MustParse("4.0"), Devise: "EUR"},
+		{ShopID: "aldi", ProductID: "milk", Price: money.MustParse("1.5"), Devise: "EUR"},
+		{ShopID: "aldi", ProductID: "bread", Price: money.MustParse("1.0"), Devise: "EUR"},
+		{ShopID: "aldi", ProductID: "eggs", Price: money.MustParse("2.0"), Devise: "EUR"},
+		{ShopID: "coop", ProductID: "milk", Price: money.MustParse("0.5"), Devise: "EUR"},
+		{ShopID: "migros", ProductID: "milk", Price: money.MustParse("0.1"), Devise: "CHF"},
+	}
+	items := []Item{
+		{ProductID: "milk", Quantity: 2},
+		{ProductID: "bread", Quantity: 1},
+		{ProductID: "eggs", Quantity: 1},
+		{ProductID: "caviar", Quantity: 1},
+	}
+
+	t.Run("Everything from a single shop", func(t *testing.T) {
+		plan := Optimize(items, prices, "EUR", ModeSingleShop, 0)
+		if len(plan.Shops) != 1 || plan.Shops[0].ShopID != "aldi" {
+			t.Fatalf("Expected aldi, got %+v", plan.Shops)
+		}
+		if plan.Total != money.MustParse("6") {
+			t.Fatalf("Expected a total of 6, got %v", plan.Total)
+		}
+		if len(plan.Missing) != 1 || plan.Missing[0] != "caviar" {
+			t.Fatalf("Expected caviar to be missing, got %v", plan.Missing)
+		}
+	})
+
+	t.Run("Split across two shops", func(t *testing.T) {
+		plan := Optimize(items, prices, "EUR", ModeSplit, 2)
+		if len(plan.Shops) != 2 || plan.Shops[0].ShopID != "aldi" || plan.Shops[1].ShopID != "coop" {
+			t.Fatalf("Expected aldi and coop, got %+v", plan.Shops)
+		}
+		if plan.Total != money.MustParse("4") {
+			t.Fatalf("Expected a total of 4, got %v", plan.Total)
+		}
+	})
+
+	t.Run("Prefer the coverage over the price", func(t *testing.T) {
+		plan := Optimize(items[:2], prices, "EUR", ModeSingleShop, 0)
+		if plan.Shops[0].ShopID != "aldi" || len(plan.Unavailable) != 0 {
+			t.Fatalf("Expected aldi covering everything, got %+v", plan)
+		}
+	})
+}
@@ -0,0 +1,349 @@
+// Package bulk reads and writes the ingredient catalog as CSV or JSON Lines,
+// the formats of the import and export routes.
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"catalog/db"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Format string
+
+const (
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+)
+
+const (
+	MIMECSV    = "text/csv"
+	MIMENDJSON = "application/x-ndjson"
+)
+
+// The CSV columns, the localized names have one column each, such as name_fr
+const (
+	columnID            = "id"
+	columnName          = "name"
+	columnType          = "type"
+	columnImageURL      = "image_url"
+	columnDensity       = "density"
+	localizedNamePrefix = "name_"
+)
+
+// The longest line of a JSON Lines file
+const maxLineSize = 1 << 20
+
+var (
+	ErrUnknownFormat = errors.New("unknown format")
+	ErrInvalidHeader = errors.New("invalid header")
+)
+
+// Row is an ingredient read from a file. Err holds why the row couldn't be
+// read, the other rows are still read.
+type Row struct {
+	Line       int
+	Ingredient db.Ingredient
+	// The optional fields given by the row, even empty, as listed by
+	// db.IngredientImport
+	Fields []string
+	Err    error
+}
+
+// ParseFormat parses the name of a format, as given in a query parameter
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case CSV, NDJSON:
+		return format, nil
+	case "jsonl":
+		return NDJSON, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+}
+
+// FormatFromContentType returns the format of a media type
+func FormatFromContentType(contentType string) (Format, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", ErrUnknownFormat, contentType)
+	}
+	switch mediaType {
+	case MIMECSV, "application/csv":
+		return CSV, nil
+	case MIMENDJSON, "application/jsonl", "application/json-lines", "application/jsonlines":
+		return NDJSON, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownFormat, mediaType)
+}
+
+// FormatFromFilename returns the format of a file by its extension
+func FormatFromFilename(filename string) (Format, error) {
+	return ParseFormat(strings.TrimPrefix(path.Ext(filename), "."))
+}
+
+func (f Format) ContentType() string {
+	if f == CSV {
+		return MIMECSV + "; charset=utf-8"
+	}
+	return MIMENDJSON
+}
+
+// Read calls fn with every row of the file, in order. It stops on the first
+// error returned by fn, or when the file itself can't be read.
+func Read(r io.Reader, format Format, fn func(Row) error) error {
+	switch format {
+	case CSV:
+		return readCSV(r, fn)
+	case NDJSON:
+		return readNDJSON(r, fn)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+}
+
+// readCSV reads a CSV file with a header. The separator is a comma or a
+// semicolon, as written by the spreadsheets of some locales.
+func readCSV(r io.Reader, fn func(Row) error) error {
+	buffered := bufio.NewReader(r)
+	// Skip the byte order mark written by some spreadsheets
+	if bom, err := buffered.Peek(3); err == nil && bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		buffered.Discard(3)
+	}
+	firstLine, _ := buffered.Peek(buffered.Buffered())
+	if line, _, found := bytes.Cut(firstLine, []byte("\n")); found {
+		firstLine = line
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: empty file", ErrInvalidHeader)
+		}
+		return err
+	}
+	columns, err := parseHeader(header)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return err
+		}
+
+		var row Row
+		if err != nil {
+			row = Row{Line: parseErr.StartLine, Err: err}
+		} else {
+			row.Line, _ = reader.FieldPos(0)
+			row.Ingredient, row.Err = parseRecord(columns, record)
+			row.Fields = columnFields(columns)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+func parseHeader(header []string) ([]string, error) {
+	columns := make([]string, len(header))
+	seen := make(map[string]bool, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		switch {
+		case column == columnID, column == columnName, column == columnType,
+			column == columnImageURL, column == columnDensity:
+		case strings.HasPrefix(column, localizedNamePrefix) && len(column) > len(localizedNamePrefix):
+		default:
+			return nil, fmt.Errorf("%w: unknown column %q", ErrInvalidHeader, header[i])
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("%w: duplicate column %q", ErrInvalidHeader, header[i])
+		}
+		seen[column] = true
+		columns[i] = column
+	}
+	if !seen[columnName] {
+		return nil, fmt.Errorf("%w: missing column %q", ErrInvalidHeader, columnName)
+	}
+	return columns, nil
+}
+
+// columnFields returns the optional fields of the columns
+func columnFields(columns []string) []string {
+	fields := make([]string, 0, len(columns))
+	for _, column := range columns {
+		switch {
+		case column == columnDensity:
+			fields = append(fields, db.FieldDensity)
+		case strings.HasPrefix(column, localizedNamePrefix):
+			fields = append(fields, db.FieldNames+"."+strings.TrimPrefix(column, localizedNamePrefix))
+		}
+	}
+	return fields
+}
+
+func parseRecord(columns, record []string) (db.Ingredient, error) {
+	var ingredient db.Ingredient
+	if len(record) != len(columns) {
+		return ingredient, fmt.Errorf("expected %d fields, got %d", len(columns), len(record))
+	}
+
+	for i, column := range columns {
+		value := strings.TrimSpace(record[i])
+		switch column {
+		case columnName:
+			ingredient.Name = value
+		case columnType:
+			ingredient.Type = value
+		case columnImageURL:
+			ingredient.ImageURL = value
+		case columnDensity:
+			if value == "" {
+				continue
+			}
+			// Accept the decimal comma of the spreadsheets
+			density, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+			if err != nil {
+				return ingredient, fmt.Errorf("invalid density %q", value)
+			}
+			ingredient.Density = density
+		case columnID:
+			// The ingredients are matched by name, the ID is only exported
+		default:
+			if value == "" {
+				continue
+			}
+			if ingredient.Names == nil {
+				ingredient.Names = make(map[string]string)
+			}
+			ingredient.Names[strings.TrimPrefix(column, localizedNamePrefix)] = value
+		}
+	}
+	return ingredient, nil
+}
+
+func readNDJSON(r io.Reader, fn func(Row) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		row := Row{Line: line}
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(data, &row.Ingredient); err != nil {
+			row.Err = fmt.Errorf("invalid JSON: %w", err)
+		} else if err := json.Unmarshal(data, &keys); err == nil {
+			for _, field := range []string{db.FieldDensity, db.FieldNames} {
+				if _, ok := keys[field]; ok {
+					row.Fields = append(row.Fields, field)
+				}
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Writer writes the ingredients one by one, so the export is streamed
+type Writer interface {
+	Write(ingredient *db.Ingredient) error
+	// Flush writes the buffered ingredients
+	Flush() error
+}
+
+// NewWriter returns a writer of the format. The CSV files have a column per
+// locale, for the localized names.
+func NewWriter(w io.Writer, format Format, locales []string) (Writer, error) {
+	switch format {
+	case CSV:
+		sorted := append([]string(nil), locales...)
+		sort.Strings(sorted)
+		return &csvWriter{writer: csv.NewWriter(w), locales: sorted}, nil
+	case NDJSON:
+		buffered := bufio.NewWriter(w)
+		return &ndjsonWriter{buffered: buffered, encoder: json.NewEncoder(buffered)}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+}
+
+type csvWriter struct {
+	writer        *csv.Writer
+	locales       []string
+	headerWritten bool
+}
+
+func (w *csvWriter) Write(ingredient *db.Ingredient) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	var density string
+	if ingredient.Density != 0 {
+		density = strconv.FormatFloat(ingredient.Density, 'f', -1, 64)
+	}
+	record := []string{ingredient.ID.Hex(), ingredient.Name, ingredient.Type, ingredient.ImageURL, density}
+	for _, locale := range w.locales {
+		record = append(record, ingredient.Names[locale])
+	}
+	return w.writer.Write(record)
+}
+
+// writeHeader writes the header before the first ingredient, or on the flush
+// of an empty catalog
+func (w *csvWriter) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	header := []string{columnID, columnName, columnType, columnImageURL, columnDensity}
+	for _, locale := range w.locales {
+		header = append(header, localizedNamePrefix+locale)
+	}
+	w.headerWritten = true
+	return w.writer.Write(header)
+}
+
+func (w *csvWriter) Flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type ndjsonWriter struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func (w *ndjsonWriter) Write(ingredient *db.Ingredient) error {
+	return w.encoder.Encode(ingredient)
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.buffered.Flush()
+}
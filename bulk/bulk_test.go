@@ -0,0 +1,220 @@
+package bulk
+
+import (
+	"bytes"
+	"catalog/db"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func readAll(t *testing.T, data string, format Format) []Row {
+	t.Helper()
+	rows := make([]Row, 0)
+	err := Read(strings.NewReader(data), format, func(row Row) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	return rows
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	ingredients := []db.Ingredient{
+		{ID: primitive.NewObjectID(), Name: "Carrot", Type: "vegetable", Density: 0.64, Names: map[string]string{"fr": "Carotte"}},
+		{ID: primitive.NewObjectID(), Name: "Milk, whole", Type: "dairy", ImageURL: "https://example.com/milk.png", Names: map[string]string{"de": "Vollmilch", "fr": "Lait entier"}},
+	}
+
+	var buffer bytes.Buffer
+	writer, err := NewWriter(&buffer, CSV, []string{"fr", "de"})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %v", err)
+	}
+	for i := range ingredients {
+		if err := writer.Write(&ingredients[i]); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	header, _, _ := strings.Cut(buffer.String(), "\n")
+	if header != "id,name,type,image_url,density,name_de,name_fr" {
+		t.Fatalf("Unexpected header %q", header)
+	}
+
+	rows := readAll(t, buffer.String(), CSV)
+	if len(rows) != len(ingredients) {
+		t.Fatalf("Expected %d rows, got %d", len(ingredients), len(rows))
+	}
+	for i, row := range rows {
+		if row.Err != nil {
+			t.Fatalf("Row %d failed: %v", i, row.Err)
+		}
+		if row.Line != i+2 {
+			t.Errorf("Expected the line %d, got %d", i+2, row.Line)
+		}
+		// The IDs are not imported
+		expected := ingredients[i]
+		expected.ID = primitive.NilObjectID
+		if !reflect.DeepEqual(expected, row.Ingredient) {
+			t.Errorf("Expected %+v, got %+v", expected, row.Ingredient)
+		}
+	}
+}
+
+func TestCSVEmptyExport(t *testing.T) {
+	var buffer bytes.Buffer
+	writer, _ := NewWriter(&buffer, CSV, nil)
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if buffer.String() != "id,name,type,image_url,density\n" {
+		t.Fatalf("Unexpected export %q", buffer.String())
+	}
+}
+
+func TestCSVSpreadsheet(t *testing.T) {
+	data := "\xef\xbb\xbfName;Density;Name_FR\r\nButter;0,91;Beurre\r\nFlour;;\r\n"
+	rows := readAll(t, data, CSV)
+	expected := []db.Ingredient{
+		{Name: "Butter", Density: 0.91, Names: map[string]string{"fr": "Beurre"}},
+		{Name: "Flour"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got %d", len(expected), len(rows))
+	}
+	for i, row := range rows {
+		if row.Err != nil {
+			t.Fatalf("Row %d failed: %v", i, row.Err)
+		}
+		if !reflect.DeepEqual(expected[i], row.Ingredient) {
+			t.Errorf("Expected %+v, got %+v", expected[i], row.Ingredient)
+		}
+		// The columns are given even empty, to be cleared
+		if fields := []string{"density", "names.fr"}; !reflect.DeepEqual(fields, row.Fields) {
+			t.Errorf("Expected the fields %v, got %v", fields, row.Fields)
+		}
+	}
+}
+
+func TestCSVRowErrors(t *testing.T) {
+	data := "name,density\nSugar,0.85\nSalt,heavy\nPepper\n\"Oil,0.92\n"
+	rows := readAll(t, data, CSV)
+	if len(rows) != 4 {
+		t.Fatalf("Expected 4 rows, got %d", len(rows))
+	}
+	if rows[0].Err != nil {
+		t.Errorf("Expected a valid first row, got %v", rows[0].Err)
+	}
+	for i, line := range []int{3, 4, 5} {
+		row := rows[i+1]
+		if row.Err == nil {
+			t.Errorf("Expected an error on the line %d", line)
+		}
+		if row.Line != line {
+			t.Errorf("Expected the line %d, got %d", line, row.Line)
+		}
+	}
+}
+
+func TestCSVInvalidHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"Empty file", ""},
+		{"Unknown column", "name,price\nSugar,1\n"},
+		{"Duplicate column", "name,Name\nSugar,Sucre\n"},
+		{"Missing name", "type,density\nsweet,0.85\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Read(strings.NewReader(tt.data), CSV, func(Row) error { return nil })
+			if !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("Expected %v, got %v", ErrInvalidHeader, err)
+			}
+		})
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	ingredients := []db.Ingredient{
+		{ID: primitive.NewObjectID(), Name: "Carrot", Type: "vegetable", Names: map[string]string{"fr": "Carotte"}},
+		{ID: primitive.NewObjectID(), Name: "Milk", Density: 1.03},
+	}
+
+	var buffer bytes.Buffer
+	writer, err := NewWriter(&buffer, NDJSON, nil)
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %v", err)
+	}
+	for i := range ingredients {
+		if err := writer.Write(&ingredients[i]); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	buffer.WriteString("\n{\"name\":\n")
+
+	rows := readAll(t, buffer.String(), NDJSON)
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %d", len(rows))
+	}
+	for i, ingredient := range ingredients {
+		if rows[i].Err != nil {
+			t.Fatalf("Row %d failed: %v", i, rows[i].Err)
+		}
+		if !reflect.DeepEqual(ingredient, rows[i].Ingredient) {
+			t.Errorf("Expected %+v, got %+v", ingredient, rows[i].Ingredient)
+		}
+	}
+	// The empty fields are left out of the export, so kept by the import
+	if fields := []string{"names"}; !reflect.DeepEqual(fields, rows[0].Fields) {
+		t.Errorf("Expected the fields %v, got %v", fields, rows[0].Fields)
+	}
+	// The blank line is skipped but counted
+	if rows[2].Err == nil || rows[2].Line != 4 {
+		t.Errorf("Expected an error on the line 4, got %+v", rows[2])
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		parse    func(string) (Format, error)
+		value    string
+		expected Format
+	}{
+		{"Name", ParseFormat, "CSV", CSV},
+		{"JSON Lines name", ParseFormat, "jsonl", NDJSON},
+		{"Unknown name", ParseFormat, "xlsx", ""},
+		{"Content type", FormatFromContentType, "text/csv; charset=utf-8", CSV},
+		{"JSON Lines content type", FormatFromContentType, MIMENDJSON, NDJSON},
+		{"Unknown content type", FormatFromContentType, "application/json", ""},
+		{"Filename", FormatFromFilename, "catalog.ndjson", NDJSON},
+		{"Filename without extension", FormatFromFilename, "catalog", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := tt.parse(tt.value)
+			if tt.expected == "" {
+				if !errors.Is(err, ErrUnknownFormat) {
+					t.Fatalf("Expected %v, got %v", ErrUnknownFormat, err)
+				}
+				return
+			}
+			if err != nil || format != tt.expected {
+				t.Fatalf("Expected %s, got %s (%v)", tt.expected, format, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"catalog/configuration"
+	"catalog/db"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage:
+  catalog                          serve the API
+  catalog projections rebuild      rebuild the price projection from the event store
+      --from-position commit[/prepare]  replay the events from this position of $all
+      --dry-run                         replay the events without writing anything
+`
+
+// The subcommands of the binary, by name
+var commands = map[string]bool{
+	"projections": true,
+}
+
+// isCommand reports whether the arguments start with a subcommand. The other
+// arguments, such as flags, are left to the server.
+func isCommand(args []string) bool {
+	return len(args) > 0 && commands[args[0]]
+}
+
+// runCommand runs a subcommand of the binary and returns its exit code
+func runCommand(conf *configuration.Configuration, args []string) int {
+	if len(args) >= 2 && args[0] == "projections" && args[1] == "rebuild" {
+		return rebuildProjections(conf, args[2:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n%s", strings.Join(args, " "), usage)
+	return 2
+}
+
+func rebuildProjections(conf *configuration.Configuration, args []string) int {
+	flags := flag.NewFlagSet("projections rebuild", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	fromPosition := flags.String("from-position", "", "replay the events from this position of $all")
+	dryRun := flags.Bool("dry-run", false, "replay the events without writing anything")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	l := logger.WithField("command", "projections rebuild")
+	if conf.EventStoreURI == "" {
+		l.Error("EVENTSTORE_URI is not set, the prices are not projected")
+		return 1
+	}
+	opts := db.RebuildOptions{DryRun: *dryRun}
+	if *fromPosition != "" {
+		from, err := db.ParsePosition(*fromPosition)
+		if err != nil {
+			l.WithError(err).Error("Invalid --from-position")
+			return 2
+		}
+		opts.From = from
+	}
+
+	mh, err := db.NewMongoHandler(conf)
+	if err != nil {
+		return 1
+	}
+	defer mh.Disconnect()
+	eh, err := db.NewEventHandler(conf)
+	if err != nil {
+		return 1
+	}
+	dbh := db.NewMixedHandler(mh, eh)
+
+	progress, err := dbh.RebuildPriceProjection(l, &opts, func(progress db.RebuildProgress) {
+		l.WithFields(logrus.Fields{
+			"events":   progress.Events,
+			"prices":   progress.Prices,
+			"position": progress.Position,
+		}).Info("Rebuilding the price projection")
+	})
+	if err != nil {
+		l.WithError(err).Error("Failed to rebuild the price projection")
+		return 1
+	}
+	l.WithFields(logrus.Fields{
+		"events":     progress.Events,
+		"prices":     progress.Prices,
+		"dryRun":     progress.DryRun,
+		"swapped":    progress.Swapped,
+		"collection": progress.Collection,
+	}).Info("Rebuilt the price projection")
+	return 0
+}
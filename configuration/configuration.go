@@ -1,10 +1,12 @@
 package configuration
 
 import (
+	"crypto/rsa"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/sirupsen/logrus"
 )
 
@@ -12,21 +14,36 @@ var logger = logrus.WithFields(logrus.Fields{
 	"context": "configuration/configuration",
 })
 
+// RateLimit allows Burst requests at once, refilled at PerMinute requests
+// per minute. A zero PerMinute disables the limit.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
 type Configuration struct {
-	ListenPort                string
-	ListenAddress             string
-	ListenRoute               string
-	LogLevel                  logrus.Level
-	EventStoreURI             string
-	RabbitURI                 string
-	DBURI                     string
-	DBName                    string
-	IngredientsCollectionName string
-	ShopsCollectionName       string
-	PricesColletionName       string
-	TranslateValidation       bool
-	JWTSecret                 string
-	OtelServiceName           string
+	ListenPort                 string
+	ListenAddress              string
+	ListenRoute                string
+	LogLevel                   logrus.Level
+	EventStoreURI              string
+	RabbitURI                  string
+	DBURI                      string
+	DBName                     string
+	IngredientsCollectionName  string
+	ShopsCollectionName        string
+	PricesColletionName        string
+	RatesCollectionName        string
+	APIKeysCollectionName      string
+	LatestPricesCollectionName string
+	CheckpointsCollectionName  string
+	TranslateValidation        bool
+	JWTSecret                  string
+	JWTPublicKey               *rsa.PublicKey
+	IngredientRateLimit        RateLimit
+	ShopRateLimit              RateLimit
+	PriceRateLimit             RateLimit
+	OtelServiceName            string
 }
 
 func New() *Configuration {
@@ -106,6 +123,27 @@ func New() *Configuration {
 		os.Exit(1)
 	}
 
+	conf.RatesCollectionName = os.Getenv("MONGODB_RATES_COLLECTION")
+	if len(conf.RatesCollectionName) < 1 {
+		conf.RatesCollectionName = "exchange_rate"
+	}
+
+	conf.APIKeysCollectionName = os.Getenv("MONGODB_API_KEYS_COLLECTION")
+	if len(conf.APIKeysCollectionName) < 1 {
+		conf.APIKeysCollectionName = "api_key"
+	}
+
+	// The read model of the prices, projected from the event store
+	conf.LatestPricesCollectionName = os.Getenv("MONGODB_LATEST_PRICES_COLLECTION")
+	if len(conf.LatestPricesCollectionName) < 1 {
+		conf.LatestPricesCollectionName = "latest_price"
+	}
+
+	conf.CheckpointsCollectionName = os.Getenv("MONGODB_CHECKPOINTS_COLLECTION")
+	if len(conf.CheckpointsCollectionName) < 1 {
+		conf.CheckpointsCollectionName = "checkpoint"
+	}
+
 	conf.TranslateValidation, err = strconv.ParseBool(os.Getenv("TRANSLATE_VALIDATION"))
 
 	if err != nil {
@@ -114,6 +152,49 @@ func New() *Configuration {
 	}
 
 	conf.JWTSecret = os.Getenv("JWT_SECRET")
+
+	// PEM encoded public key verifying the RS256 tokens
+	if publicKey := os.Getenv("JWT_PUBLIC_KEY"); len(publicKey) > 0 {
+		conf.JWTPublicKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(publicKey))
+		if err != nil {
+			logger.WithError(err).Error("Failed to parse JWT_PUBLIC_KEY")
+			os.Exit(1)
+		}
+	}
+
+	if len(conf.JWTSecret) < 1 && conf.JWTPublicKey == nil {
+		logger.Warn("Neither JWT_SECRET nor JWT_PUBLIC_KEY is set, every authenticated request will be rejected")
+	}
+
+	// Limits of the write requests of each client
+	conf.IngredientRateLimit = parseRateLimit("INGREDIENT", 60)
+	conf.ShopRateLimit = parseRateLimit("SHOP", 30)
+	conf.PriceRateLimit = parseRateLimit("PRICE", 120)
+
 	conf.OtelServiceName = os.Getenv("OTEL_SERVICE_NAME")
 	return &conf
 }
+
+// parseRateLimit reads RATE_LIMIT_<group> and RATE_LIMIT_<group>_BURST,
+// the burst defaults to the number of requests per minute.
+func parseRateLimit(group string, defaultPerMinute int) RateLimit {
+	limit := RateLimit{PerMinute: defaultPerMinute}
+	var err error
+
+	name := "RATE_LIMIT_" + group
+	if value := os.Getenv(name); len(value) > 0 {
+		if limit.PerMinute, err = strconv.Atoi(value); err != nil || limit.PerMinute < 0 {
+			logger.Error("Failed to parse int for " + name)
+			os.Exit(1)
+		}
+	}
+
+	limit.Burst = limit.PerMinute
+	if value := os.Getenv(name + "_BURST"); len(value) > 0 {
+		if limit.Burst, err = strconv.Atoi(value); err != nil || limit.Burst < 1 {
+			logger.Error("Failed to parse int for " + name + "_BURST")
+			os.Exit(1)
+		}
+	}
+	return limit
+}
@@ -0,0 +1,156 @@
+// Package currency converts amounts between currencies with the exchange
+// rates of a pluggable RateProvider.
+package currency
+
+import (
+	"catalog/db"
+	"catalog/money"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Rates are published against the euro, as the ECB does
+const PivotCurrency = "EUR"
+
+var ErrRateNotFound = errors.New("exchange rate not found")
+
+// Rate is the value of one base unit in quote, in effect from its date until
+// the date of the next rate. A zero Until is the latest rate.
+type Rate struct {
+	Value float64
+	From  time.Time
+	Until time.Time
+}
+
+// covers reports whether the rate is in effect at the given time
+func (r *Rate) covers(at time.Time) bool {
+	return !at.Before(r.From) && (r.Until.IsZero() || at.Before(r.Until))
+}
+
+func (r *Rate) inverse() *Rate {
+	return &Rate{Value: 1 / r.Value, From: r.From, Until: r.Until}
+}
+
+// cross returns the rate through the quote of r to the quote of next, in
+// effect while both are
+func (r *Rate) cross(next *Rate) *Rate {
+	cross := &Rate{Value: r.Value * next.Value, From: r.From, Until: r.Until}
+	if next.From.After(cross.From) {
+		cross.From = next.From
+	}
+	if cross.Until.IsZero() || !next.Until.IsZero() && next.Until.Before(cross.Until) {
+		cross.Until = next.Until
+	}
+	return cross
+}
+
+// RateProvider returns the rate from base to quote in effect at the given time
+type RateProvider interface {
+	Rate(l *logrus.Entry, base, quote string, at time.Time) (*Rate, error)
+}
+
+// DbRateProvider reads the rates from the exchange rate table
+type DbRateProvider struct {
+	dbh db.DbHandler
+}
+
+func NewDbRateProvider(dbh db.DbHandler) *DbRateProvider {
+	return &DbRateProvider{dbh: dbh}
+}
+
+func (p *DbRateProvider) Rate(l *logrus.Entry, base, quote string, at time.Time) (*Rate, error) {
+	rate, err := p.dbh.FindExchangeRate(l, base, quote, at)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrRateNotFound
+		}
+		return nil, err
+	}
+	result := &Rate{Value: rate.Rate, From: rate.Date}
+
+	next, err := p.dbh.FindNextExchangeRate(l, base, quote, rate.Date)
+	if err == nil {
+		result.Until = next.Date
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return result, nil
+}
+
+type ratePair struct {
+	base, quote string
+}
+
+// Converter converts amounts, trying the direct rate, then the inverse one,
+// then a cross rate through the pivot currency. The rates are cached with
+// the period they are in effect, so a Converter is meant to live for a
+// single request.
+type Converter struct {
+	provider RateProvider
+	cache    map[ratePair][]*Rate
+}
+
+func NewConverter(provider RateProvider) *Converter {
+	return &Converter{
+		provider: provider,
+		cache:    make(map[ratePair][]*Rate),
+	}
+}
+
+// Convert returns the amount, in from, converted to the to currency with the
+// rate in effect at the given time.
+func (c *Converter) Convert(l *logrus.Entry, amount money.Amount, from, to string, at time.Time) (money.Amount, error) {
+	rate, err := c.Rate(l, from, to, at)
+	if err != nil {
+		return money.Amount{}, err
+	}
+	return amount.Mul(rate), nil
+}
+
+func (c *Converter) Rate(l *logrus.Entry, from, to string, at time.Time) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	pair := ratePair{base: from, quote: to}
+	for _, rate := range c.cache[pair] {
+		if rate.covers(at) {
+			return rate.Value, nil
+		}
+	}
+
+	rate, err := c.lookup(l, from, to, at)
+	if errors.Is(err, ErrRateNotFound) && from != PivotCurrency && to != PivotCurrency {
+		var toPivot, fromPivot *Rate
+		if toPivot, err = c.lookup(l, from, PivotCurrency, at); err == nil {
+			if fromPivot, err = c.lookup(l, PivotCurrency, to, at); err == nil {
+				rate = toPivot.cross(fromPivot)
+			}
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrRateNotFound) {
+			return 0, fmt.Errorf("%w from %s to %s on %s", ErrRateNotFound, from, to, at.Format(time.DateOnly))
+		}
+		return 0, err
+	}
+
+	c.cache[pair] = append(c.cache[pair], rate)
+	return rate.Value, nil
+}
+
+// lookup tries the direct rate, then the inverse one
+func (c *Converter) lookup(l *logrus.Entry, from, to string, at time.Time) (*Rate, error) {
+	rate, err := c.provider.Rate(l, from, to, at)
+	if !errors.Is(err, ErrRateNotFound) {
+		return rate, err
+	}
+	inverse, err := c.provider.Rate(l, to, from, at)
+	if err != nil {
+		return nil, err
+	}
+	return inverse.inverse(), nil
+}
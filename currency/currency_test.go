@@ -0,0 +1,151 @@
+package currency
+
+import (
+	"catalog/money"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type testRate struct {
+	base, quote string
+	rate        float64
+	date        time.Time
+}
+
+// staticProvider serves the last rate dated before the requested time,
+// counting the lookups
+type staticProvider struct {
+	rates   []testRate
+	lookups int
+}
+
+func (p *staticProvider) add(base, quote string, rate float64, date time.Time) {
+	p.rates = append(p.rates, testRate{base, quote, rate, date})
+}
+
+func (p *staticProvider) Rate(l *logrus.Entry, base, quote string, at time.Time) (*Rate, error) {
+	p.lookups++
+	var found *Rate
+	for _, r := range p.rates {
+		if r.base != base || r.quote != quote {
+			continue
+		}
+		if !r.date.After(at) && (found == nil || r.date.After(found.From)) {
+			found = &Rate{Value: r.rate, From: r.date}
+		}
+	}
+	if found == nil {
+		return nil, ErrRateNotFound
+	}
+	for _, r := range p.rates {
+		if r.base == base && r.quote == quote && r.date.After(found.From) && (found.Until.IsZero() || r.date.Before(found.Until)) {
+			found.Until = r.date
+		}
+	}
+	return found, nil
+}
+
+func TestConverter(t *testing.T) {
+	l := logrus.WithField("test", "TestConverter")
+	jan := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)
+
+	provider := &staticProvider{}
+	provider.add("EUR", "CHF", 0.95, jan)
+	provider.add("EUR", "CHF", 0.90, feb)
+	provider.add("EUR", "USD", 1.10, jan)
+
+	tests := []struct {
+		name     string
+		from, to string
+		at       time.Time
+		expected float64
+	}{
+		{name: "Same currency", from: "CHF", to: "CHF", at: jan, expected: 10},
+		{name: "Direct rate", from: "EUR", to: "CHF", at: jan.AddDate(0, 0, 15), expected: 9.5},
+		{name: "Rate in effect at the date", from: "EUR", to: "CHF", at: feb.AddDate(0, 0, 1), expected: 9},
+		{name: "Inverse rate", from: "CHF", to: "EUR", at: feb, expected: 10 / 0.9},
+		{name: "Cross rate", from: "CHF", to: "USD", at: jan, expected: 10 / 0.95 * 1.10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewConverter(provider).Convert(l, money.MustParse("10"), tt.from, tt.to, tt.at)
+			if err != nil {
+				t.Fatalf("Failed to convert: %v", err)
+			}
+			if got != money.FromFloat(tt.expected) {
+				t.Fatalf("Expected %v, got %v", money.FromFloat(tt.expected), got)
+			}
+		})
+	}
+
+	if _, err := NewConverter(provider).Convert(l, money.MustParse("10"), "EUR", "CHF", jan.AddDate(-1, 0, 0)); !errors.Is(err, ErrRateNotFound) {
+		t.Fatalf("Expected ErrRateNotFound before the first rate, got %v", err)
+	}
+
+	// The rates are cached for the period they are in effect, which may end
+	// during the day
+	provider.add("EUR", "CHF", 0.80, feb.Add(12*time.Hour))
+	converter := NewConverter(provider)
+	provider.lookups = 0
+	for _, expected := range []struct {
+		at      time.Time
+		rate    float64
+		lookups int
+	}{
+		{feb.Add(time.Hour), 0.90, 1},
+		{feb.Add(2 * time.Hour), 0.90, 1},
+		{feb.Add(13 * time.Hour), 0.80, 2},
+		{feb.AddDate(0, 1, 0), 0.80, 2},
+		{feb.Add(time.Hour), 0.90, 2},
+	} {
+		rate, err := converter.Rate(l, "EUR", "CHF", expected.at)
+		if err != nil || rate != expected.rate {
+			t.Fatalf("Expected %v at %s, got %v, %v", expected.rate, expected.at, rate, err)
+		}
+		if provider.lookups != expected.lookups {
+			t.Fatalf("Expected %d lookups at %s, got %d", expected.lookups, expected.at, provider.lookups)
+		}
+	}
+
+	// A cross rate is in effect while both of its rates are
+	provider.lookups = 0
+	for _, at := range []time.Time{jan, jan.AddDate(0, 0, 10)} {
+		if _, err := converter.Rate(l, "CHF", "USD", at); err != nil {
+			t.Fatalf("Failed to get the cross rate: %v", err)
+		}
+	}
+	if provider.lookups != 5 {
+		t.Fatalf("Expected the cross rate cached, got %d lookups", provider.lookups)
+	}
+	if rate, err := converter.Rate(l, "CHF", "USD", feb); err != nil || rate != 1.10/0.90 {
+		t.Fatalf("Expected the cross rate of February, got %v, %v", rate, err)
+	}
+}
+
+func TestParseECBCSV(t *testing.T) {
+	file := `Date,USD,JPY,CHF,CYP,
+2024-10-15,1.0899,162.82,0.9402,N/A,
+14 October 2024, 1.0911, 163.01, 0.9404, N/A,
+`
+	rates, err := ParseECBCSV(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(rates) != 6 {
+		t.Fatalf("Expected 6 rates, got %d: %v", len(rates), rates)
+	}
+	last := rates[5]
+	if last.Base != "EUR" || last.Quote != "CHF" || last.Rate != 0.9404 || last.Date.Day() != 14 {
+		t.Fatalf("Unexpected rate: %+v", last)
+	}
+
+	if _, err := ParseECBCSV(strings.NewReader("Date,USD\nyesterday,1.2\n")); err == nil {
+		t.Fatal("Expected an error on an invalid date")
+	}
+}
@@ -0,0 +1,81 @@
+package currency
+
+import (
+	"catalog/db"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date layouts used by the ECB daily and historical reference rate files
+var ecbDateLayouts = []string{time.DateOnly, "02 January 2006", "2 January 2006"}
+
+// ParseECBCSV reads an ECB reference rates file, such as eurofxref.csv or
+// eurofxref-hist.csv: a Date column followed by one column per currency,
+// holding the value of one euro. Missing values (N/A) are skipped.
+func ParseECBCSV(r io.Reader) ([]db.ExchangeRate, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("empty file")
+		}
+		return nil, err
+	}
+	if len(header) < 2 || !strings.EqualFold(strings.TrimSpace(header[0]), "date") {
+		return nil, errors.New("the first column must be the Date")
+	}
+
+	rates := make([]db.ExchangeRate, 0)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		date, err := parseECBDate(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		for i := 1; i < len(record) && i < len(header); i++ {
+			quote := strings.TrimSpace(header[i])
+			value := strings.TrimSpace(record[i])
+			if quote == "" || value == "" || value == "N/A" {
+				continue
+			}
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate <= 0 {
+				return nil, fmt.Errorf("line %d: invalid %s rate %q", line, quote, value)
+			}
+			rates = append(rates, db.ExchangeRate{
+				Base:  PivotCurrency,
+				Quote: quote,
+				Rate:  rate,
+				Date:  date,
+			})
+		}
+	}
+
+	return rates, nil
+}
+
+func parseECBDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range ecbDateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
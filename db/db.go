@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -16,42 +17,135 @@ type DbHandler interface {
 	Ping() error
 	NewID() primitive.ObjectID
 	FindByID(l *logrus.Entry, id string) (*Ingredient, error)
-	FindAllIngredients(l *logrus.Entry) (*[]Ingredient, error)
+	FindAllIngredients(l *logrus.Entry, page *Pagination) (*Page[Ingredient], error)
 	FindByName(l *logrus.Entry, name string) (*Ingredient, error)
 	FindByType(l *logrus.Entry, ingredientType string) (*[]Ingredient, error)
+	SearchIngredients(l *logrus.Entry, query string, limit int) (*[]SearchResult, error)
 	InsertOne(l *logrus.Entry, ingredient *Ingredient) error
-	UpsertOne(l *logrus.Entry, ingredient *Ingredient) error
+	UpsertOne(l *logrus.Entry, ingredient *Ingredient, expected int64) error
+	DeleteIngredient(l *logrus.Entry, id primitive.ObjectID, expected int64, check func() error) error
+	RestoreIngredient(l *logrus.Entry, id primitive.ObjectID) (*Ingredient, error)
+	PurgeIngredient(l *logrus.Entry, id primitive.ObjectID, check func() error) error
+	FindIngredientsByNames(l *logrus.Entry, names []string) (*[]Ingredient, error)
+	FindIngredientsByIDs(l *logrus.Entry, ids []string) (*[]Ingredient, error)
+	ImportIngredients(l *logrus.Entry, ingredients []IngredientImport) error
+	ExportIngredients(l *logrus.Entry, fn func(*Ingredient) error) error
+	IngredientLocales(l *logrus.Entry) ([]string, error)
 	CreateShop(l *logrus.Entry, shop *Shop) (*Shop, error)
-	GetShops(l *logrus.Entry) (*[]Shop, error)
+	GetShops(l *logrus.Entry, page *Pagination) (*Page[Shop], error)
 	GetShop(l *logrus.Entry, id primitive.ObjectID) (*Shop, error)
-	UpdateShop(l *logrus.Entry, shop *Shop) (*Shop, error)
-	DeleteShop(l *logrus.Entry, id primitive.ObjectID) error
+	GetShopsNear(l *logrus.Entry, point *GeoPoint, radius float64, limit int) (*[]ShopDistance, error)
+	UpdateShop(l *logrus.Entry, shop *Shop, expected int64) (*Shop, error)
+	DeleteShop(l *logrus.Entry, id primitive.ObjectID, expected int64) error
 	CreatePrice(l *logrus.Entry, price *Price) (*Price, error)
-	UpdatePrice(l *logrus.Entry, price *Price) (*Price, error)
-	GetPrices(l *logrus.Entry) (*[]Price, error)
+	UpdatePrice(l *logrus.Entry, price *Price, expected int64) (*Price, error)
+	WritePrices(l *logrus.Entry, writes []*PriceWrite) error
+	GetPrices(l *logrus.Entry, query *PriceQuery, page *Pagination) (*Page[Price], error)
 	GetLastUpdatedPrice(l *logrus.Entry, shopID, productID string) (*Price, error)
+	GetLatestPrices(l *logrus.Entry, productIDs []string) (*[]Price, error)
+	GetPriceHistory(l *logrus.Entry, shopID, productID string, from, to *time.Time) (*[]Price, error)
+	GetPriceAt(l *logrus.Entry, shopID, productID string, at time.Time) (*Price, error)
+	GetPricesAt(l *logrus.Entry, shopID, productID string, at time.Time) (*[]Price, error)
+	RebuildPriceProjection(l *logrus.Entry, opts *RebuildOptions, progress func(RebuildProgress)) (*RebuildProgress, error)
+	CreateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error)
+	GetExchangeRates(l *logrus.Entry, base, quote string, page *Pagination) (*Page[ExchangeRate], error)
+	GetExchangeRate(l *logrus.Entry, id primitive.ObjectID) (*ExchangeRate, error)
+	UpdateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error)
+	DeleteExchangeRate(l *logrus.Entry, id primitive.ObjectID) error
+	ImportExchangeRates(l *logrus.Entry, rates []ExchangeRate) (int64, error)
+	FindExchangeRate(l *logrus.Entry, base, quote string, at time.Time) (*ExchangeRate, error)
+	FindNextExchangeRate(l *logrus.Entry, base, quote string, after time.Time) (*ExchangeRate, error)
+	CreateAPIKey(l *logrus.Entry, key *APIKey) (*APIKey, error)
+	GetAPIKeys(l *logrus.Entry, page *Pagination) (*Page[APIKey], error)
+	RevokeAPIKey(l *logrus.Entry, id primitive.ObjectID) error
+	FindAPIKeyByHash(l *logrus.Entry, hash string) (*APIKey, error)
+	RecordAPIKeyUsage(l *logrus.Entry, id primitive.ObjectID, at time.Time) error
 }
 
 type MongoHandler struct {
-	client                    *mongo.Client
-	dbName                    string
-	ingredientsCollectionName string
-	shopsCollectionName       string
-	pricesCollectionName      string
+	client                     *mongo.Client
+	dbName                     string
+	ingredientsCollectionName  string
+	shopsCollectionName        string
+	pricesCollectionName       string
+	ratesCollectionName        string
+	apiKeysCollectionName      string
+	latestPricesCollectionName string
+	checkpointsCollectionName  string
 }
 
-func newMongoHandler(client *mongo.Client, dbName, ingredientsCollectionName, shopsCollectionName, pricesCollectionName string) *MongoHandler {
+func newMongoHandler(client *mongo.Client, dbName, ingredientsCollectionName, shopsCollectionName, pricesCollectionName, ratesCollectionName, apiKeysCollectionName, latestPricesCollectionName, checkpointsCollectionName string) *MongoHandler {
 
 	handler := MongoHandler{
-		client:                    client,
-		dbName:                    dbName,
-		ingredientsCollectionName: ingredientsCollectionName,
-		shopsCollectionName:       shopsCollectionName,
-		pricesCollectionName:      pricesCollectionName,
+		client:                     client,
+		dbName:                     dbName,
+		ingredientsCollectionName:  ingredientsCollectionName,
+		shopsCollectionName:        shopsCollectionName,
+		pricesCollectionName:       pricesCollectionName,
+		ratesCollectionName:        ratesCollectionName,
+		apiKeysCollectionName:      apiKeysCollectionName,
+		latestPricesCollectionName: latestPricesCollectionName,
+		checkpointsCollectionName:  checkpointsCollectionName,
 	}
 	return &handler
 }
 
+// createIndexes creates the indexes required by the queries, if missing
+func (dbh *MongoHandler) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := dbh.GetShopsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "coordinates", Value: "2dsphere"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = dbh.GetRatesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "base", Value: 1}, {Key: "quote", Value: 1}, {Key: "date", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = dbh.GetAPIKeysCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = dbh.GetIngredientsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "allNames", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	// Index the names of the ingredients stored before the index
+	_, err = dbh.GetIngredientsCollection().UpdateMany(ctx, bson.M{"allNames": bson.M{"$exists": false}}, updateAllNames)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbh.GetIngredientsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "searchGrams", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	// Index the trigrams of the ingredients stored before the searches used them
+	err = indexSearchGrams(ctx, dbh.GetIngredientsCollection(), bson.M{"searchGrams": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+
+	_, err = dbh.GetLatestPricesCollection().Indexes().CreateOne(ctx, latestPriceIndex)
+	return err
+}
+
 func NewMongoHandler(conf *configuration.Configuration) (*MongoHandler, error) {
 
 	// Database connexion
@@ -69,6 +163,10 @@ func NewMongoHandler(conf *configuration.Configuration) (*MongoHandler, error) {
 		panic(err)
 	}
 	loger.Info("Connected to MongoDB!")
-	dbHandler := newMongoHandler(client, conf.DBName, conf.IngredientsCollectionName, conf.ShopsCollectionName, conf.PricesColletionName)
+	dbHandler := newMongoHandler(client, conf.DBName, conf.IngredientsCollectionName, conf.ShopsCollectionName, conf.PricesColletionName, conf.RatesCollectionName, conf.APIKeysCollectionName, conf.LatestPricesCollectionName, conf.CheckpointsCollectionName)
+	if err := dbHandler.createIndexes(); err != nil {
+		loger.WithError(err).Error("Failed to create the indexes")
+		return nil, err
+	}
 	return dbHandler, nil
 }
@@ -3,16 +3,17 @@ package db
 import (
 	"catalog/configuration"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strings"
 	"time"
 
 	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type EventHandler struct {
@@ -52,7 +53,7 @@ func (e *EventHandler) FindByID(l *logrus.Entry, id string) (*Ingredient, error)
 	panic("not implemented")
 }
 
-func (e *EventHandler) FindAllIngredients(l *logrus.Entry) (*[]Ingredient, error) {
+func (e *EventHandler) FindAllIngredients(l *logrus.Entry, page *Pagination) (*Page[Ingredient], error) {
 	panic("not implemented")
 }
 
@@ -64,11 +65,47 @@ func (e *EventHandler) FindByType(l *logrus.Entry, ingredientType string) (*[]In
 	panic("not implemented")
 }
 
+func (e *EventHandler) SearchIngredients(l *logrus.Entry, query string, limit int) (*[]SearchResult, error) {
+	panic("not implemented")
+}
+
 func (e *EventHandler) InsertOne(l *logrus.Entry, ingredient *Ingredient) error {
 	panic("not implemented")
 }
 
-func (e *EventHandler) UpsertOne(l *logrus.Entry, ingredient *Ingredient) error {
+func (e *EventHandler) UpsertOne(l *logrus.Entry, ingredient *Ingredient, expected int64) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) DeleteIngredient(l *logrus.Entry, id primitive.ObjectID, expected int64, check func() error) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) RestoreIngredient(l *logrus.Entry, id primitive.ObjectID) (*Ingredient, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) PurgeIngredient(l *logrus.Entry, id primitive.ObjectID, check func() error) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) FindIngredientsByNames(l *logrus.Entry, names []string) (*[]Ingredient, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) FindIngredientsByIDs(l *logrus.Entry, ids []string) (*[]Ingredient, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) ImportIngredients(l *logrus.Entry, ingredients []IngredientImport) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) ExportIngredients(l *logrus.Entry, fn func(*Ingredient) error) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) IngredientLocales(l *logrus.Entry) ([]string, error) {
 	panic("not implemented")
 }
 
@@ -76,7 +113,7 @@ func (e *EventHandler) CreateShop(l *logrus.Entry, shop *Shop) (*Shop, error) {
 	panic("not implemented")
 }
 
-func (e *EventHandler) GetShops(l *logrus.Entry) (*[]Shop, error) {
+func (e *EventHandler) GetShops(l *logrus.Entry, page *Pagination) (*Page[Shop], error) {
 	panic("not implemented")
 }
 
@@ -84,11 +121,71 @@ func (e *EventHandler) GetShop(l *logrus.Entry, id primitive.ObjectID) (*Shop, e
 	panic("not implemented")
 }
 
-func (e *EventHandler) UpdateShop(l *logrus.Entry, shop *Shop) (*Shop, error) {
+func (e *EventHandler) GetShopsNear(l *logrus.Entry, point *GeoPoint, radius float64, limit int) (*[]ShopDistance, error) {
 	panic("not implemented")
 }
 
-func (e *EventHandler) DeleteShop(l *logrus.Entry, id primitive.ObjectID) error {
+func (e *EventHandler) UpdateShop(l *logrus.Entry, shop *Shop, expected int64) (*Shop, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) DeleteShop(l *logrus.Entry, id primitive.ObjectID, expected int64) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) CreateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) GetExchangeRates(l *logrus.Entry, base, quote string, page *Pagination) (*Page[ExchangeRate], error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) GetExchangeRate(l *logrus.Entry, id primitive.ObjectID) (*ExchangeRate, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) UpdateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) DeleteExchangeRate(l *logrus.Entry, id primitive.ObjectID) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) ImportExchangeRates(l *logrus.Entry, rates []ExchangeRate) (int64, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) FindExchangeRate(l *logrus.Entry, base, quote string, at time.Time) (*ExchangeRate, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) FindNextExchangeRate(l *logrus.Entry, base, quote string, after time.Time) (*ExchangeRate, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) CreateAPIKey(l *logrus.Entry, key *APIKey) (*APIKey, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) GetAPIKeys(l *logrus.Entry, page *Pagination) (*Page[APIKey], error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) RevokeAPIKey(l *logrus.Entry, id primitive.ObjectID) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) FindAPIKeyByHash(l *logrus.Entry, hash string) (*APIKey, error) {
+	panic("not implemented")
+}
+
+func (e *EventHandler) RecordAPIKeyUsage(l *logrus.Entry, id primitive.ObjectID, at time.Time) error {
+	panic("not implemented")
+}
+
+func (e *EventHandler) RebuildPriceProjection(l *logrus.Entry, opts *RebuildOptions, progress func(RebuildProgress)) (*RebuildProgress, error) {
 	panic("not implemented")
 }
 
@@ -97,113 +194,208 @@ const (
 	PriceUpdatedEventType = "PriceUpdated"
 )
 
+// The prefix of the price streams, one per shop and product
+const priceStreamPrefix = "price-"
+
+func priceStreamName(shopID, productID string) string {
+	return fmt.Sprintf("%s%s-%s", priceStreamPrefix, shopID, productID)
+}
+
+func isStreamNotFound(err error) bool {
+	esdbErr, ok := esdb.FromError(err)
+	return !ok && esdbErr.Code() == esdb.ErrorCodeResourceNotFound
+}
+
+func isWrongExpectedVersion(err error) bool {
+	esdbErr, ok := esdb.FromError(err)
+	return !ok && esdbErr.Code() == esdb.ErrorCodeWrongExpectedVersion
+}
+
+// expectedRevision maps the expected version of a price, the number of events
+// of its stream, to the expected revision of the stream
+func expectedRevision(expected int64) esdb.ExpectedRevision {
+	switch {
+	case expected == AnyVersion:
+		return esdb.Any{}
+	case expected == 0:
+		return esdb.NoStream{}
+	}
+	return esdb.Revision(uint64(expected - 1))
+}
+
+// eventVersion returns the version of the price stream after the event
+func eventVersion(event *esdb.RecordedEvent) int64 {
+	return int64(event.EventNumber) + 1
+}
+
 func (e *EventHandler) CreatePrice(l *logrus.Entry, price *Price) (*Price, error) {
 	// Set current timestamp
 	price.CreatedAt = time.Now()
 	price.UpdatedAt = time.Now()
 
 	// Construct stream name using shopId and productId
-	streamName := fmt.Sprintf("price-%s-%s", price.ShopID, price.ProductID)
+	streamName := priceStreamName(price.ShopID, price.ProductID)
 
-	// Serialize price to JSON
-	priceJSON, err := json.Marshal(price)
+	// Prepare event data
+	eventData, err := newPriceEventData(l.Context, PriceCreatedEventType, price, 0)
 	if err != nil {
 		l.Errorf("Failed to marshal price: %v", err)
 		return nil, err
 	}
 
-	// Prepare event data
-	eventData := esdb.EventData{
-		ContentType: esdb.ContentTypeJson,
-		EventType:   PriceCreatedEventType,
-		Data:        priceJSON,
-	}
-
 	// Write event to EventStore
-	_, err = e.db.AppendToStream(context.Background(), streamName, esdb.AppendToStreamOptions{}, eventData)
+	result, err := e.db.AppendToStream(context.Background(), streamName, esdb.AppendToStreamOptions{}, eventData)
 	if err != nil {
 		l.Errorf("Failed to append price creation event: %v", err)
 		return nil, err
 	}
 
+	price.Version = int64(result.NextExpectedVersion) + 1
 	return price, nil
 }
 
-func (e *EventHandler) UpdatePrice(l *logrus.Entry, price *Price) (*Price, error) {
+// UpdatePrice appends the update to the price stream, if the stream still has
+// the expected version
+func (e *EventHandler) UpdatePrice(l *logrus.Entry, price *Price, expected int64) (*Price, error) {
 	// Set current timestamp for update
 	price.CreatedAt = time.Now()
 	price.UpdatedAt = time.Now()
 
 	// Construct stream name using shopId and productId
-	streamName := fmt.Sprintf("price-%s-%s", price.ShopID, price.ProductID)
+	streamName := priceStreamName(price.ShopID, price.ProductID)
 
-	// Serialize price to JSON
-	priceJSON, err := json.Marshal(price)
+	// Prepare event data
+	eventData, err := newPriceEventData(l.Context, PriceUpdatedEventType, price, 0)
 	if err != nil {
 		l.Errorf("Failed to marshal price: %v", err)
 		return nil, err
 	}
 
-	// Prepare event data
-	eventData := esdb.EventData{
-		ContentType: esdb.ContentTypeJson,
-		EventType:   PriceUpdatedEventType,
-		Data:        priceJSON,
-	}
-
 	// Write event to EventStore
-	_, err = e.db.AppendToStream(context.Background(), streamName, esdb.AppendToStreamOptions{}, eventData)
+	opts := esdb.AppendToStreamOptions{ExpectedRevision: expectedRevision(expected)}
+	result, err := e.db.AppendToStream(context.Background(), streamName, opts, eventData)
+	if isWrongExpectedVersion(err) {
+		return nil, ErrVersionMismatch
+	}
 	if err != nil {
 		l.Errorf("Failed to append price update event: %v", err)
 		return nil, err
 	}
 
+	price.Version = int64(result.NextExpectedVersion) + 1
 	return price, nil
 }
 
+// WritePrices appends the prices of a batch with one append per price stream,
+// each checking the version of its stream. The streams are not written
+// atomically: on a failure, the streams appended before stay written.
+func (e *EventHandler) WritePrices(l *logrus.Entry, writes []*PriceWrite) error {
+	streams := make([]string, 0)
+	byStream := make(map[string][]*PriceWrite)
+	for _, write := range writes {
+		streamName := priceStreamName(write.Price.ShopID, write.Price.ProductID)
+		if _, ok := byStream[streamName]; !ok {
+			streams = append(streams, streamName)
+		}
+		byStream[streamName] = append(byStream[streamName], write)
+	}
+
+	now := time.Now()
+	for _, streamName := range streams {
+		streamWrites := byStream[streamName]
+		events := make([]esdb.EventData, 0, len(streamWrites))
+		for i, write := range streamWrites {
+			eventType := PriceCreatedEventType
+			if write.Refresh {
+				eventType = PriceUpdatedEventType
+			}
+			if write.Price.CreatedAt.IsZero() {
+				write.Price.CreatedAt = now
+			}
+			if write.Price.UpdatedAt.IsZero() {
+				write.Price.UpdatedAt = now
+			}
+			eventData, err := newPriceEventData(l.Context, eventType, write.Price, i)
+			if err != nil {
+				l.Errorf("Failed to marshal price: %v", err)
+				return err
+			}
+			events = append(events, eventData)
+		}
+
+		// Only the stored price, refreshed first, was read: the new prices
+		// append to whatever the stream holds
+		opts := esdb.AppendToStreamOptions{}
+		if first := streamWrites[0]; first.Refresh {
+			opts.ExpectedRevision = expectedRevision(first.Expected)
+		}
+		result, err := e.db.AppendToStream(context.Background(), streamName, opts, events...)
+		if isWrongExpectedVersion(err) {
+			return ErrVersionMismatch
+		}
+		if err != nil {
+			l.Errorf("Failed to append price events: %v", err)
+			return err
+		}
+
+		next := int64(result.NextExpectedVersion) + 1
+		for i, write := range streamWrites {
+			write.Price.Version = next - int64(len(streamWrites)-1-i)
+		}
+	}
+	return nil
+}
+
 func (e *EventHandler) GetLastUpdatedPrice(l *logrus.Entry, shopID, productID string) (*Price, error) {
-	// Construct stream name
-	streamName := fmt.Sprintf("price-%s-%s", shopID, productID)
+	return e.lastPrice(l, priceStreamName(shopID, productID))
+}
 
-	// Read stream from end, limit to 1 event
+// lastPrice reads the price stream backwards, until its first price event. It
+// returns mongo.ErrNoDocuments when the stream has no price.
+func (e *EventHandler) lastPrice(l *logrus.Entry, streamName string) (*Price, error) {
 	stream, err := e.db.ReadStream(context.Background(), streamName, esdb.ReadStreamOptions{
 		From:      esdb.End{},
 		Direction: esdb.Backwards,
-	}, 1)
+	}, math.MaxUint64)
 
+	if isStreamNotFound(err) {
+		return nil, mongo.ErrNoDocuments
+	}
 	if err != nil {
 		l.Errorf("Failed to read price stream: %v", err)
 		return nil, err
 	}
 	defer stream.Close()
 
-	// Deserialize the latest event
-	var latestPrice Price
-
 	for {
 		event, err := stream.Recv()
 
 		if errors.Is(err, io.EOF) {
-			break
+			return nil, mongo.ErrNoDocuments
 		}
 
+		if isStreamNotFound(err) {
+			return nil, mongo.ErrNoDocuments
+		}
 		if err != nil {
 			l.Errorf("Failed to read price event: %v", err)
 			return nil, err
 		}
 
 		// Deserialize event data
-		err = json.Unmarshal(event.Event.Data, &latestPrice)
+		price, err := decodePriceEvent(event.Event)
+		if errors.Is(err, ErrUnknownEventType) {
+			warnSkippedEvent(l, event.Event, err)
+			continue
+		}
 		if err != nil {
-			l.Errorf("Failed to unmarshal price event data: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("failed to read event %d of %s: %w", event.Event.EventNumber, event.Event.StreamID, err)
 		}
+		return price, nil
 	}
-
-	return &latestPrice, nil
 }
 
-func (e *EventHandler) GetPrices(l *logrus.Entry) (*[]Price, error) {
+func (e *EventHandler) GetPrices(l *logrus.Entry, query *PriceQuery, page *Pagination) (*Page[Price], error) {
 
 	// Use a map to track the latest price for each unique stream
 	latestPrices := make(map[string]Price)
@@ -228,29 +420,28 @@ func (e *EventHandler) GetPrices(l *logrus.Entry) (*[]Price, error) {
 		}
 
 		if err != nil {
-			panic(err)
+			l.Errorf("Failed to read event: %v", err)
+			return nil, err
 		}
 
-		if strings.HasPrefix(event.OriginalEvent().EventType, "$") {
+		// Only process the events of the price streams
+		if !strings.HasPrefix(event.OriginalEvent().StreamID, priceStreamPrefix) {
 			continue
 		}
 
-		// Only process price-related events
-		if event.OriginalEvent().EventType != PriceCreatedEventType &&
-			event.OriginalEvent().EventType != PriceUpdatedEventType {
+		// Deserialize event data
+		decoded, err := decodePriceEvent(event.OriginalEvent())
+		if errors.Is(err, ErrUnknownEventType) {
+			warnSkippedEvent(l, event.OriginalEvent(), err)
 			continue
 		}
-
-		// Deserialize event data
-		var price Price
-		err = json.Unmarshal(event.Event.Data, &price)
 		if err != nil {
-			l.Errorf("Failed to unmarshal price event data: %v", err)
-			continue
+			return nil, fmt.Errorf("failed to read event %d of %s: %w", event.OriginalEvent().EventNumber, event.OriginalEvent().StreamID, err)
 		}
+		price := *decoded
 
 		// Create a unique key for the stream
-		streamKey := fmt.Sprintf("price-%s-%s", price.ShopID, price.ProductID)
+		streamKey := priceStreamName(price.ShopID, price.ProductID)
 
 		// Store only the first (latest) event for each unique stream
 		if _, exists := latestPrices[streamKey]; !exists {
@@ -258,12 +449,143 @@ func (e *EventHandler) GetPrices(l *logrus.Entry) (*[]Price, error) {
 		}
 	}
 
-	// Convert map to slice
+	// Convert map to slice, keeping only the prices matching the query
 	prices := make([]Price, 0, len(latestPrices))
 	for _, price := range latestPrices {
-		prices = append(prices, price)
+		if query.Match(&price) {
+			prices = append(prices, price)
+		}
+	}
+
+	return paginate(prices, page, PriceSortFields)
+}
+
+// GetLatestPrices is served by the projection of the MixedHandler
+func (e *EventHandler) GetLatestPrices(l *logrus.Entry, productIDs []string) (*[]Price, error) {
+	panic("not implemented")
+}
+
+// GetPriceAt folds the price stream of the product in the shop up to the
+// instant, or returns mongo.ErrNoDocuments if it had no price yet
+func (e *EventHandler) GetPriceAt(l *logrus.Entry, shopID, productID string, at time.Time) (*Price, error) {
+	streamName := priceStreamName(shopID, productID)
+	fold := newPriceFold(at)
+
+	stream, err := e.db.ReadStream(context.Background(), streamName, esdb.ReadStreamOptions{
+		From:      esdb.Start{},
+		Direction: esdb.Forwards,
+	}, math.MaxUint64)
+	if err != nil {
+		l.Errorf("Failed to read price stream: %v", err)
+		return nil, err
+	}
+	defer stream.Close()
+
+	for {
+		event, err := stream.Recv()
+
+		if errors.Is(err, io.EOF) || isStreamNotFound(err) {
+			break
+		}
+
+		if err != nil {
+			l.Errorf("Failed to read price event: %v", err)
+			return nil, err
+		}
+
+		price, err := decodePriceEvent(event.Event)
+		if errors.Is(err, ErrUnknownEventType) {
+			warnSkippedEvent(l, event.Event, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event %d of %s: %w", event.Event.EventNumber, event.Event.StreamID, err)
+		}
+		fold.add(streamName, price)
 	}
 
+	prices := fold.result()
+	if len(prices) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &prices[0], nil
+}
+
+// GetPricesAt folds every price stream up to the instant. The shop and
+// product filters are optional.
+func (e *EventHandler) GetPricesAt(l *logrus.Entry, shopID, productID string, at time.Time) (*[]Price, error) {
+	if shopID != "" && productID != "" {
+		prices := make([]Price, 0, 1)
+		price, err := e.GetPriceAt(l, shopID, productID, at)
+		if err == nil {
+			prices = append(prices, *price)
+		} else if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		return &prices, nil
+	}
+
+	fold := newPriceFold(at)
+	err := replayPrices(context.Background(), l, e, nil, func(stream string, price *Price, _ Position) error {
+		if (shopID == "" || price.ShopID == shopID) && (productID == "" || price.ProductID == productID) {
+			fold.add(stream, price)
+		}
+		return nil
+	})
+	if err != nil {
+		l.Errorf("Failed to fold the price streams: %v", err)
+		return nil, err
+	}
+	prices := fold.result()
 	return &prices, nil
+}
+
+// GetPriceHistory folds the whole price stream of the product in the shop,
+// keeping the events updated between from and to.
+func (e *EventHandler) GetPriceHistory(l *logrus.Entry, shopID, productID string, from, to *time.Time) (*[]Price, error) {
+	streamName := priceStreamName(shopID, productID)
+
+	stream, err := e.db.ReadStream(context.Background(), streamName, esdb.ReadStreamOptions{
+		From:      esdb.Start{},
+		Direction: esdb.Forwards,
+	}, math.MaxUint64)
+	if err != nil {
+		l.Errorf("Failed to read price stream: %v", err)
+		return nil, err
+	}
+	defer stream.Close()
 
+	prices := make([]Price, 0)
+	for {
+		event, err := stream.Recv()
+
+		if errors.Is(err, io.EOF) || isStreamNotFound(err) {
+			break
+		}
+
+		if err != nil {
+			l.Errorf("Failed to read price event: %v", err)
+			return nil, err
+		}
+
+		decoded, err := decodePriceEvent(event.Event)
+		if errors.Is(err, ErrUnknownEventType) {
+			warnSkippedEvent(l, event.Event, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event %d of %s: %w", event.Event.EventNumber, event.Event.StreamID, err)
+		}
+		price := *decoded
+
+		if from != nil && price.UpdatedAt.Before(*from) {
+			continue
+		}
+		if to != nil && price.UpdatedAt.After(*to) {
+			continue
+		}
+		prices = append(prices, price)
+	}
+
+	return &prices, nil
 }
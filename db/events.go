@@ -0,0 +1,322 @@
+package db
+
+import (
+	"catalog/money"
+	"catalog/units"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The schema version of the price events written. The events written before
+// the schema versions, the raw JSON of a Price, are version 1.
+const PriceEventSchemaVersion = 2
+
+var (
+	ErrUnknownEventType  = errors.New("unknown event type")
+	ErrUnsupportedSchema = errors.New("unsupported schema version")
+)
+
+// PriceEvent is the payload of the PriceCreated and PriceUpdated events, in
+// the current schema version
+type PriceEvent struct {
+	ProductID string       `json:"productId"`
+	ShopID    string       `json:"shopId"`
+	Price     money.Amount `json:"price"`
+	Devise    string       `json:"devise"`
+	Quantity  float64      `json:"quantity,omitempty"`
+	Unit      units.Unit   `json:"unit,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+// The namespace of the event IDs, derived from the causation and the content
+// of the events
+var eventNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("catalog/events"))
+
+// EventSource is where the change recorded by an event was entered
+type EventSource string
+
+const (
+	SourceAPI    EventSource = "api"
+	SourceAMQP   EventSource = "amqp"
+	SourceImport EventSource = "import"
+)
+
+// EventContext tells what caused the events appended while handling a request
+// or a message. It is carried by the context of the logger entry given to the
+// handler.
+type EventContext struct {
+	// Shared by every request and message of the same operation
+	CorrelationID string
+	// The request or message appending the events. Its events keep the same
+	// IDs when it is retried, so the event store appends them once.
+	CausationID string
+	// The subject of the authenticated client
+	Actor  string
+	Source EventSource
+}
+
+type eventContextKey struct{}
+
+func WithEventContext(ctx context.Context, ec EventContext) context.Context {
+	return context.WithValue(ctx, eventContextKey{}, ec)
+}
+
+// EventContextFrom returns the event context of the context, empty if none
+func EventContextFrom(ctx context.Context) EventContext {
+	if ctx == nil {
+		return EventContext{}
+	}
+	ec, _ := ctx.Value(eventContextKey{}).(EventContext)
+	return ec
+}
+
+// EventMetadata is the user metadata of the events. The correlation and
+// causation IDs use the keys of the event store system projections.
+type EventMetadata struct {
+	SchemaVersion int         `json:"schemaVersion"`
+	CorrelationID string      `json:"$correlationId,omitempty"`
+	CausationID   string      `json:"$causationId,omitempty"`
+	TraceID       string      `json:"traceId,omitempty"`
+	SpanID        string      `json:"spanId,omitempty"`
+	Actor         string      `json:"actor,omitempty"`
+	Source        EventSource `json:"source,omitempty"`
+}
+
+// newEventMetadata returns the metadata of the events appended with the
+// context, from its event context and its span
+func newEventMetadata(ctx context.Context, schemaVersion int) *EventMetadata {
+	ec := EventContextFrom(ctx)
+	metadata := &EventMetadata{
+		SchemaVersion: schemaVersion,
+		CorrelationID: ec.CorrelationID,
+		CausationID:   ec.CausationID,
+		Actor:         ec.Actor,
+		Source:        ec.Source,
+	}
+	if ctx != nil {
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			metadata.TraceID = span.TraceID().String()
+			metadata.SpanID = span.SpanID().String()
+		}
+	}
+	return metadata
+}
+
+// eventID returns the ID of the index-th event of an append to the stream.
+// The same events, without their timestamps, caused by the same request or
+// message get the same IDs: the event store ignores them when appended again.
+// A request ID reused for another content gets other IDs. Without causation,
+// the ID is derived from the whole payload.
+func eventID(metadata *EventMetadata, stream, eventType string, index int, content, data []byte) uuid.UUID {
+	cause := metadata.CausationID
+	if len(cause) < 1 {
+		cause = string(data)
+	}
+	sum := sha256.Sum256(content)
+	name := fmt.Sprintf("%s/%d/%s/%s/%s", stream, index, eventType, hex.EncodeToString(sum[:]), cause)
+	return uuid.NewSHA1(eventNamespace, []byte(name))
+}
+
+// Upcaster migrates the payload of an event from a schema version to the next
+type Upcaster func(data []byte) ([]byte, error)
+
+// UpcasterRegistry migrates the payloads of old events to the current schema
+// version of their type, one version at a time
+type UpcasterRegistry struct {
+	current   map[string]int
+	upcasters map[string]map[int]Upcaster
+}
+
+func NewUpcasterRegistry() *UpcasterRegistry {
+	return &UpcasterRegistry{
+		current:   make(map[string]int),
+		upcasters: make(map[string]map[int]Upcaster),
+	}
+}
+
+// Register adds the upcaster from a version of the event type to the next one
+func (r *UpcasterRegistry) Register(eventType string, from int, upcaster Upcaster) {
+	if r.upcasters[eventType] == nil {
+		r.upcasters[eventType] = make(map[int]Upcaster)
+	}
+	r.upcasters[eventType][from] = upcaster
+	if r.current[eventType] < from+1 {
+		r.current[eventType] = from + 1
+	}
+}
+
+// Upcast migrates the payload to the current version of the event type. The
+// types without upcaster are at version 1.
+func (r *UpcasterRegistry) Upcast(eventType string, version int, data []byte) ([]byte, error) {
+	current, ok := r.current[eventType]
+	if !ok {
+		current = 1
+	}
+	if version < 1 || version > current {
+		return nil, fmt.Errorf("%w: %s version %d", ErrUnsupportedSchema, eventType, version)
+	}
+	for ; version < current; version++ {
+		upcaster, ok := r.upcasters[eventType][version]
+		if !ok {
+			return nil, fmt.Errorf("%w: no upcaster of %s from version %d", ErrUnsupportedSchema, eventType, version)
+		}
+		var err error
+		if data, err = upcaster(data); err != nil {
+			return nil, fmt.Errorf("failed to upcast %s from version %d: %w", eventType, version, err)
+		}
+	}
+	return data, nil
+}
+
+// The upcasters of the price events
+var priceUpcasters = NewUpcasterRegistry()
+
+func init() {
+	for _, eventType := range []string{PriceCreatedEventType, PriceUpdatedEventType} {
+		priceUpcasters.Register(eventType, 1, upcastRawPrice)
+	}
+}
+
+// rawPriceEvent is the JSON of a Price, whose price was a float64 before
+// the money type
+type rawPriceEvent struct {
+	PriceEvent
+	Price json.Number `json:"price"`
+}
+
+// upcastRawPrice keeps the fields of the PriceEvent from the JSON of a Price,
+// which also held its ID, its version and its unit price. The float prices
+// are rounded to the precision of the money type.
+func upcastRawPrice(data []byte) ([]byte, error) {
+	var event rawPriceEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	if event.Price != "" {
+		price, err := money.Parse(event.Price.String())
+		if err != nil {
+			f, ferr := event.Price.Float64()
+			if ferr != nil {
+				return nil, err
+			}
+			price = money.FromFloat(f)
+		}
+		event.PriceEvent.Price = price
+	}
+	return json.Marshal(&event.PriceEvent)
+}
+
+func newPriceEvent(price *Price) *PriceEvent {
+	return &PriceEvent{
+		ProductID: price.ProductID,
+		ShopID:    price.ShopID,
+		Price:     price.Price,
+		Devise:    price.Devise,
+		Quantity:  price.Quantity,
+		Unit:      price.Unit,
+		CreatedAt: price.CreatedAt,
+		UpdatedAt: price.UpdatedAt,
+	}
+}
+
+func (e *PriceEvent) toPrice() *Price {
+	return &Price{
+		ProductID: e.ProductID,
+		ShopID:    e.ShopID,
+		Price:     e.Price,
+		Devise:    e.Devise,
+		Quantity:  e.Quantity,
+		Unit:      e.Unit,
+		CreatedAt: e.CreatedAt,
+		UpdatedAt: e.UpdatedAt,
+	}
+}
+
+// newPriceEventData returns the index-th event of an append to the price
+// stream, in the current schema, with the metadata of the context
+func newPriceEventData(ctx context.Context, eventType string, price *Price, index int) (esdb.EventData, error) {
+	event := newPriceEvent(price)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return esdb.EventData{}, err
+	}
+	event.CreatedAt, event.UpdatedAt = time.Time{}, time.Time{}
+	content, err := json.Marshal(event)
+	if err != nil {
+		return esdb.EventData{}, err
+	}
+	metadata := newEventMetadata(ctx, PriceEventSchemaVersion)
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return esdb.EventData{}, err
+	}
+	stream := priceStreamName(price.ShopID, price.ProductID)
+	return esdb.EventData{
+		EventID:     eventID(metadata, stream, eventType, index, content, data),
+		ContentType: esdb.ContentTypeJson,
+		EventType:   eventType,
+		Data:        data,
+		Metadata:    metadataJSON,
+	}, nil
+}
+
+// eventMetadata reads the metadata of the event. The events without schema
+// version are version 1.
+func eventMetadata(event *esdb.RecordedEvent) (*EventMetadata, error) {
+	metadata := &EventMetadata{}
+	if len(event.UserMetadata) > 0 {
+		if err := json.Unmarshal(event.UserMetadata, metadata); err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+	if metadata.SchemaVersion == 0 {
+		metadata.SchemaVersion = 1
+	}
+	return metadata, nil
+}
+
+// decodePriceEvent returns the price of a price event, with its version,
+// upcasting the old payloads. The events of another type return
+// ErrUnknownEventType, to be skipped by the readers.
+func decodePriceEvent(event *esdb.RecordedEvent) (*Price, error) {
+	if event.EventType != PriceCreatedEventType && event.EventType != PriceUpdatedEventType {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEventType, event.EventType)
+	}
+	metadata, err := eventMetadata(event)
+	if err != nil {
+		return nil, err
+	}
+	data, err := priceUpcasters.Upcast(event.EventType, metadata.SchemaVersion, event.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload PriceEvent
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	price := payload.toPrice()
+	price.Version = eventVersion(event)
+	price.CausationID = metadata.CausationID
+	return price, nil
+}
+
+// warnSkippedEvent logs an event of an unknown type skipped by a reader
+func warnSkippedEvent(l *logrus.Entry, event *esdb.RecordedEvent, err error) {
+	l.WithError(err).WithFields(logrus.Fields{
+		"stream":      event.StreamID,
+		"eventNumber": event.EventNumber,
+		"eventType":   event.EventType,
+	}).Warn("Skipping price event")
+}
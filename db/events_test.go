@@ -0,0 +1,270 @@
+package db
+
+import (
+	"catalog/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestDecodePriceEvent(t *testing.T) {
+	event := &esdb.RecordedEvent{
+		EventType:   PriceUpdatedEventType,
+		StreamID:    priceStreamName("s1", "p1"),
+		EventNumber: 2,
+		Data:        []byte(`{"shopId":"s1","productId":"p1","price":"2.50","devise":"EUR"}`),
+	}
+	price, err := decodePriceEvent(event)
+	if err != nil {
+		t.Fatalf("Failed to decode price event: %v", err)
+	}
+	if price.ShopID != "s1" || price.Price != money.MustParse("2.5") || price.Version != 3 {
+		t.Fatalf("Unexpected price %+v", price)
+	}
+
+	event.EventType = "ShopCreated"
+	if _, err := decodePriceEvent(event); !errors.Is(err, ErrUnknownEventType) {
+		t.Fatalf("Expected an unknown event type, got %v", err)
+	}
+
+	event.EventType = PriceCreatedEventType
+	event.Data = []byte(`{"price":`)
+	if _, err := decodePriceEvent(event); err == nil {
+		t.Fatal("Expected an invalid event to fail")
+	}
+}
+
+func TestDecodeRawPriceEvent(t *testing.T) {
+	// Written before the schema versions, with the ID, the version and the
+	// unit price of the Price
+	event := &esdb.RecordedEvent{
+		EventType:   PriceCreatedEventType,
+		EventNumber: 0,
+		Data: []byte(`{"id":"000000000000000000000000","shopId":"s1","productId":"p1","price":"4","devise":"EUR",` +
+			`"quantity":2,"unit":"kg","version":7,"unitPrice":{"price":"2","devise":"EUR","unit":"kg"}}`),
+	}
+	price, err := decodePriceEvent(event)
+	if err != nil {
+		t.Fatalf("Failed to decode raw price event: %v", err)
+	}
+	if price.Price != money.MustParse("4") || price.Quantity != 2 || price.Unit != "kg" {
+		t.Fatalf("Unexpected price %+v", price)
+	}
+	if price.Version != 1 || price.UnitPrice != nil {
+		t.Fatalf("Expected the version of the stream and no unit price, got %+v", price)
+	}
+}
+
+func TestDecodeRawFloatPriceEvent(t *testing.T) {
+	// The prices were float64 before the money type
+	event := &esdb.RecordedEvent{
+		EventType: PriceUpdatedEventType,
+		Data:      []byte(`{"shopId":"s1","productId":"p1","price":3.3000000000000003,"devise":"EUR"}`),
+	}
+	price, err := decodePriceEvent(event)
+	if err != nil {
+		t.Fatalf("Failed to decode the float price event: %v", err)
+	}
+	if price.Price != money.MustParse("3.3") {
+		t.Fatalf("Expected the price rounded, got %s", price.Price)
+	}
+
+	// The current schema keeps rejecting them
+	event.UserMetadata = []byte(`{"schemaVersion":2}`)
+	if _, err := decodePriceEvent(event); !errors.Is(err, money.ErrInvalidAmount) {
+		t.Fatalf("Expected an invalid amount, got %v", err)
+	}
+}
+
+func TestPriceEventRoundTrip(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	price := &Price{
+		ShopID:    "s1",
+		ProductID: "p1",
+		Price:     money.MustParse("1.99"),
+		Devise:    "EUR",
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   4,
+	}
+	data, err := newPriceEventData(context.Background(), PriceUpdatedEventType, price, 0)
+	if err != nil {
+		t.Fatalf("Failed to encode price event: %v", err)
+	}
+
+	var metadata EventMetadata
+	if err := json.Unmarshal(data.Metadata, &metadata); err != nil || metadata.SchemaVersion != PriceEventSchemaVersion {
+		t.Fatalf("Unexpected metadata %s: %v", data.Metadata, err)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(data.Data, &payload); err != nil {
+		t.Fatalf("Failed to read payload: %v", err)
+	}
+	if _, ok := payload["version"]; ok {
+		t.Fatalf("Expected no version in the payload, got %s", data.Data)
+	}
+
+	decoded, err := decodePriceEvent(&esdb.RecordedEvent{
+		EventType:    data.EventType,
+		EventNumber:  3,
+		Data:         data.Data,
+		UserMetadata: data.Metadata,
+	})
+	if err != nil {
+		t.Fatalf("Failed to decode price event: %v", err)
+	}
+	if *decoded != *price {
+		t.Fatalf("Expected %+v, got %+v", price, decoded)
+	}
+}
+
+func TestDecodeFutureSchemaVersion(t *testing.T) {
+	event := &esdb.RecordedEvent{
+		EventType:    PriceCreatedEventType,
+		Data:         []byte(`{"shopId":"s1","productId":"p1","price":"1","devise":"EUR"}`),
+		UserMetadata: []byte(`{"schemaVersion":99}`),
+	}
+	if _, err := decodePriceEvent(event); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Fatalf("Expected an unsupported schema, got %v", err)
+	}
+}
+
+func TestProjectStopsAtUnreadableEvents(t *testing.T) {
+	l := loger.WithField("test", "TestProjectStopsAtUnreadableEvents")
+	// Only the events of an unknown type are skipped, without projecting
+	projector := NewPriceProjector(nil, nil)
+	if err := projector.project(l, &esdb.RecordedEvent{EventType: "ShopCreated", StreamID: priceStreamName("s1", "p1")}); err != nil {
+		t.Fatalf("Expected the unknown event to be skipped, got %v", err)
+	}
+
+	event := &esdb.RecordedEvent{
+		EventType:    PriceCreatedEventType,
+		StreamID:     priceStreamName("s1", "p1"),
+		Data:         []byte(`{"shopId":"s1","productId":"p1","price":"1","devise":"EUR"}`),
+		UserMetadata: []byte(`{"schemaVersion":99}`),
+	}
+	if err := projector.project(l, event); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Fatalf("Expected the projection to stop at the unsupported schema, got %v", err)
+	}
+	event.UserMetadata, event.Data = nil, []byte(`{"price":`)
+	if err := projector.project(l, event); err == nil {
+		t.Fatal("Expected the projection to stop at the invalid event")
+	}
+}
+
+func TestUpcasterRegistry(t *testing.T) {
+	registry := NewUpcasterRegistry()
+	registry.Register("Renamed", 1, func(data []byte) ([]byte, error) {
+		return append(data, 'b'), nil
+	})
+	registry.Register("Renamed", 2, func(data []byte) ([]byte, error) {
+		return append(data, 'c'), nil
+	})
+
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{1, "abc"},
+		{2, "ac"},
+		{3, "a"},
+	}
+	for _, tt := range tests {
+		data, err := registry.Upcast("Renamed", tt.version, []byte("a"))
+		if err != nil || string(data) != tt.want {
+			t.Errorf("Upcast from version %d: expected %q, got %q, %v", tt.version, tt.want, data, err)
+		}
+	}
+
+	if data, err := registry.Upcast("Other", 1, []byte("a")); err != nil || string(data) != "a" {
+		t.Errorf("Expected the payload of a type without upcaster unchanged, got %q, %v", data, err)
+	}
+	if _, err := registry.Upcast("Renamed", 4, []byte("a")); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Errorf("Expected an unsupported schema, got %v", err)
+	}
+}
+
+func TestPriceEventMetadata(t *testing.T) {
+	span := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1, 2, 3},
+		SpanID:  trace.SpanID{4, 5, 6},
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), span)
+	ctx = WithEventContext(ctx, EventContext{
+		CorrelationID: "c1",
+		CausationID:   "m1",
+		Actor:         "user-1",
+		Source:        SourceAMQP,
+	})
+	price := &Price{ShopID: "s1", ProductID: "p1", Price: money.MustParse("1"), Devise: "EUR", UpdatedAt: time.Now()}
+
+	data, err := newPriceEventData(ctx, PriceCreatedEventType, price, 0)
+	if err != nil {
+		t.Fatalf("Failed to encode price event: %v", err)
+	}
+	var metadata EventMetadata
+	if err := json.Unmarshal(data.Metadata, &metadata); err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	want := EventMetadata{
+		SchemaVersion: PriceEventSchemaVersion,
+		CorrelationID: "c1",
+		CausationID:   "m1",
+		TraceID:       span.TraceID().String(),
+		SpanID:        span.SpanID().String(),
+		Actor:         "user-1",
+		Source:        SourceAMQP,
+	}
+	if metadata != want {
+		t.Fatalf("Expected metadata %+v, got %+v", want, metadata)
+	}
+
+	// A retry of the message writes the same event, whatever its timestamps
+	price.UpdatedAt = price.UpdatedAt.Add(time.Second)
+	retried, err := newPriceEventData(ctx, PriceCreatedEventType, price, 0)
+	if err != nil {
+		t.Fatalf("Failed to encode price event: %v", err)
+	}
+	if retried.EventID != data.EventID {
+		t.Fatalf("Expected the same event ID on retry, got %v and %v", data.EventID, retried.EventID)
+	}
+	next, err := newPriceEventData(ctx, PriceCreatedEventType, price, 1)
+	if err != nil {
+		t.Fatalf("Failed to encode price event: %v", err)
+	}
+	if next.EventID == data.EventID {
+		t.Fatal("Expected the next event of the append to get another ID")
+	}
+	other, err := newPriceEventData(WithEventContext(ctx, EventContext{CausationID: "m2"}), PriceCreatedEventType, price, 0)
+	if err != nil {
+		t.Fatalf("Failed to encode price event: %v", err)
+	}
+	if other.EventID == data.EventID {
+		t.Fatal("Expected another message to get another event ID")
+	}
+
+	// A request ID reused for another price gets another event
+	changed := *price
+	changed.Price = money.MustParse("2")
+	reused, err := newPriceEventData(ctx, PriceCreatedEventType, &changed, 0)
+	if err != nil {
+		t.Fatalf("Failed to encode price event: %v", err)
+	}
+	if reused.EventID == data.EventID {
+		t.Fatal("Expected another price of the same request to get another event ID")
+	}
+
+	decoded, err := decodePriceEvent(&esdb.RecordedEvent{
+		EventType:    data.EventType,
+		Data:         data.Data,
+		UserMetadata: data.Metadata,
+	})
+	if err != nil || decoded.CausationID != "m1" {
+		t.Fatalf("Expected the causation of the event, got %+v, %v", decoded, err)
+	}
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"catalog/money"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PriceQuery holds the optional filters applied when listing prices.
+// Nil or empty fields are not applied.
+type PriceQuery struct {
+	ID        *primitive.ObjectID
+	MinPrice  *money.Amount
+	MaxPrice  *money.Amount
+	ProductID string
+	ShopID    string
+	StartDate *time.Time
+	EndDate   *time.Time
+}
+
+// ErrInvalidPriceQuery is returned for a query whose ranges can't match
+var ErrInvalidPriceQuery = errors.New("invalid price query")
+
+// Validate rejects the ranges whose lower bound is above their upper bound,
+// which would silently match no price
+func (q *PriceQuery) Validate() error {
+	if q == nil {
+		return nil
+	}
+	if q.MinPrice != nil && q.MaxPrice != nil && q.MinPrice.Cmp(*q.MaxPrice) > 0 {
+		return fmt.Errorf("%w: minPrice is above maxPrice", ErrInvalidPriceQuery)
+	}
+	if q.StartDate != nil && q.EndDate != nil && q.StartDate.After(*q.EndDate) {
+		return fmt.Errorf("%w: startDate is after endDate", ErrInvalidPriceQuery)
+	}
+	return nil
+}
+
+// Filter converts the query into a MongoDB filter on the prices collection
+func (q *PriceQuery) Filter() bson.M {
+	filter := bson.M{}
+	if q == nil {
+		return filter
+	}
+
+	if q.ID != nil {
+		filter["_id"] = *q.ID
+	}
+
+	price := bson.M{}
+	if q.MinPrice != nil {
+		price["$gte"] = *q.MinPrice
+	}
+	if q.MaxPrice != nil {
+		price["$lte"] = *q.MaxPrice
+	}
+	if len(price) > 0 {
+		filter["price"] = price
+	}
+
+	if q.ProductID != "" {
+		filter["productId"] = q.ProductID
+	}
+	if q.ShopID != "" {
+		filter["shopId"] = q.ShopID
+	}
+	if q.StartDate != nil {
+		filter["createdAt"] = bson.M{"$gte": *q.StartDate}
+	}
+	if q.EndDate != nil {
+		filter["updatedAt"] = bson.M{"$lte": *q.EndDate}
+	}
+	return filter
+}
+
+// Match reports whether the price satisfies every filter of the query.
+// It mirrors Filter for the handlers that can't delegate to MongoDB.
+func (q *PriceQuery) Match(price *Price) bool {
+	if q == nil {
+		return true
+	}
+	if q.ID != nil && price.ID != *q.ID {
+		return false
+	}
+	if q.MinPrice != nil && price.Price.Cmp(*q.MinPrice) < 0 {
+		return false
+	}
+	if q.MaxPrice != nil && price.Price.Cmp(*q.MaxPrice) > 0 {
+		return false
+	}
+	if q.ProductID != "" && price.ProductID != q.ProductID {
+		return false
+	}
+	if q.ShopID != "" && price.ShopID != q.ShopID {
+		return false
+	}
+	if q.StartDate != nil && price.CreatedAt.Before(*q.StartDate) {
+		return false
+	}
+	if q.EndDate != nil && price.UpdatedAt.After(*q.EndDate) {
+		return false
+	}
+	return true
+}
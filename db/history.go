@@ -0,0 +1,90 @@
+package db
+
+import (
+	"catalog/money"
+	"time"
+)
+
+type Interval string
+
+const (
+	IntervalDay   Interval = "day"
+	IntervalWeek  Interval = "week"
+	IntervalMonth Interval = "month"
+)
+
+// PriceBucket summarizes the prices observed during one interval
+type PriceBucket struct {
+	Start  time.Time    `json:"start"`
+	End    time.Time    `json:"end"`
+	Open   money.Amount `json:"open"`
+	Close  money.Amount `json:"close"`
+	Min    money.Amount `json:"min"`
+	Max    money.Amount `json:"max"`
+	Devise string       `json:"devise"`
+	Count  int          `json:"count"`
+}
+
+// PriceHistory is the evolution of the price of a product in a shop.
+// Without interval it holds every price, otherwise the downsampled buckets.
+type PriceHistory struct {
+	ShopID    string        `json:"shopId"`
+	ProductID string        `json:"productId"`
+	Interval  Interval      `json:"interval,omitempty"`
+	Prices    []Price       `json:"prices,omitempty"`
+	Buckets   []PriceBucket `json:"buckets,omitempty"`
+}
+
+// BucketStart returns the start, in UTC, of the interval containing t.
+// Weeks start on Monday.
+func BucketStart(t time.Time, interval Interval) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case IntervalWeek:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case IntervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+func bucketEnd(start time.Time, interval Interval) time.Time {
+	switch interval {
+	case IntervalWeek:
+		return start.AddDate(0, 0, 7)
+	case IntervalMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Downsample groups the prices, sorted by UpdatedAt, into one bucket per
+// interval. Intervals without any price are skipped.
+func Downsample(prices []Price, interval Interval) []PriceBucket {
+	buckets := make([]PriceBucket, 0)
+	for _, price := range prices {
+		start := BucketStart(price.UpdatedAt, interval)
+		last := len(buckets) - 1
+		if last < 0 || !buckets[last].Start.Equal(start) {
+			buckets = append(buckets, PriceBucket{
+				Start:  start,
+				End:    bucketEnd(start, interval),
+				Open:   price.Price,
+				Close:  price.Price,
+				Min:    price.Price,
+				Max:    price.Price,
+				Devise: price.Devise,
+				Count:  1,
+			})
+			continue
+		}
+		bucket := &buckets[last]
+		bucket.Close = price.Price
+		bucket.Min = money.Min(bucket.Min, price.Price)
+		bucket.Max = money.Max(bucket.Max, price.Price)
+		bucket.Count++
+	}
+	return buckets
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"catalog/money"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	at := func(s string) time.Time {
+		d, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	prices := []Price{
+		{Price: money.MustParse("2.0"), Devise: "EUR", UpdatedAt: at("2024-03-04T08:00:00Z")},
+		{Price: money.MustParse("1.5"), Devise: "EUR", UpdatedAt: at("2024-03-05T08:00:00Z")},
+		{Price: money.MustParse("3.0"), Devise: "EUR", UpdatedAt: at("2024-03-09T08:00:00Z")},
+		{Price: money.MustParse("2.5"), Devise: "EUR", UpdatedAt: at("2024-03-11T08:00:00Z")},
+		{Price: money.MustParse("2.0"), Devise: "EUR", UpdatedAt: at("2024-04-01T08:00:00Z")},
+	}
+
+	weeks := Downsample(prices, IntervalWeek)
+	if len(weeks) != 3 {
+		t.Fatalf("Expected 3 weeks, got %+v", weeks)
+	}
+	first := weeks[0]
+	if !first.Start.Equal(at("2024-03-04T00:00:00Z")) || !first.End.Equal(at("2024-03-11T00:00:00Z")) {
+		t.Fatalf("Unexpected week bounds: %v - %v", first.Start, first.End)
+	}
+	if first.Open != money.MustParse("2") || first.Close != money.MustParse("3") ||
+		first.Min != money.MustParse("1.5") || first.Max != money.MustParse("3") || first.Count != 3 {
+		t.Fatalf("Unexpected first week: %+v", first)
+	}
+
+	months := Downsample(prices, IntervalMonth)
+	if len(months) != 2 || months[0].Count != 4 || months[1].Open != money.MustParse("2") {
+		t.Fatalf("Unexpected months: %+v", months)
+	}
+
+	if days := Downsample(prices, IntervalDay); len(days) != 5 {
+		t.Fatalf("Expected 5 days, got %+v", days)
+	}
+}
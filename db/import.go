@@ -0,0 +1,74 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The optional fields of an imported ingredient, a single localized name is
+// given as FieldNames.<locale>
+const (
+	FieldDensity = "density"
+	FieldNames   = "names"
+)
+
+// IngredientImport is an ingredient read from an import file, with the
+// optional fields given by the file, even empty. The optional fields left out
+// of the file keep their stored value.
+type IngredientImport struct {
+	Ingredient Ingredient
+	Fields     []string
+}
+
+// ImportError tells which ingredients of an import failed to be written, by
+// index. The other ones are written.
+type ImportError struct {
+	Failed map[int]error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("failed to import %d ingredients", len(e.Failed))
+}
+
+// update returns the fields of the ingredient to set, and the optional fields
+// given empty to unset
+func (i *IngredientImport) update() (bson.M, bson.M) {
+	ingredient := &i.Ingredient
+	set := bson.M{"name": ingredient.Name, "image_url": ingredient.ImageURL, "type": ingredient.Type}
+	unset := bson.M{}
+	whole := false
+	for _, field := range i.Fields {
+		switch {
+		case field == FieldDensity:
+			if ingredient.Density != 0 {
+				set[FieldDensity] = ingredient.Density
+			} else {
+				unset[FieldDensity] = ""
+			}
+		case field == FieldNames:
+			whole = true
+			if len(ingredient.Names) > 0 {
+				set[FieldNames] = ingredient.Names
+			} else {
+				unset[FieldNames] = ""
+			}
+		}
+	}
+	if whole {
+		return set, unset
+	}
+	for _, field := range i.Fields {
+		locale, ok := strings.CutPrefix(field, FieldNames+".")
+		if !ok {
+			continue
+		}
+		if name := ingredient.Names[locale]; len(name) > 0 {
+			set[field] = name
+		} else {
+			unset[field] = ""
+		}
+	}
+	return set, unset
+}
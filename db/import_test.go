@@ -0,0 +1,45 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestIngredientImportUpdate(t *testing.T) {
+	ingredient := Ingredient{Name: "Butter", ImageURL: "butter.png", Type: "dairy", Density: 0.91, Names: map[string]string{"fr": "Beurre"}}
+	required := bson.M{"name": "Butter", "image_url": "butter.png", "type": "dairy"}
+	with := func(fields bson.M) bson.M {
+		m := bson.M{}
+		for k, v := range required {
+			m[k] = v
+		}
+		for k, v := range fields {
+			m[k] = v
+		}
+		return m
+	}
+
+	tests := []struct {
+		name          string
+		ingredient    Ingredient
+		fields        []string
+		expectedSet   bson.M
+		expectedUnset bson.M
+	}{
+		{"Without optional columns", ingredient, nil, required, bson.M{}},
+		{"With columns", ingredient, []string{"density", "names.fr"}, with(bson.M{"density": 0.91, "names.fr": "Beurre"}), bson.M{}},
+		{"With empty columns", Ingredient{Name: "Butter", ImageURL: "butter.png", Type: "dairy"}, []string{"density", "names.de"}, required, bson.M{"density": "", "names.de": ""}},
+		{"With all the names", ingredient, []string{"names", "names.fr"}, with(bson.M{"names": map[string]string{"fr": "Beurre"}}), bson.M{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imported := IngredientImport{Ingredient: tt.ingredient, Fields: tt.fields}
+			set, unset := imported.update()
+			if !reflect.DeepEqual(tt.expectedSet, set) || !reflect.DeepEqual(tt.expectedUnset, unset) {
+				t.Fatalf("Expected %v and %v, got %v and %v", tt.expectedSet, tt.expectedUnset, set, unset)
+			}
+		})
+	}
+}
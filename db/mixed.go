@@ -2,6 +2,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -43,8 +45,8 @@ func (h *MixedHandler) FindByID(l *logrus.Entry, id string) (*Ingredient, error)
 	return h.mongoHandler.FindByID(l, id)
 }
 
-func (h *MixedHandler) FindAllIngredients(l *logrus.Entry) (*[]Ingredient, error) {
-	return h.mongoHandler.FindAllIngredients(l)
+func (h *MixedHandler) FindAllIngredients(l *logrus.Entry, page *Pagination) (*Page[Ingredient], error) {
+	return h.mongoHandler.FindAllIngredients(l, page)
 }
 
 func (h *MixedHandler) FindByName(l *logrus.Entry, name string) (*Ingredient, error) {
@@ -55,46 +57,165 @@ func (h *MixedHandler) FindByType(l *logrus.Entry, ingredientType string) (*[]In
 	return h.mongoHandler.FindByType(l, ingredientType)
 }
 
+func (h *MixedHandler) SearchIngredients(l *logrus.Entry, query string, limit int) (*[]SearchResult, error) {
+	return h.mongoHandler.SearchIngredients(l, query, limit)
+}
+
 func (h *MixedHandler) InsertOne(l *logrus.Entry, ingredient *Ingredient) error {
 	return h.mongoHandler.InsertOne(l, ingredient)
 }
 
-func (h *MixedHandler) UpsertOne(l *logrus.Entry, ingredient *Ingredient) error {
-	return h.mongoHandler.UpsertOne(l, ingredient)
+func (h *MixedHandler) UpsertOne(l *logrus.Entry, ingredient *Ingredient, expected int64) error {
+	return h.mongoHandler.UpsertOne(l, ingredient, expected)
+}
+
+func (h *MixedHandler) DeleteIngredient(l *logrus.Entry, id primitive.ObjectID, expected int64, check func() error) error {
+	return h.mongoHandler.DeleteIngredient(l, id, expected, check)
+}
+
+func (h *MixedHandler) RestoreIngredient(l *logrus.Entry, id primitive.ObjectID) (*Ingredient, error) {
+	return h.mongoHandler.RestoreIngredient(l, id)
+}
+
+func (h *MixedHandler) PurgeIngredient(l *logrus.Entry, id primitive.ObjectID, check func() error) error {
+	return h.mongoHandler.PurgeIngredient(l, id, check)
+}
+
+func (h *MixedHandler) FindIngredientsByNames(l *logrus.Entry, names []string) (*[]Ingredient, error) {
+	return h.mongoHandler.FindIngredientsByNames(l, names)
+}
+
+func (h *MixedHandler) FindIngredientsByIDs(l *logrus.Entry, ids []string) (*[]Ingredient, error) {
+	return h.mongoHandler.FindIngredientsByIDs(l, ids)
+}
+
+func (h *MixedHandler) ImportIngredients(l *logrus.Entry, ingredients []IngredientImport) error {
+	return h.mongoHandler.ImportIngredients(l, ingredients)
+}
+
+func (h *MixedHandler) ExportIngredients(l *logrus.Entry, fn func(*Ingredient) error) error {
+	return h.mongoHandler.ExportIngredients(l, fn)
+}
+
+func (h *MixedHandler) IngredientLocales(l *logrus.Entry) ([]string, error) {
+	return h.mongoHandler.IngredientLocales(l)
 }
 
 func (h *MixedHandler) CreateShop(l *logrus.Entry, shop *Shop) (*Shop, error) {
 	return h.mongoHandler.CreateShop(l, shop)
 }
 
-func (h *MixedHandler) GetShops(l *logrus.Entry) (*[]Shop, error) {
-	return h.mongoHandler.GetShops(l)
+func (h *MixedHandler) GetShops(l *logrus.Entry, page *Pagination) (*Page[Shop], error) {
+	return h.mongoHandler.GetShops(l, page)
 }
 
 func (h *MixedHandler) GetShop(l *logrus.Entry, id primitive.ObjectID) (*Shop, error) {
 	return h.mongoHandler.GetShop(l, id)
 }
 
-func (h *MixedHandler) UpdateShop(l *logrus.Entry, shop *Shop) (*Shop, error) {
-	return h.mongoHandler.UpdateShop(l, shop)
+func (h *MixedHandler) GetShopsNear(l *logrus.Entry, point *GeoPoint, radius float64, limit int) (*[]ShopDistance, error) {
+	return h.mongoHandler.GetShopsNear(l, point, radius, limit)
 }
 
-func (h *MixedHandler) DeleteShop(l *logrus.Entry, id primitive.ObjectID) error {
-	return h.mongoHandler.DeleteShop(l, id)
+func (h *MixedHandler) UpdateShop(l *logrus.Entry, shop *Shop, expected int64) (*Shop, error) {
+	return h.mongoHandler.UpdateShop(l, shop, expected)
+}
+
+func (h *MixedHandler) DeleteShop(l *logrus.Entry, id primitive.ObjectID, expected int64) error {
+	return h.mongoHandler.DeleteShop(l, id, expected)
 }
 
 func (h *MixedHandler) CreatePrice(l *logrus.Entry, price *Price) (*Price, error) {
 	return h.eventHandler.CreatePrice(l, price)
 }
 
-func (h *MixedHandler) UpdatePrice(l *logrus.Entry, price *Price) (*Price, error) {
-	return h.eventHandler.UpdatePrice(l, price)
+func (h *MixedHandler) UpdatePrice(l *logrus.Entry, price *Price, expected int64) (*Price, error) {
+	return h.eventHandler.UpdatePrice(l, price, expected)
+}
+
+func (h *MixedHandler) WritePrices(l *logrus.Entry, writes []*PriceWrite) error {
+	return h.eventHandler.WritePrices(l, writes)
 }
 
-func (h *MixedHandler) GetPrices(l *logrus.Entry) (*[]Price, error) {
-	return h.eventHandler.GetPrices(l)
+// GetPrices reads the latest prices projected by the PriceProjector
+func (h *MixedHandler) GetPrices(l *logrus.Entry, query *PriceQuery, page *Pagination) (*Page[Price], error) {
+	return h.mongoHandler.GetProjectedPrices(l, query, page)
 }
 
 func (h *MixedHandler) GetLastUpdatedPrice(l *logrus.Entry, shopID, productID string) (*Price, error) {
 	return h.eventHandler.GetLastUpdatedPrice(l, shopID, productID)
-}
\ No newline at end of file
+}
+
+func (h *MixedHandler) GetLatestPrices(l *logrus.Entry, productIDs []string) (*[]Price, error) {
+	return h.mongoHandler.GetProjectedLatestPrices(l, productIDs)
+}
+
+func (h *MixedHandler) GetPriceHistory(l *logrus.Entry, shopID, productID string, from, to *time.Time) (*[]Price, error) {
+	return h.eventHandler.GetPriceHistory(l, shopID, productID, from, to)
+}
+
+func (h *MixedHandler) GetPriceAt(l *logrus.Entry, shopID, productID string, at time.Time) (*Price, error) {
+	return h.eventHandler.GetPriceAt(l, shopID, productID, at)
+}
+
+func (h *MixedHandler) GetPricesAt(l *logrus.Entry, shopID, productID string, at time.Time) (*[]Price, error) {
+	return h.eventHandler.GetPricesAt(l, shopID, productID, at)
+}
+
+// RebuildPriceProjection rebuilds the latest prices projected from the event
+// store
+func (h *MixedHandler) RebuildPriceProjection(l *logrus.Entry, opts *RebuildOptions, progress func(RebuildProgress)) (*RebuildProgress, error) {
+	return rebuildLatestPrices(l, h.mongoHandler, h.eventHandler, opts, progress)
+}
+
+func (h *MixedHandler) CreateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error) {
+	return h.mongoHandler.CreateExchangeRate(l, rate)
+}
+
+func (h *MixedHandler) GetExchangeRates(l *logrus.Entry, base, quote string, page *Pagination) (*Page[ExchangeRate], error) {
+	return h.mongoHandler.GetExchangeRates(l, base, quote, page)
+}
+
+func (h *MixedHandler) GetExchangeRate(l *logrus.Entry, id primitive.ObjectID) (*ExchangeRate, error) {
+	return h.mongoHandler.GetExchangeRate(l, id)
+}
+
+func (h *MixedHandler) UpdateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error) {
+	return h.mongoHandler.UpdateExchangeRate(l, rate)
+}
+
+func (h *MixedHandler) DeleteExchangeRate(l *logrus.Entry, id primitive.ObjectID) error {
+	return h.mongoHandler.DeleteExchangeRate(l, id)
+}
+
+func (h *MixedHandler) ImportExchangeRates(l *logrus.Entry, rates []ExchangeRate) (int64, error) {
+	return h.mongoHandler.ImportExchangeRates(l, rates)
+}
+
+func (h *MixedHandler) FindExchangeRate(l *logrus.Entry, base, quote string, at time.Time) (*ExchangeRate, error) {
+	return h.mongoHandler.FindExchangeRate(l, base, quote, at)
+}
+
+func (h *MixedHandler) FindNextExchangeRate(l *logrus.Entry, base, quote string, after time.Time) (*ExchangeRate, error) {
+	return h.mongoHandler.FindNextExchangeRate(l, base, quote, after)
+}
+
+func (h *MixedHandler) CreateAPIKey(l *logrus.Entry, key *APIKey) (*APIKey, error) {
+	return h.mongoHandler.CreateAPIKey(l, key)
+}
+
+func (h *MixedHandler) GetAPIKeys(l *logrus.Entry, page *Pagination) (*Page[APIKey], error) {
+	return h.mongoHandler.GetAPIKeys(l, page)
+}
+
+func (h *MixedHandler) RevokeAPIKey(l *logrus.Entry, id primitive.ObjectID) error {
+	return h.mongoHandler.RevokeAPIKey(l, id)
+}
+
+func (h *MixedHandler) FindAPIKeyByHash(l *logrus.Entry, hash string) (*APIKey, error) {
+	return h.mongoHandler.FindAPIKeyByHash(l, hash)
+}
+
+func (h *MixedHandler) RecordAPIKeyUsage(l *logrus.Entry, id primitive.ObjectID, at time.Time) error {
+	return h.mongoHandler.RecordAPIKeyUsage(l, id, at)
+}
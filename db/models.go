@@ -1,6 +1,8 @@
 package db
 
 import (
+	"catalog/money"
+	"catalog/units"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -11,16 +13,107 @@ type Ingredient struct {
 	Name     string             `bson:"name" json:"name" validate:"required"`
 	ImageURL string             `bson:"image_url" json:"image_url" validate:"required"`
 	Type     string             `bson:"type" json:"type" validate:"required,oneof=vegetable fruit meat fish dairy spice sugar cereals nuts other"`
+	// Density in kilograms per litre, to compare prices by mass and by volume
+	Density float64 `bson:"density,omitempty" json:"density,omitempty" validate:"omitempty,gt=0"`
+	// Localized names, by BCP 47 language tag such as "fr" or "de-CH"
+	Names map[string]string `bson:"names,omitempty" json:"names,omitempty" validate:"omitempty,dive,keys,bcp47_language_tag,endkeys,required"`
+	// Set when the ingredient is deleted, it is hidden until restored or purged
+	DeletedAt *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	// Incremented on every write, it is the ETag of the ingredient
+	Version int64 `bson:"version,omitempty" json:"version"`
+}
+
+// AllNames returns the name of the ingredient followed by its localized names
+func (i *Ingredient) AllNames() []string {
+	names := make([]string, 0, len(i.Names)+1)
+	names = append(names, i.Name)
+	for _, name := range i.Names {
+		names = append(names, name)
+	}
+	return names
 }
 
 type Price struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id" validate:"omitempty"`
 	ProductID string             `bson:"productId" json:"productId" validate:"required"`
 	ShopID    string             `bson:"shopId" json:"shopId" validate:"required"`
-	Price     float64            `bson:"price" json:"price" validate:"required"`
-	Devise    string             `bson:"devise" json:"devise" validate:"required,oneof=EUR USD"`
+	Price     money.Amount       `bson:"price" json:"price" validate:"required"`
+	Devise    string             `bson:"devise" json:"devise" validate:"required,iso4217"`
+	Quantity  float64            `bson:"quantity,omitempty" json:"quantity,omitempty" validate:"omitempty,gt=0"`
+	Unit      units.Unit         `bson:"unit,omitempty" json:"unit,omitempty" validate:"required_with=Quantity,omitempty,unit"`
 	CreatedAt time.Time          `bson:"createdAt" json:"createdAt" validate:"required"`
 	UpdatedAt time.Time          `bson:"updatedAt" json:"updatedAt" validate:"required"`
+	// Incremented on every write. In the event store, it is the number of
+	// events of the price stream.
+	Version int64 `bson:"version,omitempty" json:"version"`
+	// Computed when reading the price, never stored
+	UnitPrice *UnitPrice `bson:"-" json:"unitPrice,omitempty"`
+	// The request or message of the last event of the price, when read from
+	// the event store
+	CausationID string `bson:"-" json:"-"`
+}
+
+// UnitPrice is a price brought back to a single unit, e.g. a price per kilogram
+type UnitPrice struct {
+	Price money.Amount `json:"price"`
+	Unit  units.Unit   `json:"unit"`
+}
+
+// NeedsDensity reports whether normalizing the price to the unit converts
+// between mass and volume.
+func (p *Price) NeedsDensity(to units.Unit) bool {
+	if p.Unit == "" || to == "" {
+		return false
+	}
+	from, target := p.Unit.Dimension(), to.Dimension()
+	return from != target && from != units.Count && target != units.Count
+}
+
+// Normalize computes the UnitPrice of the price in the given unit, or in the
+// base unit of its dimension if empty. Prices without quantity are left as is.
+func (p *Price) Normalize(to units.Unit, density float64) error {
+	p.UnitPrice = nil
+	if p.Quantity <= 0 || p.Unit == "" {
+		return nil
+	}
+	if to == "" {
+		to = units.BaseUnit(p.Unit.Dimension())
+	}
+	quantity, err := units.Convert(p.Quantity, p.Unit, to, density)
+	if err != nil {
+		return err
+	}
+	p.UnitPrice = &UnitPrice{Price: p.Price.Mul(1 / quantity), Unit: to}
+	return nil
+}
+
+// ExchangeRate is the value of one Base unit in Quote, in effect from Date
+type ExchangeRate struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty" json:"id" validate:"omitempty"`
+	Base  string             `bson:"base" json:"base" validate:"required,iso4217"`
+	Quote string             `bson:"quote" json:"quote" validate:"required,iso4217,nefield=Base"`
+	Rate  float64            `bson:"rate" json:"rate" validate:"required,gt=0"`
+	Date  time.Time          `bson:"date" json:"date" validate:"required"`
+}
+
+// APIKey authenticates a machine client. Only the SHA-256 hash of the key is
+// stored, the key itself is returned once, when created.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id" validate:"omitempty"`
+	Name       string             `bson:"name" json:"name" validate:"required"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	Hash       string             `bson:"hash" json:"-"`
+	Scopes     []string           `bson:"scopes" json:"scopes" validate:"required,min=1,dive,oneof=reader contributor admin"`
+	ExpiresAt  *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	RevokedAt  *time.Time         `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+	LastUsedAt *time.Time         `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	UsageCount int64              `bson:"usageCount" json:"usageCount"`
+}
+
+// Expired reports whether the key can't be used anymore at the given time
+func (k *APIKey) Expired(at time.Time) bool {
+	return k.RevokedAt != nil || (k.ExpiresAt != nil && !at.Before(*k.ExpiresAt))
 }
 
 type Location struct {
@@ -30,8 +123,30 @@ type Location struct {
 	City       string `bson:"city" json:"city" validate:"required"`
 }
 
+// GeoPoint is a GeoJSON point, its coordinates are [longitude, latitude]
+type GeoPoint struct {
+	Type        string     `bson:"type" json:"type"`
+	Coordinates [2]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+func NewGeoPoint(latitude, longitude float64) *GeoPoint {
+	return &GeoPoint{
+		Type:        "Point",
+		Coordinates: [2]float64{longitude, latitude},
+	}
+}
+
 type Shop struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id" validate:"omitempty"`
-	Name     string             `bson:"name" json:"name" validate:"required"`
-	Location Location           `bson:"location" json:"location" validate:"required"`
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id" validate:"omitempty"`
+	Name        string             `bson:"name" json:"name" validate:"required"`
+	Location    Location           `bson:"location" json:"location" validate:"required"`
+	Coordinates *GeoPoint          `bson:"coordinates,omitempty" json:"coordinates,omitempty"`
+	// Incremented on every write, it is the ETag of the shop
+	Version int64 `bson:"version,omitempty" json:"version"`
+}
+
+// ShopDistance is a shop returned by a proximity query, with its distance in meters
+type ShopDistance struct {
+	Shop     `bson:",inline"`
+	Distance float64 `bson:"distance" json:"distance"`
 }
@@ -0,0 +1,337 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 500
+)
+
+var ErrInvalidPagination = errors.New("invalid pagination")
+
+// Fields on which each collection can be sorted, in addition to the _id
+var (
+	IngredientSortFields = []string{"name", "type"}
+	ShopSortFields       = []string{"name"}
+	PriceSortFields      = []string{"price", "productId", "shopId", "createdAt", "updatedAt"}
+	RateSortFields       = []string{"base", "quote", "date"}
+	APIKeySortFields     = []string{"name", "createdAt", "expiresAt", "lastUsedAt"}
+)
+
+// Pagination describes the page requested by a list operation.
+// Sort is a field name, prefixed with "-" for a descending order.
+// A nil Pagination returns every item sorted by _id.
+type Pagination struct {
+	Limit     int
+	Cursor    string
+	Sort      string
+	WithTotal bool
+}
+
+// Page is the envelope returned by the list operations.
+// NextCursor is empty on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+	Total      *int64 `json:"total,omitempty"`
+}
+
+// The cursor is an opaque base64 BSON document holding the sort key of the
+// last returned item and its ObjectID, so the paging stays stable on inserts.
+type pageCursor struct {
+	Key bson.RawValue      `bson:"k"`
+	ID  primitive.ObjectID `bson:"id"`
+}
+
+func encodeCursor(key bson.RawValue, id primitive.ObjectID) (string, error) {
+	b, err := bson.Marshal(pageCursor{Key: key, ID: id})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(cursor string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidPagination)
+	}
+	var c pageCursor
+	if err := bson.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidPagination)
+	}
+	return &c, nil
+}
+
+// sortField returns the field to sort on and the direction (1 or -1)
+func (p *Pagination) sortField(allowed []string) (string, int, error) {
+	if p == nil || p.Sort == "" {
+		return "_id", 1, nil
+	}
+	field, direction := p.Sort, 1
+	if strings.HasPrefix(field, "-") {
+		field, direction = field[1:], -1
+	}
+	if field != "_id" && !slices.Contains(allowed, field) {
+		return "", 0, fmt.Errorf("%w: unknown sort field %q", ErrInvalidPagination, field)
+	}
+	return field, direction, nil
+}
+
+func (p *Pagination) limit() int {
+	if p == nil {
+		return 0
+	}
+	if p.Limit <= 0 {
+		return DefaultPageLimit
+	}
+	return min(p.Limit, MaxPageLimit)
+}
+
+// sortKey extracts the sort key and the ObjectID of an item from its BSON form
+func sortKey(item any, field string) (bson.RawValue, primitive.ObjectID, error) {
+	raw, err := bson.Marshal(item)
+	if err != nil {
+		return bson.RawValue{}, primitive.NilObjectID, err
+	}
+	id, _ := bson.Raw(raw).Lookup("_id").ObjectIDOK()
+	key, err := bson.Raw(raw).LookupErr(field)
+	if err != nil {
+		key = bson.RawValue{Type: bsontype.Null}
+	}
+	return key, id, nil
+}
+
+// afterCursor builds the filter selecting the items placed after the cursor
+func afterCursor(field string, direction int, c *pageCursor) bson.M {
+	op := "$gt"
+	if direction < 0 {
+		op = "$lt"
+	}
+	if field == "_id" {
+		return bson.M{"_id": bson.M{op: c.ID}}
+	}
+	tie := bson.M{field: c.Key, "_id": bson.M{op: c.ID}}
+	// Null sorts before every other value, and comparisons never match it
+	if c.Key.Type == bsontype.Null {
+		if direction > 0 {
+			return bson.M{"$or": bson.A{bson.M{field: bson.M{"$ne": nil}}, tie}}
+		}
+		return tie
+	}
+	if direction < 0 {
+		return bson.M{"$or": bson.A{bson.M{field: bson.M{op: c.Key}}, tie, bson.M{field: nil}}}
+	}
+	return bson.M{"$or": bson.A{bson.M{field: bson.M{op: c.Key}}, tie}}
+}
+
+// findPage runs the filter on the collection and returns the requested page
+func findPage[T any](collection *mongo.Collection, filter bson.M, page *Pagination, allowed []string) (*Page[T], error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	field, direction, err := page.sortField(allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	sort := bson.D{{Key: field, Value: direction}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: direction})
+	}
+	opts := options.Find().SetSort(sort)
+	limit := page.limit()
+	if limit > 0 {
+		opts.SetLimit(int64(limit + 1))
+	}
+
+	result := Page[T]{Items: make([]T, 0)}
+	if page != nil && page.WithTotal {
+		total, err := collection.CountDocuments(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		result.Total = &total
+	}
+
+	query := filter
+	if page != nil && page.Cursor != "" {
+		c, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query = bson.M{"$and": bson.A{filter, afterCursor(field, direction, c)}}
+	}
+
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	if err = cursor.All(ctx, &result.Items); err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(result.Items) > limit {
+		result.Items = result.Items[:limit]
+		key, id, err := sortKey(result.Items[limit-1], field)
+		if err != nil {
+			return nil, err
+		}
+		if result.NextCursor, err = encodeCursor(key, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
+
+// paginate applies the pagination on items held in memory, the same way
+// findPage does it on a MongoDB collection.
+func paginate[T any](items []T, page *Pagination, allowed []string) (*Page[T], error) {
+	field, direction, err := page.sortField(allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	type keyed struct {
+		item T
+		key  bson.RawValue
+		id   primitive.ObjectID
+	}
+	compare := func(aKey bson.RawValue, aID primitive.ObjectID, bKey bson.RawValue, bID primitive.ObjectID) int {
+		if c := compareRawValues(aKey, bKey); c != 0 {
+			return c * direction
+		}
+		return bytes.Compare(aID[:], bID[:]) * direction
+	}
+
+	keyedItems := make([]keyed, 0, len(items))
+	for _, item := range items {
+		key, id, err := sortKey(item, field)
+		if err != nil {
+			return nil, err
+		}
+		keyedItems = append(keyedItems, keyed{item: item, key: key, id: id})
+	}
+	slices.SortStableFunc(keyedItems, func(a, b keyed) int {
+		return compare(a.key, a.id, b.key, b.id)
+	})
+
+	result := Page[T]{Items: make([]T, 0)}
+	if page != nil && page.WithTotal {
+		total := int64(len(items))
+		result.Total = &total
+	}
+
+	start := 0
+	if page != nil && page.Cursor != "" {
+		c, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		for start < len(keyedItems) && compare(keyedItems[start].key, keyedItems[start].id, c.Key, c.ID) <= 0 {
+			start++
+		}
+	}
+
+	end := len(keyedItems)
+	limit := page.limit()
+	if limit > 0 && start+limit < end {
+		end = start + limit
+		last := keyedItems[end-1]
+		if result.NextCursor, err = encodeCursor(last.key, last.id); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, k := range keyedItems[start:end] {
+		result.Items = append(result.Items, k.item)
+	}
+	return &result, nil
+}
+
+// compareRawValues orders two BSON values of the types used as sort keys
+func compareRawValues(a, b bson.RawValue) int {
+	if a.Type == bsontype.Null || b.Type == bsontype.Null {
+		switch {
+		case a.Type == b.Type:
+			return 0
+		case a.Type == bsontype.Null:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	if af, ok := numericValue(a); ok {
+		if bf, ok := numericValue(b); ok {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	switch a.Type {
+	case bsontype.String:
+		if bs, ok := b.StringValueOK(); ok {
+			return strings.Compare(a.StringValue(), bs)
+		}
+	case bsontype.DateTime:
+		if bt, ok := b.DateTimeOK(); ok {
+			return compareInts(a.DateTime(), bt)
+		}
+	case bsontype.ObjectID:
+		if bo, ok := b.ObjectIDOK(); ok {
+			ao := a.ObjectID()
+			return bytes.Compare(ao[:], bo[:])
+		}
+	}
+	return compareInts(int64(a.Type), int64(b.Type))
+}
+
+func numericValue(v bson.RawValue) (float64, bool) {
+	switch v.Type {
+	case bsontype.Double:
+		return v.Double(), true
+	case bsontype.Int32:
+		return float64(v.Int32()), true
+	case bsontype.Int64:
+		return float64(v.Int64()), true
+	case bsontype.Decimal128:
+		f, err := strconv.ParseFloat(v.Decimal128().String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
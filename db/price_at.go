@@ -0,0 +1,45 @@
+package db
+
+import (
+	"sort"
+	"time"
+)
+
+// priceFold folds the events of price streams into the price in effect at an
+// instant: the latest event of each stream observed at or before it, whatever
+// their order in the stream. The later events, even if appended before, are
+// ignored.
+type priceFold struct {
+	at     time.Time
+	prices map[string]*Price
+}
+
+func newPriceFold(at time.Time) *priceFold {
+	return &priceFold{at: at, prices: make(map[string]*Price)}
+}
+
+func (f *priceFold) add(stream string, price *Price) {
+	if price.UpdatedAt.After(f.at) {
+		return
+	}
+	// The observations may be appended out of order, the last appended wins a tie
+	if kept, ok := f.prices[stream]; ok && price.UpdatedAt.Before(kept.UpdatedAt) {
+		return
+	}
+	f.prices[stream] = price
+}
+
+// result returns the prices by shop and product
+func (f *priceFold) result() []Price {
+	prices := make([]Price, 0, len(f.prices))
+	for _, price := range f.prices {
+		prices = append(prices, *price)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		if prices[i].ShopID != prices[j].ShopID {
+			return prices[i].ShopID < prices[j].ShopID
+		}
+		return prices[i].ProductID < prices[j].ProductID
+	})
+	return prices
+}
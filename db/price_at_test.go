@@ -0,0 +1,43 @@
+package db
+
+import (
+	"catalog/money"
+	"testing"
+	"time"
+)
+
+func TestPriceFold(t *testing.T) {
+	at := func(day int) time.Time {
+		return time.Date(2024, 3, day, 12, 0, 0, 0, time.UTC)
+	}
+	price := func(shopID, amount string, day int) *Price {
+		return &Price{ShopID: shopID, ProductID: "p1", Price: money.MustParse(amount), Devise: "EUR", UpdatedAt: at(day)}
+	}
+
+	fold := newPriceFold(at(10))
+	fold.add("price-s2-p1", price("s2", "4", 1))
+	fold.add("price-s1-p1", price("s1", "1", 1))
+	fold.add("price-s1-p1", price("s1", "2", 10))
+	// Observed after the instant
+	fold.add("price-s1-p1", price("s1", "3", 11))
+	fold.add("price-s3-p1", price("s3", "5", 20))
+	// Appended later but observed before the instant
+	fold.add("price-s2-p1", price("s2", "6", 5))
+	// Observed before the price appended first
+	fold.add("price-s4-p1", price("s4", "7", 8))
+	fold.add("price-s4-p1", price("s4", "8", 3))
+
+	prices := fold.result()
+	if len(prices) != 3 {
+		t.Fatalf("Expected 3 prices, got %+v", prices)
+	}
+	if prices[0].ShopID != "s1" || prices[0].Price != money.MustParse("2") {
+		t.Errorf("Expected the price of s1 at the instant, got %+v", prices[0])
+	}
+	if prices[1].ShopID != "s2" || prices[1].Price != money.MustParse("6") {
+		t.Errorf("Expected the last observed price of s2, got %+v", prices[1])
+	}
+	if prices[2].ShopID != "s4" || prices[2].Price != money.MustParse("7") {
+		t.Errorf("Expected the latest observed price of s4, got %+v", prices[2])
+	}
+}
@@ -0,0 +1,70 @@
+package db
+
+// PriceWrite is a write of a price: either a new price, or the refresh of the
+// updatedAt of the last price of the shop and product, when it didn't change.
+type PriceWrite struct {
+	Price *Price
+	// Whether the write refreshes an existing price, of the Expected version
+	Refresh  bool
+	Expected int64
+	// Whether the price was already written by the same request or message,
+	// which is retried: it is not written again
+	Applied bool
+	queued  bool
+}
+
+// PriceBatch dedupes the prices of a batch, in order, against the last price
+// of their shop and product. The last price is either stored, or added before
+// in the batch.
+type PriceBatch struct {
+	// The writes to do, in order. A write is shared by the prices deduped
+	// into it.
+	Writes []*PriceWrite
+	last   map[string]*PriceWrite
+}
+
+// NewPriceBatch starts a batch from the last stored prices, by shop and product
+func NewPriceBatch(last []Price) *PriceBatch {
+	batch := &PriceBatch{last: make(map[string]*PriceWrite, len(last))}
+	for i := range last {
+		price := last[i]
+		batch.last[priceKey(price.ShopID, price.ProductID)] = &PriceWrite{Price: &price, Refresh: true, Expected: price.Version}
+	}
+	return batch
+}
+
+func priceKey(shopID, productID string) string {
+	return shopID + "/" + productID
+}
+
+// SameAs reports whether the prices are the same offer: same amount, currency
+// and quantity. The dates are not compared.
+func (p *Price) SameAs(other *Price) bool {
+	return p.Price == other.Price && p.Devise == other.Devise &&
+		p.Quantity == other.Quantity && p.Unit == other.Unit
+}
+
+// Add adds the price to the batch and returns its write. When the price is the
+// same as the last one, the write only bumps the updatedAt of the last price.
+func (b *PriceBatch) Add(price *Price) *PriceWrite {
+	key := priceKey(price.ShopID, price.ProductID)
+	if last, ok := b.last[key]; ok && last.Price.SameAs(price) {
+		if price.UpdatedAt.After(last.Price.UpdatedAt) {
+			last.Price.UpdatedAt = price.UpdatedAt
+		}
+		b.queue(last)
+		return last
+	}
+
+	write := &PriceWrite{Price: price}
+	b.last[key] = write
+	b.queue(write)
+	return write
+}
+
+func (b *PriceBatch) queue(write *PriceWrite) {
+	if !write.queued {
+		write.queued = true
+		b.Writes = append(b.Writes, write)
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"catalog/money"
+	"catalog/units"
+	"testing"
+	"time"
+)
+
+func TestPriceBatch(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 3, 4, hour, 0, 0, 0, time.UTC)
+	}
+	last := []Price{
+		{ShopID: "s1", ProductID: "p1", Price: money.MustParse("2.0"), Devise: "EUR", UpdatedAt: at(8), Version: 3},
+		{ShopID: "s1", ProductID: "p2", Price: money.MustParse("1.0"), Devise: "EUR", UpdatedAt: at(8), Version: 1},
+	}
+	batch := NewPriceBatch(last)
+
+	// Same as the stored price, refreshed
+	refreshed := batch.Add(&Price{ShopID: "s1", ProductID: "p1", Price: money.MustParse("2.0"), Devise: "EUR", UpdatedAt: at(10)})
+	if !refreshed.Refresh || refreshed.Expected != 3 || !refreshed.Price.UpdatedAt.Equal(at(10)) {
+		t.Fatalf("Expected the stored price to be refreshed, got %+v", refreshed)
+	}
+	// Changed quantity, created
+	created := batch.Add(&Price{ShopID: "s1", ProductID: "p2", Price: money.MustParse("1.0"), Devise: "EUR", Quantity: 500, Unit: units.Gram, UpdatedAt: at(10)})
+	if created.Refresh {
+		t.Fatalf("Expected a new price, got %+v", created)
+	}
+	// Same as the price added before, deduped into it
+	if deduped := batch.Add(&Price{ShopID: "s1", ProductID: "p2", Price: money.MustParse("1.0"), Devise: "EUR", Quantity: 500, Unit: units.Gram, UpdatedAt: at(11)}); deduped != created {
+		t.Fatalf("Expected the price to be deduped into the previous one, got %+v", deduped)
+	}
+	if !created.Price.UpdatedAt.Equal(at(11)) {
+		t.Fatalf("Expected the updatedAt to be bumped, got %v", created.Price.UpdatedAt)
+	}
+	// An older duplicate doesn't move the updatedAt back
+	batch.Add(&Price{ShopID: "s1", ProductID: "p1", Price: money.MustParse("2.0"), Devise: "EUR", UpdatedAt: at(9)})
+	if !refreshed.Price.UpdatedAt.Equal(at(10)) {
+		t.Fatalf("Expected the updatedAt to be kept, got %v", refreshed.Price.UpdatedAt)
+	}
+	// New shop and product
+	batch.Add(&Price{ShopID: "s2", ProductID: "p1", Price: money.MustParse("2.0"), Devise: "EUR", UpdatedAt: at(10)})
+
+	if len(batch.Writes) != 3 {
+		t.Fatalf("Expected 3 writes, got %d", len(batch.Writes))
+	}
+	if batch.Writes[0] != refreshed || batch.Writes[1] != created {
+		t.Fatalf("Expected the writes in the order of the batch, got %+v", batch.Writes)
+	}
+	if last[0].UpdatedAt != at(8) {
+		t.Fatal("Expected the stored prices to be copied")
+	}
+}
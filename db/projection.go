@@ -0,0 +1,231 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The checkpoint of the projection of the latest prices
+const latestPricesProjection = "latest-prices"
+
+// Wait before subscribing again when the subscription drops
+const resubscribeDelay = 5 * time.Second
+
+// The latest prices collection holds one price per shop and product
+var latestPriceIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "shopId", Value: 1}, {Key: "productId", Value: 1}},
+	Options: options.Index().SetUnique(true),
+}
+
+// Checkpoint is the position in $all of the last event handled by a projection
+type Checkpoint struct {
+	Name      string    `bson:"_id" json:"name"`
+	Commit    uint64    `bson:"commit" json:"commit"`
+	Prepare   uint64    `bson:"prepare" json:"prepare"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// GetCheckpoint returns mongo.ErrNoDocuments when the projection never ran
+func (dbh *MongoHandler) GetCheckpoint(l *logrus.Entry, name string) (*Checkpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var checkpoint Checkpoint
+	err := dbh.GetCheckpointsCollection().FindOne(ctx, bson.M{"_id": name}).Decode(&checkpoint)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Failed to get checkpoint")
+		}
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (dbh *MongoHandler) SaveCheckpoint(l *logrus.Entry, checkpoint *Checkpoint) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	checkpoint.UpdatedAt = time.Now()
+	_, err := dbh.GetCheckpointsCollection().ReplaceOne(ctx, bson.M{"_id": checkpoint.Name}, checkpoint, options.Replace().SetUpsert(true))
+	if err != nil {
+		l.WithError(err).Error("Failed to save checkpoint")
+	}
+	return err
+}
+
+// ProjectPrice sets the price as the latest of its shop and product, unless a
+// later version is already projected: a redelivered event changes nothing.
+func (dbh *MongoHandler) ProjectPrice(l *logrus.Entry, price *Price) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := projectPrice(ctx, dbh.GetLatestPricesCollection(), price); err != nil {
+		l.WithError(err).Error("Failed to project price")
+		return err
+	}
+	return nil
+}
+
+func projectPrice(ctx context.Context, collection *mongo.Collection, price *Price) error {
+	projected := *price
+	projected.ID = primitive.NilObjectID
+	filter := bson.M{
+		"shopId":    price.ShopID,
+		"productId": price.ProductID,
+		"version":   bson.M{"$lt": price.Version},
+	}
+	_, err := collection.UpdateOne(ctx, filter, bson.M{"$set": &projected}, options.Update().SetUpsert(true))
+	// The upsert of an older version conflicts with the projected price
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// GetProjectedPrices reads the latest prices projected from the event store
+func (dbh *MongoHandler) GetProjectedPrices(l *logrus.Entry, query *PriceQuery, page *Pagination) (*Page[Price], error) {
+	prices, err := findPage[Price](dbh.GetLatestPricesCollection(), query.Filter(), page, PriceSortFields)
+	if err != nil {
+		l.WithError(err).Error("Failed to get projected prices")
+		return nil, err
+	}
+	return prices, nil
+}
+
+// GetProjectedLatestPrices returns the projected price of every shop selling
+// one of the products
+func (dbh *MongoHandler) GetProjectedLatestPrices(l *logrus.Entry, productIDs []string) (*[]Price, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := dbh.GetLatestPricesCollection().Find(ctx, bson.M{"productId": bson.M{"$in": productIDs}})
+	if err != nil {
+		l.WithError(err).Error("Failed to get projected latest prices")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	prices := make([]Price, 0)
+	if err = cursor.All(ctx, &prices); err != nil {
+		l.WithError(err).Error("Failed to decode projected latest prices")
+		return nil, err
+	}
+	return &prices, nil
+}
+
+// PriceProjector keeps the latest price of every shop and product in Mongo,
+// following the price streams of the event store with a catch-up
+// subscription to $all. The position of the last projected event is saved as
+// a checkpoint, from which the projection resumes after a restart.
+type PriceProjector struct {
+	mongoHandler *MongoHandler
+	eventHandler *EventHandler
+}
+
+func NewPriceProjector(mongoHandler *MongoHandler, eventHandler *EventHandler) *PriceProjector {
+	return &PriceProjector{
+		mongoHandler: mongoHandler,
+		eventHandler: eventHandler,
+	}
+}
+
+// Run projects the price events until the context is done, subscribing again
+// when the subscription drops
+func (p *PriceProjector) Run(ctx context.Context) {
+	l := loger.WithField("projection", latestPricesProjection)
+	for {
+		err := p.subscribe(ctx, l)
+		if ctx.Err() != nil {
+			l.Info("Stopping the price projection")
+			return
+		}
+		l.WithError(err).Warn("Price subscription dropped, subscribing again")
+
+		select {
+		case <-ctx.Done():
+			l.Info("Stopping the price projection")
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+func (p *PriceProjector) subscribe(ctx context.Context, l *logrus.Entry) error {
+	opts := esdb.SubscribeToAllOptions{
+		From: esdb.Start{},
+		Filter: &esdb.SubscriptionFilter{
+			Type:     esdb.StreamFilterType,
+			Prefixes: []string{priceStreamPrefix},
+		},
+	}
+	checkpoint, err := p.mongoHandler.GetCheckpoint(l, latestPricesProjection)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if checkpoint != nil {
+		opts.From = esdb.Position{Commit: checkpoint.Commit, Prepare: checkpoint.Prepare}
+	}
+
+	subscription, err := p.eventHandler.db.SubscribeToAll(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+	l.WithField("checkpoint", checkpoint).Info("Subscribed to the price events")
+
+	for {
+		event := subscription.Recv()
+		switch {
+		case event.SubscriptionDropped != nil:
+			return event.SubscriptionDropped.Error
+		case event.CheckPointReached != nil:
+			// No price event since the last checkpoint, skip the filtered
+			// events on the next subscription
+			position := event.CheckPointReached
+			if err := p.saveCheckpoint(l, position); err != nil {
+				return err
+			}
+		case event.EventAppeared != nil:
+			recorded := event.EventAppeared.OriginalEvent()
+			if err := p.project(l, recorded); err != nil {
+				return err
+			}
+			if err := p.saveCheckpoint(l, &recorded.Position); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// project projects a price event. The events of an unknown type are skipped,
+// but an event which can't be read, such as one of a schema version written by
+// a newer release, stops the projection before its checkpoint: it is retried
+// when subscribing again, rather than lost.
+func (p *PriceProjector) project(l *logrus.Entry, event *esdb.RecordedEvent) error {
+	price, err := decodePriceEvent(event)
+	if errors.Is(err, ErrUnknownEventType) {
+		warnSkippedEvent(l, event, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read event %d of %s: %w", event.EventNumber, event.StreamID, err)
+	}
+	return p.mongoHandler.ProjectPrice(l, price)
+}
+
+func (p *PriceProjector) saveCheckpoint(l *logrus.Entry, position *esdb.Position) error {
+	return p.mongoHandler.SaveCheckpoint(l, &Checkpoint{
+		Name:    latestPricesProjection,
+		Commit:  position.Commit,
+		Prepare: position.Prepare,
+	})
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -44,39 +45,50 @@ func (dbh *MongoHandler) GetShopsCollection() *mongo.Collection {
 	return dbh.client.Database(dbh.dbName).Collection(dbh.shopsCollectionName)
 }
 
+func (dbh *MongoHandler) GetRatesCollection() *mongo.Collection {
+	return dbh.client.Database(dbh.dbName).Collection(dbh.ratesCollectionName)
+}
+
+func (dbh *MongoHandler) GetAPIKeysCollection() *mongo.Collection {
+	return dbh.client.Database(dbh.dbName).Collection(dbh.apiKeysCollectionName)
+}
+
+func (dbh *MongoHandler) GetLatestPricesCollection() *mongo.Collection {
+	return dbh.client.Database(dbh.dbName).Collection(dbh.latestPricesCollectionName)
+}
+
+func (dbh *MongoHandler) GetCheckpointsCollection() *mongo.Collection {
+	return dbh.client.Database(dbh.dbName).Collection(dbh.checkpointsCollectionName)
+}
+
 func (dbh *MongoHandler) FindByID(l *logrus.Entry, id string) (*Ingredient, error) {
 	// TODO Change those hardcoded values
 	collection := dbh.GetIngredientsCollection()
 	objectID, _ := primitive.ObjectIDFromHex(id)
-	filter := map[string]primitive.ObjectID{"_id": objectID}
+	filter := notDeleted(bson.M{"_id": objectID})
 	var ingredient Ingredient
 	err := collection.FindOne(context.Background(), filter).Decode(&ingredient)
 	if err != nil {
-		l.WithError(err).Error("Error when trying to find ingredient by ID")
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Error when trying to find ingredient by ID")
+		}
 		return nil, err
 	}
 	return &ingredient, nil
 }
 
-func (dbh *MongoHandler) FindAllIngredients(l *logrus.Entry) (*[]Ingredient, error) {
-	collection := dbh.GetIngredientsCollection()
-	cursor, err := collection.Find(context.Background(), bson.M{})
+func (dbh *MongoHandler) FindAllIngredients(l *logrus.Entry, page *Pagination) (*Page[Ingredient], error) {
+	ingredients, err := findPage[Ingredient](dbh.GetIngredientsCollection(), notDeleted(bson.M{}), page, IngredientSortFields)
 	if err != nil {
-		l.WithError(err).Error("Error when trying to find all recipes")
+		l.WithError(err).Error("Error when trying to find all ingredients")
 		return nil, err
 	}
-	var ingredients []Ingredient
-	err = cursor.All(context.Background(), &ingredients)
-	if err != nil {
-		l.WithError(err).Error("Error when trying to decode all recipes")
-		return nil, err
-	}
-	return &ingredients, nil
+	return ingredients, nil
 }
 
 func (dbh *MongoHandler) FindByName(l *logrus.Entry, name string) (*Ingredient, error) {
 	collection := dbh.GetIngredientsCollection()
-	filter := map[string]string{"name": name}
+	filter := notDeleted(nameFilter(name))
 	var ingredient Ingredient
 	err := collection.FindOne(context.Background(), filter).Decode(&ingredient)
 	if err != nil {
@@ -86,9 +98,65 @@ func (dbh *MongoHandler) FindByName(l *logrus.Entry, name string) (*Ingredient,
 	return &ingredient, nil
 }
 
+// storedIngredient is an ingredient as stored, with its name and localized
+// names indexed together to be found by any of them, and their trigrams
+// indexed for the searches
+type storedIngredient struct {
+	Ingredient  `bson:",inline"`
+	AllNames    []string `bson:"allNames"`
+	SearchGrams []string `bson:"searchGrams"`
+}
+
+func newStoredIngredient(ingredient *Ingredient) *storedIngredient {
+	names := ingredient.AllNames()
+	return &storedIngredient{Ingredient: *ingredient, AllNames: names, SearchGrams: SearchGrams(names...)}
+}
+
+// updateAllNames recomputes the indexed names from the stored ones, for the
+// writes which don't know all the names, such as the imports
+var updateAllNames = mongo.Pipeline{{{Key: "$set", Value: bson.M{"allNames": bson.M{"$setUnion": bson.A{
+	bson.A{"$name"},
+	bson.M{"$map": bson.M{
+		"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$names", bson.M{}}}},
+		"in":    "$$this.v",
+	}},
+}}}}}}
+
+// indexSearchGrams sets the search trigrams of the ingredients matching the
+// filter from their indexed names, for the writes which don't know all the
+// names
+func indexSearchGrams(ctx context.Context, collection *mongo.Collection, filter bson.M) error {
+	opts := options.Find().SetProjection(bson.M{"allNames": 1})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	var stored []storedIngredient
+	if err := cursor.All(ctx, &stored); err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(stored))
+	for i, ingredient := range stored {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": ingredient.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"searchGrams": SearchGrams(ingredient.AllNames...)}})
+	}
+	_, err = collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// nameFilter matches the ingredients with the name, or any of the localized
+// names, on the indexed allNames
+func nameFilter(name string) bson.M {
+	return bson.M{"allNames": name}
+}
+
 func (dbh *MongoHandler) FindByType(l *logrus.Entry, ingredientType string) (*[]Ingredient, error) {
 	collection := dbh.GetIngredientsCollection()
-	filter := map[string]string{"type": ingredientType}
+	filter := notDeleted(bson.M{"type": ingredientType})
 	cursor, err := collection.Find(context.Background(), filter)
 	if err != nil {
 		l.WithError(err).Error("Error when trying to find ingredient by type")
@@ -102,9 +170,48 @@ func (dbh *MongoHandler) FindByType(l *logrus.Entry, ingredientType string) (*[]
 	return &ingredients, nil
 }
 
+// SearchIngredients ranks the ingredients sharing a trigram with the query,
+// found on the indexed searchGrams, with the same scoring as RankIngredients.
+func (dbh *MongoHandler) SearchIngredients(l *logrus.Entry, query string, limit int) (*[]SearchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	results := make([]SearchResult, 0)
+	grams := SearchGrams(query)
+	if len(grams) == 0 {
+		return &results, nil
+	}
+	cursor, err := dbh.GetIngredientsCollection().Find(ctx, notDeleted(bson.M{"searchGrams": bson.M{"$in": grams}}))
+	if err != nil {
+		l.WithError(err).Error("Error when trying to search ingredients")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	q := NormalizeSearchText(query)
+	for cursor.Next(ctx) {
+		var ingredient Ingredient
+		if err := cursor.Decode(&ingredient); err != nil {
+			l.WithError(err).Error("Error when trying to decode ingredient")
+			return nil, err
+		}
+		if score := ingredientScore(q, &ingredient); score >= minSearchScore {
+			results = append(results, SearchResult{Ingredient: ingredient, Score: score})
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		l.WithError(err).Error("Error when trying to search ingredients")
+		return nil, err
+	}
+
+	results = topResults(results, limit)
+	return &results, nil
+}
+
 func (dbh *MongoHandler) InsertOne(l *logrus.Entry, ingredient *Ingredient) error {
 	collection := dbh.GetIngredientsCollection()
-	_, err := collection.InsertOne(context.Background(), ingredient)
+	ingredient.Version = 1
+	_, err := collection.InsertOne(context.Background(), newStoredIngredient(ingredient))
 	if err != nil {
 		l.WithError(err).Error("Error when trying to insert ingredient")
 		return err
@@ -112,55 +219,365 @@ func (dbh *MongoHandler) InsertOne(l *logrus.Entry, ingredient *Ingredient) erro
 	return nil
 }
 
-func (dbh *MongoHandler) UpsertOne(l *logrus.Entry, ingredient *Ingredient) error {
+// UpsertOne replaces the ingredient if it still has the expected version, and
+// updates it with its new version
+func (dbh *MongoHandler) UpsertOne(l *logrus.Entry, ingredient *Ingredient, expected int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
 	collection := dbh.GetIngredientsCollection()
-	filter := map[string]primitive.ObjectID{"_id": ingredient.ID}
-	update := map[string]Ingredient{"$set": *ingredient}
-	res, err := collection.UpdateOne(context.Background(), filter, update)
+	filter := withVersion(notDeleted(bson.M{"_id": ingredient.ID}), expected)
+	update := replaceIngredient(ingredient)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(ingredient)
+	if err == mongo.ErrNoDocuments {
+		err = missingOrMismatch(ctx, collection, filter, expected)
+	}
 	if err != nil {
 		l.WithError(err).Error("Error when trying to upsert ingredient")
 		return err
 	}
-	if res.MatchedCount == 0 {
-		err = errors.New("ID not found")
-		l.WithError(err).Error("Error when trying to upsert ingredient")
+	return nil
+}
+
+// replaceIngredient returns the update replacing the fields of the ingredient.
+// The optional fields left empty are unset, the omitempty $set of the struct
+// would keep their stored value. The version is only incremented.
+func replaceIngredient(ingredient *Ingredient) bson.M {
+	stored := newStoredIngredient(ingredient)
+	set := bson.M{"name": ingredient.Name, "image_url": ingredient.ImageURL, "type": ingredient.Type, "allNames": stored.AllNames, "searchGrams": stored.SearchGrams}
+	unset := bson.M{}
+	if ingredient.Density != 0 {
+		set["density"] = ingredient.Density
+	} else {
+		unset["density"] = ""
+	}
+	if len(ingredient.Names) > 0 {
+		set["names"] = ingredient.Names
+	} else {
+		unset["names"] = ""
+	}
+
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// DeleteIngredient soft-deletes the ingredient, it can be restored until
+// purged. The check, if any, runs first while the ingredient is live: when it
+// fails, the ingredient is left untouched and its error returned.
+func (dbh *MongoHandler) DeleteIngredient(l *logrus.Entry, id primitive.ObjectID, expected int64, check func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := dbh.GetIngredientsCollection()
+	filter := withVersion(notDeleted(bson.M{"_id": id}), expected)
+	if check != nil {
+		count, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			l.WithError(err).Error("Failed to find ingredient")
+			return err
+		}
+		if count == 0 {
+			return missingOrMismatch(ctx, collection, filter, expected)
+		}
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	update := bson.M{"$set": bson.M{"deletedAt": time.Now()}, "$inc": bson.M{"version": 1}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		l.WithError(err).Error("Failed to delete ingredient")
 		return err
 	}
+	if result.MatchedCount == 0 {
+		return missingOrMismatch(ctx, collection, filter, expected)
+	}
+
 	return nil
 }
 
-func (dbh *MongoHandler) CreateShop(l *logrus.Entry, shop *Shop) (*Shop, error) {
+// ErrDuplicateName is returned when restoring an ingredient whose name was
+// taken by a live ingredient
+var ErrDuplicateName = errors.New("an ingredient already has this name")
+
+// RestoreIngredient brings back a soft-deleted ingredient, unless a live
+// ingredient has its name
+func (dbh *MongoHandler) RestoreIngredient(l *logrus.Entry, id primitive.ObjectID) (*Ingredient, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	result, err := dbh.GetShopsCollection().InsertOne(ctx, shop)
+	collection := dbh.GetIngredientsCollection()
+	filter := bson.M{"_id": id, "deletedAt": bson.M{"$exists": true}}
+	var ingredient Ingredient
+	if err := collection.FindOne(ctx, filter).Decode(&ingredient); err != nil {
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Failed to find the deleted ingredient")
+		}
+		return nil, err
+	}
+	count, err := collection.CountDocuments(ctx, notDeleted(nameFilter(ingredient.Name)), options.Count().SetLimit(1))
 	if err != nil {
-		l.WithError(err).Error("Failed to insert shop")
+		l.WithError(err).Error("Failed to find the ingredients of the same name")
 		return nil, err
 	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %q", ErrDuplicateName, ingredient.Name)
+	}
 
-	shop.ID = result.InsertedID.(primitive.ObjectID)
-	return shop, nil
+	// Restore the version read, a concurrent restore is not applied twice
+	filter["version"] = ingredient.Version
+	update := bson.M{"$unset": bson.M{"deletedAt": ""}, "$inc": bson.M{"version": 1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&ingredient)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Failed to restore ingredient")
+		}
+		return nil, err
+	}
+
+	return &ingredient, nil
 }
 
-func (dbh *MongoHandler) GetShops(l *logrus.Entry) (*[]Shop, error) {
+// PurgeIngredient removes for good a soft-deleted ingredient. The check, if
+// any, runs first while the ingredient is stored: when it fails, the
+// ingredient is kept and its error returned. An ingredient restored meanwhile
+// is not purged.
+func (dbh *MongoHandler) PurgeIngredient(l *logrus.Entry, id primitive.ObjectID, check func() error) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := dbh.GetShopsCollection().Find(ctx, bson.M{})
+	collection := dbh.GetIngredientsCollection()
+	filter := bson.M{"_id": id, "deletedAt": bson.M{"$exists": true}}
+	if check != nil {
+		count, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			l.WithError(err).Error("Failed to find the deleted ingredient")
+			return err
+		}
+		if count == 0 {
+			return mongo.ErrNoDocuments
+		}
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	result, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
-		l.WithError(err).Error("Failed to get shops")
+		l.WithError(err).Error("Failed to purge ingredient")
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// FindIngredientsByNames returns the ingredients with one of the names,
+// without matching the localized names
+func (dbh *MongoHandler) FindIngredientsByNames(l *logrus.Entry, names []string) (*[]Ingredient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := dbh.GetIngredientsCollection().Find(ctx, notDeleted(bson.M{"name": bson.M{"$in": names}}))
+	if err != nil {
+		l.WithError(err).Error("Failed to find ingredients by names")
+		return nil, err
+	}
+	ingredients := make([]Ingredient, 0, len(names))
+	if err := cursor.All(ctx, &ingredients); err != nil {
+		l.WithError(err).Error("Failed to decode ingredients")
 		return nil, err
 	}
+	return &ingredients, nil
+}
+
+// FindIngredientsByIDs returns the ingredients with one of the IDs. The IDs
+// which are not ObjectIDs match no ingredient.
+func (dbh *MongoHandler) FindIngredientsByIDs(l *logrus.Entry, ids []string) (*[]Ingredient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objectIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+	ingredients := make([]Ingredient, 0, len(objectIDs))
+	if len(objectIDs) == 0 {
+		return &ingredients, nil
+	}
+	cursor, err := dbh.GetIngredientsCollection().Find(ctx, notDeleted(bson.M{"_id": bson.M{"$in": objectIDs}}))
+	if err != nil {
+		l.WithError(err).Error("Failed to find ingredients by IDs")
+		return nil, err
+	}
+	if err := cursor.All(ctx, &ingredients); err != nil {
+		l.WithError(err).Error("Failed to decode ingredients")
+		return nil, err
+	}
+	return &ingredients, nil
+}
+
+// ImportIngredients upserts the ingredients by name, in a single unordered
+// bulk write. The ID of an ingredient is only used when it is inserted, and
+// its optional fields are only written when given by the file. When some
+// ingredients fail to be written, the other ones are, and an *ImportError
+// tells which.
+func (dbh *MongoHandler) ImportIngredients(l *logrus.Entry, ingredients []IngredientImport) error {
+	if len(ingredients) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	models := make([]mongo.WriteModel, len(ingredients))
+	for i, imported := range ingredients {
+		update := bson.M{
+			"$inc":         bson.M{"version": 1},
+			"$setOnInsert": bson.M{"_id": imported.Ingredient.ID},
+		}
+		set, unset := imported.update()
+		update["$set"] = set
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(notDeleted(bson.M{"name": imported.Ingredient.Name})).
+			SetUpdate(update).
+			SetUpsert(true)
+	}
+
+	collection := dbh.GetIngredientsCollection()
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	// The names given by the file may be partial, the indexed names are
+	// recomputed from the stored ones, even when some rows failed
+	names := make([]string, len(ingredients))
+	for i := range ingredients {
+		names[i] = ingredients[i].Ingredient.Name
+	}
+	imported := bson.M{"name": bson.M{"$in": names}}
+	_, rerr := collection.UpdateMany(ctx, imported, updateAllNames)
+	if rerr == nil {
+		rerr = indexSearchGrams(ctx, collection, imported)
+	}
+	if rerr != nil {
+		l.WithError(rerr).Error("Failed to index the names of the imported ingredients")
+		if err == nil {
+			return rerr
+		}
+	}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil && len(bulkErr.WriteErrors) > 0 {
+		importErr := &ImportError{Failed: make(map[int]error, len(bulkErr.WriteErrors))}
+		for _, writeErr := range bulkErr.WriteErrors {
+			importErr.Failed[writeErr.Index] = writeErr
+		}
+		l.WithError(err).WithField("failed", len(importErr.Failed)).Warn("Failed to import some ingredients")
+		return importErr
+	}
+	if err != nil {
+		l.WithError(err).Error("Failed to import ingredients")
+		return err
+	}
+	return nil
+}
+
+// ExportIngredients calls fn with every ingredient, sorted by name, without
+// loading the whole catalog
+func (dbh *MongoHandler) ExportIngredients(l *logrus.Entry, fn func(*Ingredient) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := dbh.GetIngredientsCollection().Find(ctx, notDeleted(bson.M{}), opts)
+	if err != nil {
+		l.WithError(err).Error("Failed to export ingredients")
+		return err
+	}
 	defer cursor.Close(ctx)
 
-	shops := make([]Shop, 0)
-	if err = cursor.All(ctx, &shops); err != nil {
-		l.WithError(err).Error("Failed to decode shops")
+	for cursor.Next(ctx) {
+		var ingredient Ingredient
+		if err := cursor.Decode(&ingredient); err != nil {
+			l.WithError(err).Error("Failed to decode ingredient")
+			return err
+		}
+		if err := fn(&ingredient); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// IngredientLocales returns the locales of the localized names of the catalog
+func (dbh *MongoHandler) IngredientLocales(l *logrus.Entry) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{"names": bson.M{"$type": "object"}})}},
+		{{Key: "$project", Value: bson.M{"locales": bson.M{"$objectToArray": "$names"}}}},
+		{{Key: "$unwind", Value: "$locales"}},
+		{{Key: "$group", Value: bson.M{"_id": "$locales.k"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := dbh.GetIngredientsCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		l.WithError(err).Error("Failed to get ingredient locales")
 		return nil, err
 	}
+	var results []struct {
+		Locale string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		l.WithError(err).Error("Failed to decode ingredient locales")
+		return nil, err
+	}
+	locales := make([]string, len(results))
+	for i, result := range results {
+		locales[i] = result.Locale
+	}
+	return locales, nil
+}
 
-	return &shops, nil
+// notDeleted restricts the filter to the ingredients which aren't soft-deleted
+func notDeleted(filter bson.M) bson.M {
+	filter["deletedAt"] = bson.M{"$exists": false}
+	return filter
+}
+
+func (dbh *MongoHandler) CreateShop(l *logrus.Entry, shop *Shop) (*Shop, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	shop.Version = 1
+
+	result, err := dbh.GetShopsCollection().InsertOne(ctx, shop)
+	if err != nil {
+		l.WithError(err).Error("Failed to insert shop")
+		return nil, err
+	}
+
+	shop.ID = result.InsertedID.(primitive.ObjectID)
+	return shop, nil
+}
+
+func (dbh *MongoHandler) GetShops(l *logrus.Entry, page *Pagination) (*Page[Shop], error) {
+	shops, err := findPage[Shop](dbh.GetShopsCollection(), bson.M{}, page, ShopSortFields)
+	if err != nil {
+		l.WithError(err).Error("Failed to get shops")
+		return nil, err
+	}
+	return shops, nil
 }
 
 func (dbh *MongoHandler) GetShop(l *logrus.Entry, id primitive.ObjectID) (*Shop, error) {
@@ -177,19 +594,54 @@ func (dbh *MongoHandler) GetShop(l *logrus.Entry, id primitive.ObjectID) (*Shop,
 	return &shop, nil
 }
 
-func (dbh *MongoHandler) UpdateShop(l *logrus.Entry, shop *Shop) (*Shop, error) {
+// GetShopsNear returns the shops within radius meters of the point, closest first
+func (dbh *MongoHandler) GetShopsNear(l *logrus.Entry, point *GeoPoint, radius float64, limit int) (*[]ShopDistance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$geoNear", Value: bson.M{
+			"near":          point,
+			"distanceField": "distance",
+			"maxDistance":   radius,
+			"spherical":     true,
+		}}},
+		{{Key: "$limit", Value: limit}},
+	}
+
+	cursor, err := dbh.GetShopsCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		l.WithError(err).Error("Failed to get nearby shops")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	shops := make([]ShopDistance, 0)
+	if err = cursor.All(ctx, &shops); err != nil {
+		l.WithError(err).Error("Failed to decode nearby shops")
+		return nil, err
+	}
+
+	return &shops, nil
+}
+
+// UpdateShop replaces the shop if it still has the expected version
+func (dbh *MongoHandler) UpdateShop(l *logrus.Entry, shop *Shop, expected int64) (*Shop, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	collection := dbh.GetShopsCollection()
-	filter := bson.M{"_id": shop.ID}
-	updateDoc := bson.M{"$set": shop}
+	filter := withVersion(bson.M{"_id": shop.ID}, expected)
+	// The version is only incremented, it is left out of the $set
+	set := *shop
+	set.Version = 0
+	updateDoc := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
 
 	result := collection.FindOneAndUpdate(ctx, filter, updateDoc, options.FindOneAndUpdate().SetReturnDocument(options.After))
 
 	var updated Shop
 	if err := result.Decode(&updated); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, nil
+			return nil, missingOrMismatch(ctx, collection, filter, expected)
 		}
 		l.WithError(err).Error("Failed to update inventory item")
 		return nil, err
@@ -199,18 +651,20 @@ func (dbh *MongoHandler) UpdateShop(l *logrus.Entry, shop *Shop) (*Shop, error)
 
 }
 
-func (dbh *MongoHandler) DeleteShop(l *logrus.Entry, id primitive.ObjectID) error {
+func (dbh *MongoHandler) DeleteShop(l *logrus.Entry, id primitive.ObjectID, expected int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	result, err := dbh.GetShopsCollection().DeleteOne(ctx, bson.M{"_id": id})
+	collection := dbh.GetShopsCollection()
+	filter := withVersion(bson.M{"_id": id}, expected)
+	result, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
 		l.WithError(err).Error("Failed to delete shop")
 		return err
 	}
 
 	if result.DeletedCount == 0 {
-		return mongo.ErrNoDocuments
+		return missingOrMismatch(ctx, collection, filter, expected)
 	}
 
 	return nil
@@ -222,61 +676,126 @@ func (dbh *MongoHandler) CreatePrice(l *logrus.Entry, price *Price) (*Price, err
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	result, err := dbh.GetPricesCollection().InsertOne(ctx, price)
-	if err != nil {
+	if err := dbh.insertPrice(ctx, price); err != nil {
 		l.WithError(err).Error("Failed to insert price")
 		return nil, err
 	}
+	return price, nil
+}
+
+func (dbh *MongoHandler) insertPrice(ctx context.Context, price *Price) error {
+	price.Version = 1
+
+	result, err := dbh.GetPricesCollection().InsertOne(ctx, price)
+	if err != nil {
+		return err
+	}
 
 	price.ID = result.InsertedID.(primitive.ObjectID)
-	return price, nil
+	return nil
 }
 
-func (dbh *MongoHandler) UpdatePrice(l *logrus.Entry, update *Price) (*Price, error) {
+// UpdatePrice updates the price if it still has the expected version
+func (dbh *MongoHandler) UpdatePrice(l *logrus.Entry, update *Price, expected int64) (*Price, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+
+	updated, err := dbh.updatePrice(ctx, update, expected)
+	if err != nil && err != mongo.ErrNoDocuments && err != ErrVersionMismatch {
+		l.WithError(err).Error("Failed to update price")
+	}
+	return updated, err
+}
+
+func (dbh *MongoHandler) updatePrice(ctx context.Context, update *Price, expected int64) (*Price, error) {
 	collection := dbh.GetPricesCollection()
-	filter := bson.M{"_id": update.ID}
+	filter := withVersion(bson.M{"_id": update.ID}, expected)
 
 	updateDoc := bson.M{
 		"$set": bson.M{
 			"price":     update.Price,
 			"updatedAt": update.UpdatedAt,
 			"devise":    update.Devise,
+			"quantity":  update.Quantity,
+			"unit":      update.Unit,
 		},
+		"$inc": bson.M{"version": 1},
 	}
 	result := collection.FindOneAndUpdate(ctx, filter, updateDoc, options.FindOneAndUpdate().SetReturnDocument(options.After))
 
 	var updated Price
 	if err := result.Decode(&updated); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, nil
+			return nil, missingOrMismatch(ctx, collection, filter, expected)
 		}
-		l.WithError(err).Error("Failed to update price")
 		return nil, err
 	}
 
 	return &updated, nil
 }
 
-func (dbh *MongoHandler) GetPrices(l *logrus.Entry) (*[]Price, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// WritePrices writes the prices of a batch in a transaction. The standalone
+// servers don't support the transactions, the prices are then written one by
+// one, stopping on the first failure.
+func (dbh *MongoHandler) WritePrices(l *logrus.Entry, writes []*PriceWrite) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	cursor, err := dbh.GetPricesCollection().Find(ctx, bson.M{})
+	session, err := dbh.client.StartSession()
 	if err != nil {
-		l.WithError(err).Error("Failed to get prices")
-		return nil, err
+		l.WithError(err).Error("Failed to start a session")
+		return err
 	}
-	defer cursor.Close(ctx)
+	defer session.EndSession(ctx)
 
-	prices := make([]Price, 0)
-	if err = cursor.All(ctx, &prices); err != nil {
-		l.WithError(err).Error("Failed to decode prices")
-		return nil, err
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return nil, dbh.writePrices(sessionCtx, writes)
+	})
+	if isTransactionNotSupported(err) {
+		l.Debug("Transactions not supported, writing the prices one by one")
+		err = dbh.writePrices(ctx, writes)
 	}
+	if err != nil && err != ErrVersionMismatch {
+		l.WithError(err).Error("Failed to write prices")
+	}
+	return err
+}
 
-	return &prices, nil
+func (dbh *MongoHandler) writePrices(ctx context.Context, writes []*PriceWrite) error {
+	for _, write := range writes {
+		if !write.Refresh {
+			if err := dbh.insertPrice(ctx, write.Price); err != nil {
+				return err
+			}
+			continue
+		}
+		updated, err := dbh.updatePrice(ctx, write.Price, write.Expected)
+		if err == mongo.ErrNoDocuments {
+			// The refreshed price was deleted since it was read
+			return ErrVersionMismatch
+		}
+		if err != nil {
+			return err
+		}
+		write.Price = updated
+	}
+	return nil
+}
+
+// isTransactionNotSupported reports whether the server is a standalone, which
+// rejects the transactions with an IllegalOperation error
+func isTransactionNotSupported(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && commandErr.Code == 20
+}
+
+func (dbh *MongoHandler) GetPrices(l *logrus.Entry, query *PriceQuery, page *Pagination) (*Page[Price], error) {
+	prices, err := findPage[Price](dbh.GetPricesCollection(), query.Filter(), page, PriceSortFields)
+	if err != nil {
+		l.WithError(err).Error("Failed to get prices")
+		return nil, err
+	}
+	return prices, nil
 }
 
 func (dbh *MongoHandler) GetLastUpdatedPrice(l *logrus.Entry, shopID, productID string) (*Price, error) {
@@ -306,3 +825,366 @@ func (dbh *MongoHandler) GetLastUpdatedPrice(l *logrus.Entry, shopID, productID
 
 	return &price, nil
 }
+
+// GetLatestPrices returns the last updated price of every shop selling one of the products
+func (dbh *MongoHandler) GetLatestPrices(l *logrus.Entry, productIDs []string) (*[]Price, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"productId": bson.M{"$in": productIDs}}}},
+		{{Key: "$sort", Value: bson.M{"updatedAt": -1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"shopId": "$shopId", "productId": "$productId"},
+			"price": bson.M{"$first": "$$ROOT"},
+		}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$price"}}},
+	}
+
+	cursor, err := dbh.GetPricesCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		l.WithError(err).Error("Failed to get latest prices")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	prices := make([]Price, 0)
+	if err = cursor.All(ctx, &prices); err != nil {
+		l.WithError(err).Error("Failed to decode latest prices")
+		return nil, err
+	}
+
+	return &prices, nil
+}
+
+// GetPriceAt returns the price of the product in the shop in effect at the
+// instant, or mongo.ErrNoDocuments if it had none yet
+func (dbh *MongoHandler) GetPriceAt(l *logrus.Entry, shopID, productID string, at time.Time) (*Price, error) {
+	prices, err := dbh.pricesAt(bson.M{"shopId": shopID, "productId": productID}, at)
+	if err != nil {
+		l.WithError(err).Error("Failed to get price at date")
+		return nil, err
+	}
+	if len(prices) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &prices[0], nil
+}
+
+// GetPricesAt returns the price of every shop and product in effect at the
+// instant. The shop and product filters are optional.
+func (dbh *MongoHandler) GetPricesAt(l *logrus.Entry, shopID, productID string, at time.Time) (*[]Price, error) {
+	filter := bson.M{}
+	if shopID != "" {
+		filter["shopId"] = shopID
+	}
+	if productID != "" {
+		filter["productId"] = productID
+	}
+	prices, err := dbh.pricesAt(filter, at)
+	if err != nil {
+		l.WithError(err).Error("Failed to get prices at date")
+		return nil, err
+	}
+	return &prices, nil
+}
+
+// pricesAt keeps, per shop and product, the last price which came into effect
+// at or before the instant. A price is in effect from the earliest of its
+// createdAt and updatedAt, until the next one.
+func (dbh *MongoHandler) pricesAt(filter bson.M, at time.Time) ([]Price, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$addFields", Value: bson.M{"effectiveFrom": bson.M{"$min": bson.A{"$createdAt", "$updatedAt"}}}}},
+		{{Key: "$match", Value: bson.M{"effectiveFrom": bson.M{"$lte": at}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "effectiveFrom", Value: -1}, {Key: "updatedAt", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"shopId": "$shopId", "productId": "$productId"},
+			"price": bson.M{"$first": "$$ROOT"},
+		}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$price"}}},
+		{{Key: "$sort", Value: bson.D{{Key: "shopId", Value: 1}, {Key: "productId", Value: 1}}}},
+	}
+	cursor, err := dbh.GetPricesCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	prices := make([]Price, 0)
+	if err := cursor.All(ctx, &prices); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+// GetPriceHistory returns the prices of the product in the shop updated
+// between from and to, oldest first.
+func (dbh *MongoHandler) GetPriceHistory(l *logrus.Entry, shopID, productID string, from, to *time.Time) (*[]Price, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"shopId":    shopID,
+		"productId": productID,
+	}
+	updatedAt := bson.M{}
+	if from != nil {
+		updatedAt["$gte"] = *from
+	}
+	if to != nil {
+		updatedAt["$lte"] = *to
+	}
+	if len(updatedAt) > 0 {
+		filter["updatedAt"] = updatedAt
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := dbh.GetPricesCollection().Find(ctx, filter, opts)
+	if err != nil {
+		l.WithError(err).Error("Failed to get price history")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	prices := make([]Price, 0)
+	if err = cursor.All(ctx, &prices); err != nil {
+		l.WithError(err).Error("Failed to decode price history")
+		return nil, err
+	}
+
+	return &prices, nil
+}
+
+// Exchange rate operations
+
+func (dbh *MongoHandler) CreateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := dbh.GetRatesCollection().InsertOne(ctx, rate)
+	if err != nil {
+		l.WithError(err).Error("Failed to insert exchange rate")
+		return nil, err
+	}
+
+	rate.ID = result.InsertedID.(primitive.ObjectID)
+	return rate, nil
+}
+
+func (dbh *MongoHandler) GetExchangeRates(l *logrus.Entry, base, quote string, page *Pagination) (*Page[ExchangeRate], error) {
+	filter := bson.M{}
+	if base != "" {
+		filter["base"] = base
+	}
+	if quote != "" {
+		filter["quote"] = quote
+	}
+
+	rates, err := findPage[ExchangeRate](dbh.GetRatesCollection(), filter, page, RateSortFields)
+	if err != nil {
+		l.WithError(err).Error("Failed to get exchange rates")
+		return nil, err
+	}
+	return rates, nil
+}
+
+func (dbh *MongoHandler) GetExchangeRate(l *logrus.Entry, id primitive.ObjectID) (*ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var rate ExchangeRate
+	err := dbh.GetRatesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&rate)
+	if err != nil {
+		l.WithError(err).Error("Failed to get exchange rate")
+		return nil, err
+	}
+
+	return &rate, nil
+}
+
+func (dbh *MongoHandler) UpdateExchangeRate(l *logrus.Entry, rate *ExchangeRate) (*ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result := dbh.GetRatesCollection().FindOneAndUpdate(ctx, bson.M{"_id": rate.ID}, bson.M{"$set": rate}, options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	var updated ExchangeRate
+	if err := result.Decode(&updated); err != nil {
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Failed to update exchange rate")
+		}
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+func (dbh *MongoHandler) DeleteExchangeRate(l *logrus.Entry, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := dbh.GetRatesCollection().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		l.WithError(err).Error("Failed to delete exchange rate")
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// ImportExchangeRates upserts the rates by base, quote and date, and returns
+// the number of rates inserted or modified.
+func (dbh *MongoHandler) ImportExchangeRates(l *logrus.Entry, rates []ExchangeRate) (int64, error) {
+	if len(rates) == 0 {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	models := make([]mongo.WriteModel, len(rates))
+	for i, rate := range rates {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"base": rate.Base, "quote": rate.Quote, "date": rate.Date}).
+			SetUpdate(bson.M{"$set": bson.M{"rate": rate.Rate}}).
+			SetUpsert(true)
+	}
+
+	result, err := dbh.GetRatesCollection().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		l.WithError(err).Error("Failed to import exchange rates")
+		return 0, err
+	}
+
+	return result.UpsertedCount + result.ModifiedCount, nil
+}
+
+// FindExchangeRate returns the rate from base to quote in effect at the given time
+func (dbh *MongoHandler) FindExchangeRate(l *logrus.Entry, base, quote string, at time.Time) (*ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"base":  base,
+		"quote": quote,
+		"date":  bson.M{"$lte": at},
+	}
+	opts := options.FindOne().SetSort(bson.M{"date": -1})
+
+	var rate ExchangeRate
+	if err := dbh.GetRatesCollection().FindOne(ctx, filter, opts).Decode(&rate); err != nil {
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Failed to find exchange rate")
+		}
+		return nil, err
+	}
+
+	return &rate, nil
+}
+
+// FindNextExchangeRate returns the first rate from base to quote dated after
+// the given time, which ends the validity of the rate in effect at that time
+func (dbh *MongoHandler) FindNextExchangeRate(l *logrus.Entry, base, quote string, after time.Time) (*ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"base":  base,
+		"quote": quote,
+		"date":  bson.M{"$gt": after},
+	}
+	opts := options.FindOne().SetSort(bson.M{"date": 1})
+
+	var rate ExchangeRate
+	if err := dbh.GetRatesCollection().FindOne(ctx, filter, opts).Decode(&rate); err != nil {
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Failed to find the next exchange rate")
+		}
+		return nil, err
+	}
+
+	return &rate, nil
+}
+
+// API key operations
+
+func (dbh *MongoHandler) CreateAPIKey(l *logrus.Entry, key *APIKey) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := dbh.GetAPIKeysCollection().InsertOne(ctx, key)
+	if err != nil {
+		l.WithError(err).Error("Failed to insert API key")
+		return nil, err
+	}
+
+	key.ID = result.InsertedID.(primitive.ObjectID)
+	return key, nil
+}
+
+func (dbh *MongoHandler) GetAPIKeys(l *logrus.Entry, page *Pagination) (*Page[APIKey], error) {
+	keys, err := findPage[APIKey](dbh.GetAPIKeysCollection(), bson.M{}, page, APIKeySortFields)
+	if err != nil {
+		l.WithError(err).Error("Failed to get API keys")
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey marks the key as revoked, it is kept for auditing
+func (dbh *MongoHandler) RevokeAPIKey(l *logrus.Entry, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}}
+	result, err := dbh.GetAPIKeysCollection().UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+	if err != nil {
+		l.WithError(err).Error("Failed to revoke API key")
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (dbh *MongoHandler) FindAPIKeyByHash(l *logrus.Entry, hash string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var key APIKey
+	if err := dbh.GetAPIKeysCollection().FindOne(ctx, bson.M{"hash": hash}).Decode(&key); err != nil {
+		if err != mongo.ErrNoDocuments {
+			l.WithError(err).Error("Failed to find API key")
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// RecordAPIKeyUsage updates the last use of the key and counts it
+func (dbh *MongoHandler) RecordAPIKeyUsage(l *logrus.Entry, id primitive.ObjectID, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$max": bson.M{"lastUsedAt": at},
+		"$inc": bson.M{"usageCount": 1},
+	}
+	if _, err := dbh.GetAPIKeysCollection().UpdateByID(ctx, id, update); err != nil {
+		l.WithError(err).Error("Failed to record API key usage")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The progress of a rebuild is reported every rebuildProgressInterval events
+const rebuildProgressInterval = 1000
+
+var (
+	// ErrNoProjection is returned without event store, the prices are then
+	// read from Mongo directly
+	ErrNoProjection    = errors.New("the prices are not projected")
+	ErrInvalidPosition = errors.New("invalid position")
+)
+
+// Position is a position in $all, written commit/prepare
+type Position struct {
+	Commit  uint64 `json:"commit"`
+	Prepare uint64 `json:"prepare"`
+}
+
+// ParsePosition parses a position written commit/prepare, or only commit
+// when both are the same
+func ParsePosition(s string) (*Position, error) {
+	commit, prepare, found := strings.Cut(s, "/")
+	c, err := strconv.ParseUint(commit, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPosition, s)
+	}
+	position := &Position{Commit: c, Prepare: c}
+	if found {
+		if position.Prepare, err = strconv.ParseUint(prepare, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPosition, s)
+		}
+	}
+	return position, nil
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d/%d", p.Commit, p.Prepare)
+}
+
+type RebuildOptions struct {
+	// Replay the events from this position rather than from the start. The
+	// prices of the streams without event since are kept as projected.
+	From *Position
+	// Replay the events without writing the projection
+	DryRun bool
+}
+
+// RebuildProgress is the progress of the rebuild of a projection, reported
+// while the events are replayed
+type RebuildProgress struct {
+	Projection string `json:"projection"`
+	DryRun     bool   `json:"dryRun"`
+	Events     int64  `json:"events"`
+	Prices     int    `json:"prices"`
+	// The prices kept from the projection, when rebuilt from a position
+	Seeded     int64      `json:"seeded,omitempty"`
+	Position   *Position  `json:"position,omitempty"`
+	Collection string     `json:"collection,omitempty"`
+	Swapped    bool       `json:"swapped"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// RebuildPriceProjection is not available without event store
+func (dbh *MongoHandler) RebuildPriceProjection(l *logrus.Entry, opts *RebuildOptions, progress func(RebuildProgress)) (*RebuildProgress, error) {
+	return nil, ErrNoProjection
+}
+
+// rebuildLatestPrices replays the price events into a new collection, then
+// renames it over the latest prices collection. The running projectors write
+// by name, they switch to the new collection with the rename. The events
+// appended during the rebuild are then replayed once more, the projection
+// being idempotent.
+//
+// From a position, the new collection is first seeded with the projected
+// prices, and the price of every stream replayed is projected again from
+// scratch. The seed only holds the events before the checkpoint of the
+// projection: the replay starts at the checkpoint if it is before the
+// position.
+func rebuildLatestPrices(l *logrus.Entry, mongoHandler *MongoHandler, eventHandler *EventHandler, opts *RebuildOptions, progress func(RebuildProgress)) (*RebuildProgress, error) {
+	ctx := context.Background()
+	report := &RebuildProgress{Projection: latestPricesProjection, DryRun: opts.DryRun, StartedAt: time.Now()}
+	database := mongoHandler.client.Database(mongoHandler.dbName)
+
+	from := opts.From
+	if from != nil {
+		checkpoint, err := mongoHandler.GetCheckpoint(l, latestPricesProjection)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return report, err
+		}
+		switch {
+		case checkpoint == nil:
+			l.Warn("The prices were never projected, rebuilding from the start")
+			from = nil
+		case checkpoint.Commit < from.Commit || (checkpoint.Commit == from.Commit && checkpoint.Prepare < from.Prepare):
+			l.WithField("checkpoint", checkpoint).Warn("The projection is behind the position, rebuilding from its checkpoint")
+			from = &Position{Commit: checkpoint.Commit, Prepare: checkpoint.Prepare}
+		}
+	}
+
+	var target *mongo.Collection
+	if !opts.DryRun {
+		// The random part of the ObjectID keeps apart the rebuilds started in
+		// the same second by several replicas
+		report.Collection = fmt.Sprintf("%s_rebuild_%d_%s", mongoHandler.latestPricesCollectionName, report.StartedAt.Unix(), primitive.NewObjectID().Hex())
+		target = database.Collection(report.Collection)
+		if from != nil {
+			seeded, err := seedLatestPrices(ctx, mongoHandler.GetLatestPricesCollection(), report.Collection)
+			if err != nil {
+				l.WithError(err).Error("Failed to seed the rebuilt collection")
+				_ = target.Drop(ctx)
+				return report, err
+			}
+			report.Seeded = seeded
+		}
+		if _, err := target.Indexes().CreateOne(ctx, latestPriceIndex); err != nil {
+			l.WithError(err).Error("Failed to create the rebuilt collection")
+			return report, err
+		}
+	}
+
+	streams := make(map[string]bool)
+	// The seeded price of a stream is replaced by its replayed events
+	reset := from != nil
+	project := func(stream string, price *Price, position Position) error {
+		if target != nil {
+			if reset && !streams[stream] {
+				if _, err := target.DeleteOne(ctx, bson.M{"shopId": price.ShopID, "productId": price.ProductID}); err != nil {
+					return err
+				}
+			}
+			if err := projectPrice(ctx, target, price); err != nil {
+				return err
+			}
+		}
+		streams[stream] = true
+		report.Events++
+		report.Prices = len(streams)
+		report.Position = &position
+		if progress != nil && report.Events%rebuildProgressInterval == 0 {
+			progress(*report)
+		}
+		return nil
+	}
+
+	if err := replayPrices(ctx, l, eventHandler, from, project); err != nil {
+		l.WithError(err).Error("Failed to replay the price events")
+		if target != nil {
+			_ = target.Drop(ctx)
+		}
+		return report, err
+	}
+
+	if !opts.DryRun {
+		err := database.Client().Database("admin").RunCommand(ctx, bson.D{
+			{Key: "renameCollection", Value: mongoHandler.dbName + "." + report.Collection},
+			{Key: "to", Value: mongoHandler.dbName + "." + mongoHandler.latestPricesCollectionName},
+			{Key: "dropTarget", Value: true},
+		}).Err()
+		if err != nil {
+			l.WithError(err).Error("Failed to swap the rebuilt collection")
+			return report, err
+		}
+		report.Swapped = true
+
+		target = mongoHandler.GetLatestPricesCollection()
+		reset = false
+		if report.Position != nil {
+			from = report.Position
+		}
+		if err := replayPrices(ctx, l, eventHandler, from, project); err != nil {
+			l.WithError(err).Error("Failed to replay the price events appended during the rebuild")
+			return report, err
+		}
+	}
+
+	finishedAt := time.Now()
+	report.FinishedAt = &finishedAt
+	if progress != nil {
+		progress(*report)
+	}
+	return report, nil
+}
+
+// seedLatestPrices copies the projected prices into the collection
+func seedLatestPrices(ctx context.Context, source *mongo.Collection, collection string) (int64, error) {
+	cursor, err := source.Aggregate(ctx, mongo.Pipeline{{{Key: "$out", Value: collection}}})
+	if err != nil {
+		return 0, err
+	}
+	_ = cursor.Close(ctx)
+	return source.Database().Collection(collection).CountDocuments(ctx, bson.M{})
+}
+
+// replayPrices reads the price events of $all forwards, from the position
+// included. Like the projector, it skips the events of an unknown type and
+// stops at an unreadable one.
+func replayPrices(ctx context.Context, l *logrus.Entry, eventHandler *EventHandler, from *Position, fn func(stream string, price *Price, position Position) error) error {
+	opts := esdb.ReadAllOptions{Direction: esdb.Forwards, From: esdb.Start{}}
+	if from != nil {
+		opts.From = esdb.Position{Commit: from.Commit, Prepare: from.Prepare}
+	}
+	stream, err := eventHandler.db.ReadAll(ctx, opts, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for {
+		event, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		recorded := event.OriginalEvent()
+		if !strings.HasPrefix(recorded.StreamID, priceStreamPrefix) {
+			continue
+		}
+		price, err := decodePriceEvent(recorded)
+		if errors.Is(err, ErrUnknownEventType) {
+			warnSkippedEvent(l, recorded, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read event %d of %s: %w", recorded.EventNumber, recorded.StreamID, err)
+		}
+		position := Position{Commit: recorded.Position.Commit, Prepare: recorded.Position.Prepare}
+		if err := fn(recorded.StreamID, price, position); err != nil {
+			return err
+		}
+	}
+}
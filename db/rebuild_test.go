@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePosition(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected *Position
+	}{
+		{"1024/1000", &Position{Commit: 1024, Prepare: 1000}},
+		{"2048", &Position{Commit: 2048, Prepare: 2048}},
+		{"", nil},
+		{"-1", nil},
+		{"12/", nil},
+		{"commit/prepare", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			position, err := ParsePosition(tt.value)
+			if tt.expected == nil {
+				if !errors.Is(err, ErrInvalidPosition) {
+					t.Fatalf("Expected %v, got %v", ErrInvalidPosition, err)
+				}
+				return
+			}
+			if err != nil || *position != *tt.expected {
+				t.Fatalf("Expected %v, got %v (%v)", tt.expected, position, err)
+			}
+		})
+	}
+
+	if s := (Position{Commit: 3, Prepare: 2}).String(); s != "3/2" {
+		t.Fatalf("Expected 3/2, got %s", s)
+	}
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	DefaultSearchLimit = 10
+	// Results scoring below this relevance are dropped
+	minSearchScore = 0.35
+)
+
+// SearchResult is an ingredient ranked by its relevance for a search query
+type SearchResult struct {
+	Ingredient
+	Score float64 `json:"score"`
+}
+
+// NormalizeSearchText lowercases the text, strips the accents and collapses
+// everything that is not a letter or a digit into single spaces.
+func NormalizeSearchText(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	stripped, _, err := transform.String(t, s)
+	if err != nil {
+		stripped = s
+	}
+	fields := strings.FieldsFunc(strings.ToLower(stripped), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(fields, " ")
+}
+
+// SearchScore returns the relevance, between 0 and 1, of the text for the query.
+// Both must already be normalized with NormalizeSearchText.
+func SearchScore(query, text string) float64 {
+	if query == "" || text == "" {
+		return 0
+	}
+	if query == text {
+		return 1
+	}
+	if strings.HasPrefix(text, query) {
+		return 0.95
+	}
+	if strings.Contains(text, query) {
+		return 0.85
+	}
+	return max(0.8*tokenSimilarity(query, text), trigramSimilarity(query, text))
+}
+
+// RankIngredients scores every ingredient against the query and returns the
+// best matches, most relevant first.
+func RankIngredients(query string, ingredients []Ingredient, limit int) []SearchResult {
+	q := NormalizeSearchText(query)
+	results := make([]SearchResult, 0)
+	for _, ingredient := range ingredients {
+		if score := ingredientScore(q, &ingredient); score >= minSearchScore {
+			results = append(results, SearchResult{Ingredient: ingredient, Score: score})
+		}
+	}
+	return topResults(results, limit)
+}
+
+// ingredientScore returns the relevance of the ingredient for a normalized
+// query, the best one of its names in any locale.
+func ingredientScore(query string, ingredient *Ingredient) float64 {
+	best := 0.0
+	for _, name := range ingredient.AllNames() {
+		best = max(best, SearchScore(query, NormalizeSearchText(name)))
+	}
+	return best
+}
+
+func topResults(results []SearchResult, limit int) []SearchResult {
+	slices.SortStableFunc(results, func(a, b SearchResult) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// tokenSimilarity averages, for each word of the query, the similarity of the
+// closest word of the text. A word prefixing a text word is a full match.
+func tokenSimilarity(query, text string) float64 {
+	queryTokens := strings.Fields(query)
+	textTokens := strings.Fields(text)
+	if len(queryTokens) == 0 || len(textTokens) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, q := range queryTokens {
+		best := 0.0
+		for _, t := range textTokens {
+			if strings.HasPrefix(t, q) {
+				best = 1
+				break
+			}
+			qr, tr := []rune(q), []rune(t)
+			// Compare the query word with the text word prefix of the same length
+			// as well, to keep tolerating typos while the user is still typing
+			if len(tr) > len(qr) {
+				best = max(best, 1-float64(levenshtein(qr, tr[:len(qr)]))/float64(len(qr)))
+			}
+			best = max(best, 1-float64(levenshtein(qr, tr))/float64(max(len(qr), len(tr))))
+		}
+		total += best
+	}
+	return total / float64(len(queryTokens))
+}
+
+// trigramSimilarity is the Jaccard index of the padded trigrams of both strings
+func trigramSimilarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	shared := 0
+	for t := range ta {
+		if _, ok := tb[t]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+// SearchGrams returns the trigrams of the normalized names, sorted. They are
+// indexed to find the ingredients sharing one with a query before ranking them.
+func SearchGrams(names ...string) []string {
+	set := make(map[string]struct{})
+	for _, name := range names {
+		for t := range trigrams(NormalizeSearchText(name)) {
+			set[t] = struct{}{}
+		}
+	}
+	grams := make([]string, 0, len(set))
+	for t := range set {
+		grams = append(grams, t)
+	}
+	slices.Sort(grams)
+	return grams
+}
+
+func trigrams(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, word := range strings.Fields(s) {
+		r := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			set[string(r[i:i+3])] = struct{}{}
+		}
+	}
+	return set
+}
+
+// levenshtein returns the edit distance between two words
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRankIngredients(t *testing.T) {
+	ingredients := []Ingredient{
+		{Name: "Crème fraîche", Type: "dairy"},
+		{Name: "Crevette", Type: "fish"},
+		{Name: "Tomate", Type: "vegetable"},
+		{Name: "Pomme de terre", Type: "vegetable", Names: map[string]string{"de": "Kartoffel", "en": "Potato"}},
+		{Name: "Cumin", Type: "spice"},
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "Ignore the accents", query: "creme", expected: "Crème fraîche"},
+		{name: "Ignore the case", query: "TOMATE", expected: "Tomate"},
+		{name: "Tolerate a typo", query: "tomtae", expected: "Tomate"},
+		{name: "Ignore the word order", query: "fraiche creme", expected: "Crème fraîche"},
+		{name: "Match a word in the middle", query: "terre", expected: "Pomme de terre"},
+		{name: "Match a localized name", query: "kartofel", expected: "Pomme de terre"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := RankIngredients(tt.query, ingredients, DefaultSearchLimit)
+			if len(results) == 0 {
+				t.Fatalf("No result for %q", tt.query)
+			}
+			if results[0].Name != tt.expected {
+				t.Fatalf("Expected %q first for %q, got %v", tt.expected, tt.query, results)
+			}
+			// The stored ingredients are prefiltered on their trigrams
+			grams := SearchGrams(results[0].AllNames()...)
+			if !slices.ContainsFunc(SearchGrams(tt.query), func(gram string) bool { return slices.Contains(grams, gram) }) {
+				t.Fatalf("Expected %q to share a trigram with %q", tt.expected, tt.query)
+			}
+		})
+	}
+
+	if results := RankIngredients("chocolat", ingredients, DefaultSearchLimit); len(results) != 0 {
+		t.Fatalf("Expected no result, got %v", results)
+	}
+}
+
+func TestNormalizeSearchText(t *testing.T) {
+	if got := NormalizeSearchText("  Crème-Fraîche, ÉPAISSE "); got != "creme fraiche epaisse" {
+		t.Fatalf("Unexpected normalization: %q", got)
+	}
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AnyVersion skips the version check of a write
+const AnyVersion int64 = -1
+
+// ErrVersionMismatch is returned when the document or the stream was changed
+// since the expected version was read
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// withVersion restricts the filter to the expected version of the document.
+// The documents written before the versioning have no version, they match 0.
+func withVersion(filter bson.M, expected int64) bson.M {
+	switch expected {
+	case AnyVersion:
+	case 0:
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	default:
+		filter["version"] = expected
+	}
+	return filter
+}
+
+// missingOrMismatch tells why a versioned write matched no document: either
+// the document doesn't exist, or it has another version.
+func missingOrMismatch(ctx context.Context, collection *mongo.Collection, filter bson.M, expected int64) error {
+	if expected == AnyVersion {
+		return mongo.ErrNoDocuments
+	}
+	delete(filter, "version")
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrVersionMismatch
+	}
+	return mongo.ErrNoDocuments
+}
@@ -25,7 +25,14 @@ func main() {
 
 	conf := configuration.New()
 	logger.Logger.SetLevel(conf.LogLevel)
+
+	// The subcommands run once and exit
+	if isCommand(os.Args[1:]) {
+		os.Exit(runCommand(conf, os.Args[1:]))
+	}
+
 	var dbh db.DbHandler
+	var projector *db.PriceProjector
 
 	mh, err := db.NewMongoHandler(conf)
 	if err != nil {
@@ -40,16 +47,20 @@ func main() {
 		}
 		mxh := db.NewMixedHandler(mh, eh)
 		dbh = mxh
+		projector = db.NewPriceProjector(mh, eh)
 	} else {
 		logger.Debug("Using only MongoDB with URI: ", conf.DBURI)
 		dbh = mh
 	}
 
-	val := validation.New(conf)
+	val, err := validation.New(conf)
+	if err != nil {
+		panic(err)
+	}
 	r := api.New(val)
 	v1 := r.Group(conf.ListenRoute)
 	amqp := messages.New(conf)
-	h := api.NewApiHandler(dbh, amqp, conf)
+	h := api.NewApiHandler(dbh, amqp, conf, val)
 
 	tp := api.InitOtel()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -68,6 +79,9 @@ func main() {
 	}()
 
 	go h.ConsumeAddPriceMessage(ctx)
+	if projector != nil {
+		go projector.Run(ctx)
+	}
 
 	// Graceful shutdown
 	go func() {
@@ -2,15 +2,19 @@ package messages
 
 import (
 	"catalog/db"
+	"catalog/money"
+	"catalog/units"
 	"time"
 )
 
 type AddPrice struct {
-	ProductID string    `json:"productId" validate:"required"`
-	ShopID    string    `json:"shopId" validate:"required"`
-	Price     float64   `json:"price" validate:"required,min=0.01"`
-	Devise    string    `json:"devise" validate:"required,oneof=EUR USD"`
-	Date      time.Time `json:"date" validate:"required"`
+	ProductID string       `json:"productId" validate:"required"`
+	ShopID    string       `json:"shopId" validate:"required"`
+	Price     money.Amount `json:"price" validate:"required,gt=0"`
+	Devise    string       `json:"devise" validate:"required,iso4217"`
+	Quantity  float64      `json:"quantity" validate:"omitempty,gt=0"`
+	Unit      units.Unit   `json:"unit" validate:"required_with=Quantity,omitempty,unit"`
+	Date      time.Time    `json:"date" validate:"required"`
 }
 
 func NewPrice(price *AddPrice) *db.Price {
@@ -19,6 +23,8 @@ func NewPrice(price *AddPrice) *db.Price {
 		ShopID:    price.ShopID,
 		Price:     price.Price,
 		Devise:    price.Devise,
+		Quantity:  price.Quantity,
+		Unit:      price.Unit,
 		UpdatedAt: price.Date,
 		CreatedAt: time.Now(),
 	}
@@ -0,0 +1,221 @@
+// Package money holds an exact decimal amount of money, kept as an integer
+// number of ten-thousandths of the currency unit, which covers the minor
+// units of every ISO 4217 currency.
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Decimals is the number of decimal places kept by an Amount
+const Decimals = 4
+
+const scale = 10000
+
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Amount is an exact amount of money. It is serialized as a JSON number,
+// and as a Decimal128 in MongoDB so it stays comparable with legacy doubles.
+type Amount struct {
+	scaled int64
+}
+
+// FromFloat rounds the float to the closest Amount, dropping its binary noise
+func FromFloat(f float64) Amount {
+	return Amount{scaled: int64(math.Round(f * scale))}
+}
+
+// FromScaled builds an Amount from a number of ten-thousandths
+func FromScaled(scaled int64) Amount {
+	return Amount{scaled: scaled}
+}
+
+// Parse reads a decimal number such as "12", "-0.5" or "1.2345".
+// More than Decimals decimal places is an error rather than a silent rounding.
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	if whole == "" && fraction == "" || len(fraction) > Decimals || strings.ContainsAny(whole+fraction, "+-") {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	fraction += strings.Repeat("0", Decimals-len(fraction))
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	decimals, err := strconv.ParseInt(fraction, 10, 64)
+	if err != nil || units > (math.MaxInt64-decimals)/scale {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	scaled := units*scale + decimals
+	if negative {
+		scaled = -scaled
+	}
+	return Amount{scaled: scaled}, nil
+}
+
+// MustParse is Parse panicking on errors, for constants
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// Scaled returns the amount as a number of ten-thousandths
+func (a Amount) Scaled() int64 {
+	return a.scaled
+}
+
+func (a Amount) Float64() float64 {
+	return float64(a.scaled) / scale
+}
+
+func (a Amount) IsZero() bool {
+	return a.scaled == 0
+}
+
+func (a Amount) Add(b Amount) Amount {
+	return Amount{scaled: a.scaled + b.scaled}
+}
+
+func (a Amount) Sub(b Amount) Amount {
+	return Amount{scaled: a.scaled - b.scaled}
+}
+
+// Mul multiplies the amount by a quantity or a rate, rounding the result
+func (a Amount) Mul(factor float64) Amount {
+	return Amount{scaled: int64(math.Round(float64(a.scaled) * factor))}
+}
+
+// Cmp returns -1, 0 or 1 when a is lower than, equal to or greater than b
+func (a Amount) Cmp(b Amount) int {
+	switch {
+	case a.scaled < b.scaled:
+		return -1
+	case a.scaled > b.scaled:
+		return 1
+	}
+	return 0
+}
+
+func Min(a, b Amount) Amount {
+	if a.Cmp(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+func Max(a, b Amount) Amount {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// String formats the amount with at least two decimal places
+func (a Amount) String() string {
+	sign := ""
+	scaled := a.scaled
+	if scaled < 0 {
+		sign, scaled = "-", -scaled
+	}
+	fraction := fmt.Sprintf("%04d", scaled%scale)
+	fraction = strings.TrimRight(fraction, "0")
+	if len(fraction) < 2 {
+		fraction += strings.Repeat("0", 2-len(fraction))
+	}
+	return fmt.Sprintf("%s%d.%s", sign, scaled/scale, fraction)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON reads a JSON number, or a string holding one
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAmount, data)
+	}
+	parsed, err := Parse(number.String())
+	if err != nil {
+		// Accept the exponent notation, as long as the value has at most
+		// four decimals, like Parse
+		f, ferr := number.Float64()
+		if ferr != nil {
+			return err
+		}
+		parsed = FromFloat(f)
+		if parsed.Float64() != f {
+			return err
+		}
+	}
+	*a = parsed
+	return nil
+}
+
+func (a Amount) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	d, err := primitive.ParseDecimal128(a.String())
+	if err != nil {
+		return 0, nil, err
+	}
+	return bson.MarshalValue(d)
+}
+
+// UnmarshalBSONValue reads a Decimal128, and the doubles and integers stored
+// before the money type existed.
+func (a *Amount) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.Decimal128:
+		parsed, err := Parse(value.Decimal128().String())
+		if err != nil {
+			f, ferr := strconv.ParseFloat(value.Decimal128().String(), 64)
+			if ferr != nil {
+				return err
+			}
+			parsed = FromFloat(f)
+		}
+		*a = parsed
+	case bsontype.Double:
+		*a = FromFloat(value.Double())
+	case bsontype.Int32:
+		*a = Amount{scaled: int64(value.Int32()) * scale}
+	case bsontype.Int64:
+		*a = Amount{scaled: value.Int64() * scale}
+	case bsontype.String:
+		parsed, err := Parse(value.StringValue())
+		if err != nil {
+			return err
+		}
+		*a = parsed
+	case bsontype.Null, bsontype.Undefined:
+		*a = Amount{}
+	default:
+		return fmt.Errorf("%w: cannot decode %s", ErrInvalidAmount, t)
+	}
+	return nil
+}
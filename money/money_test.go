@@ -0,0 +1,115 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		fails    bool
+	}{
+		{input: "12", expected: "12.00"},
+		{input: "1.1", expected: "1.10"},
+		{input: "-0.5", expected: "-0.50"},
+		{input: ".25", expected: "0.25"},
+		{input: "1.2345", expected: "1.2345"},
+		{input: "1.23456", fails: true},
+		{input: "922337203685477.5807", expected: "922337203685477.5807"},
+		{input: "-922337203685477.5807", expected: "-922337203685477.5807"},
+		{input: "922337203685477.5808", fails: true},
+		{input: "922337203685477.9999", fails: true},
+		{input: "922337203685478", fails: true},
+		{input: "abc", fails: true},
+		{input: "--1", fails: true},
+		{input: "", fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			a, err := Parse(tt.input)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", a)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if a.String() != tt.expected {
+				t.Fatalf("Expected %s, got %s", tt.expected, a)
+			}
+		})
+	}
+}
+
+func TestArithmeticIsExact(t *testing.T) {
+	if MustParse("1.1").Add(MustParse("2.2")) != MustParse("3.3") {
+		t.Fatal("1.1 + 2.2 != 3.3")
+	}
+	if FromFloat(1.1+2.2) != MustParse("3.3") {
+		t.Fatal("The float noise is not rounded away")
+	}
+	if got := MustParse("0.99").Mul(3); got != MustParse("2.97") {
+		t.Fatalf("Expected 2.97, got %s", got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var price struct {
+		Price Amount `json:"price"`
+	}
+	if err := json.Unmarshal([]byte(`{"price": 19.90}`), &price); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if price.Price != MustParse("19.9") {
+		t.Fatalf("Unexpected amount: %s", price.Price)
+	}
+	if err := json.Unmarshal([]byte(`{"price": "3.30"}`), &price); err != nil || price.Price != MustParse("3.3") {
+		t.Fatalf("Failed to unmarshal a string: %v %s", err, price.Price)
+	}
+
+	b, err := json.Marshal(price)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	if string(b) != `{"price":3.30}` {
+		t.Fatalf("Unexpected JSON: %s", b)
+	}
+
+	if err := json.Unmarshal([]byte(`{"price": 1.5e2}`), &price); err != nil || price.Price != MustParse("150") {
+		t.Fatalf("Failed to unmarshal an exponent: %v %s", err, price.Price)
+	}
+	for _, invalid := range []string{`0.30000000000000004`, `1.23456`, `1e-5`, `"1.23456"`} {
+		if err := json.Unmarshal([]byte(`{"price": `+invalid+`}`), &price); !errors.Is(err, ErrInvalidAmount) {
+			t.Fatalf("Expected %s to be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestBSON(t *testing.T) {
+	type price struct {
+		Price Amount `bson:"price"`
+	}
+
+	b, err := bson.Marshal(price{Price: MustParse("3.3")})
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	var decoded price
+	if err := bson.Unmarshal(b, &decoded); err != nil || decoded.Price != MustParse("3.3") {
+		t.Fatalf("Failed to round trip: %v %s", err, decoded.Price)
+	}
+
+	// Documents written when prices were float64
+	legacy, _ := bson.Marshal(bson.M{"price": 1.1 + 2.2})
+	if err := bson.Unmarshal(legacy, &decoded); err != nil || decoded.Price != MustParse("3.3") {
+		t.Fatalf("Failed to read a legacy double: %v %s", err, decoded.Price)
+	}
+}
@@ -0,0 +1,116 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func assertJSON(t *testing.T, expected string, actual []byte) {
+	t.Helper()
+	var e, a interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatalf("Invalid expected document: %v", err)
+	}
+	if err := json.Unmarshal(actual, &a); err != nil {
+		t.Fatalf("Invalid patched document: %v", err)
+	}
+	if !reflect.DeepEqual(e, a) {
+		t.Fatalf("Expected %s, got %s", expected, actual)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		patch    string
+		expected string
+	}{
+		{"Replace a member", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"Add a member", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"Remove a member", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"Replace an array", `{"a":["b"]}`, `{"a":["c","d"]}`, `{"a":["c","d"]}`},
+		{"Merge nested objects", `{"a":{"b":"c","d":"e"}}`, `{"a":{"b":"f","d":null}}`, `{"a":{"b":"f"}}`},
+		{"Replace a scalar by an object", `{"a":"b"}`, `{"a":{"c":null,"d":1}}`, `{"a":{"d":1}}`},
+		{"Replace the document", `{"a":"b"}`, `["c"]`, `["c"]`},
+		{"Keep the numbers as is", `{"price":1.10}`, `{"name":"x"}`, `{"price":1.10,"name":"x"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patched, err := MergePatch([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("Failed to patch: %v", err)
+			}
+			assertJSON(t, tt.expected, patched)
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		patch    string
+		expected string
+		err      error
+	}{
+		{"Add a member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`, nil},
+		{"Insert in an array", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{"Append to an array", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`, nil},
+		{"Remove a member", `{"foo":"bar","baz":"qux"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{"Remove from an array", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{"Replace a value", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil},
+		{"Move a value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{"Move an array item", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil},
+		{"Copy a value", `{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"foo":{"bar":1},"baz":{"bar":2}}`, nil},
+		{"Test a value", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{"Escape the pointer", `{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`, `{"a/b":3}`, nil},
+		{"Set null", `{"foo":"bar"}`, `[{"op":"replace","path":"/foo","value":null}]`, `{"foo":null}`, nil},
+		{"Fail a test", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, "", ErrTestFailed},
+		{"Add to a missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "", ErrPathNotFound},
+		{"Replace a missing member", `{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"qux"}]`, "", ErrPathNotFound},
+		{"Index out of range", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`, "", ErrPathNotFound},
+		{"Leading zero index", `{"foo":["bar","baz"]}`, `[{"op":"remove","path":"/foo/01"}]`, "", ErrInvalidPatch},
+		{"Missing value", `{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, "", ErrInvalidPatch},
+		{"Unknown operation", `{"foo":"bar"}`, `[{"op":"merge","path":"/foo","value":1}]`, "", ErrInvalidPatch},
+		{"Move into itself", `{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, "", ErrInvalidPatch},
+		{"Not an array of operations", `{"foo":"bar"}`, `{"op":"remove","path":"/foo"}`, "", ErrInvalidPatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patched, err := JSONPatch([]byte(tt.doc), []byte(tt.patch))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to patch: %v", err)
+			}
+			assertJSON(t, tt.expected, patched)
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	doc := []byte(`{"name":"Carrot","type":"vegetable"}`)
+
+	patched, err := Apply("application/merge-patch+json; charset=utf-8", doc, []byte(`{"type":"fruit"}`))
+	if err != nil {
+		t.Fatalf("Failed to merge patch: %v", err)
+	}
+	assertJSON(t, `{"name":"Carrot","type":"fruit"}`, patched)
+
+	patched, err = Apply(MIMEJSONPatch, doc, []byte(`[{"op":"remove","path":"/type"}]`))
+	if err != nil {
+		t.Fatalf("Failed to JSON patch: %v", err)
+	}
+	assertJSON(t, `{"name":"Carrot"}`, patched)
+
+	if _, err := Apply("application/json", doc, []byte(`{}`)); !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Fatalf("Expected %v, got %v", ErrUnsupportedMediaType, err)
+	}
+}
@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+	// One request per second, bursts of three
+	limiter := New(1, 3)
+
+	for i := 2; i >= 0; i-- {
+		result := limiter.Allow("scraper", now)
+		if !result.Allowed || result.Remaining != i || result.Limit != 3 {
+			t.Fatalf("Expected %d remaining requests, got %+v", i, result)
+		}
+	}
+
+	result := limiter.Allow("scraper", now)
+	if result.Allowed || result.RetryAfter != time.Second || result.Reset != 3*time.Second {
+		t.Fatalf("Expected the request to be limited, got %+v", result)
+	}
+
+	if result := limiter.Allow("someone else", now); !result.Allowed {
+		t.Fatalf("Expected the buckets to be per key, got %+v", result)
+	}
+
+	if result := limiter.Allow("scraper", now.Add(1500*time.Millisecond)); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("Expected the bucket to refill, got %+v", result)
+	}
+
+	limiter.Allow("scraper", now.Add(time.Hour))
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("Expected the idle buckets to be dropped, got %v", limiter.buckets)
+	}
+}
@@ -0,0 +1,121 @@
+// Package units converts quantities between units of mass, volume and count.
+// Mass and volume are converted into each other with a density, in kilograms
+// per litre.
+package units
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Dimension string
+
+const (
+	Mass   Dimension = "mass"
+	Volume Dimension = "volume"
+	Count  Dimension = "count"
+)
+
+type Unit string
+
+const (
+	Milligram  Unit = "mg"
+	Gram       Unit = "g"
+	Kilogram   Unit = "kg"
+	Ounce      Unit = "oz"
+	Pound      Unit = "lb"
+	Millilitre Unit = "ml"
+	Centilitre Unit = "cl"
+	Decilitre  Unit = "dl"
+	Litre      Unit = "l"
+	Piece      Unit = "piece"
+	Dozen      Unit = "dozen"
+)
+
+var (
+	ErrUnknownUnit       = errors.New("unknown unit")
+	ErrIncompatibleUnits = errors.New("incompatible units")
+	ErrMissingDensity    = errors.New("a density is required to convert between mass and volume")
+)
+
+type definition struct {
+	dimension Dimension
+	// Value of one unit in the base unit of its dimension
+	factor float64
+}
+
+var definitions = map[Unit]definition{
+	Milligram:  {Mass, 0.000001},
+	Gram:       {Mass, 0.001},
+	Kilogram:   {Mass, 1},
+	Ounce:      {Mass, 0.028349523125},
+	Pound:      {Mass, 0.45359237},
+	Millilitre: {Volume, 0.001},
+	Centilitre: {Volume, 0.01},
+	Decilitre:  {Volume, 0.1},
+	Litre:      {Volume, 1},
+	Piece:      {Count, 1},
+	Dozen:      {Count, 12},
+}
+
+// Parse reads a unit symbol, case insensitively
+func Parse(s string) (Unit, error) {
+	u := Unit(strings.ToLower(strings.TrimSpace(s)))
+	if !u.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrUnknownUnit, s)
+	}
+	return u, nil
+}
+
+func (u Unit) Valid() bool {
+	_, ok := definitions[u]
+	return ok
+}
+
+func (u Unit) Dimension() Dimension {
+	return definitions[u].dimension
+}
+
+// BaseUnit returns the unit prices are normalized to for the dimension:
+// kilogram, litre or piece.
+func BaseUnit(dimension Dimension) Unit {
+	switch dimension {
+	case Volume:
+		return Litre
+	case Count:
+		return Piece
+	}
+	return Kilogram
+}
+
+// Convert converts the quantity from one unit to another. The density, in
+// kilograms per litre, is only used between mass and volume; pass 0 if unknown.
+func Convert(quantity float64, from, to Unit, density float64) (float64, error) {
+	source, ok := definitions[from]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownUnit, from)
+	}
+	target, ok := definitions[to]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownUnit, to)
+	}
+
+	base := quantity * source.factor
+	switch {
+	case source.dimension == target.dimension:
+	case source.dimension == Mass && target.dimension == Volume:
+		if density <= 0 {
+			return 0, ErrMissingDensity
+		}
+		base /= density
+	case source.dimension == Volume && target.dimension == Mass:
+		if density <= 0 {
+			return 0, ErrMissingDensity
+		}
+		base *= density
+	default:
+		return 0, fmt.Errorf("%w: %s to %s", ErrIncompatibleUnits, from, to)
+	}
+	return base / target.factor, nil
+}
@@ -0,0 +1,55 @@
+package units
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity float64
+		from, to Unit
+		density  float64
+		expected float64
+		err      error
+	}{
+		{name: "Grams to kilograms", quantity: 500, from: Gram, to: Kilogram, expected: 0.5},
+		{name: "Centilitres to litres", quantity: 75, from: Centilitre, to: Litre, expected: 0.75},
+		{name: "Dozen to pieces", quantity: 2, from: Dozen, to: Piece, expected: 24},
+		{name: "Pounds to grams", quantity: 1, from: Pound, to: Gram, expected: 453.59237},
+		{name: "Litres to kilograms", quantity: 1.5, from: Litre, to: Kilogram, density: 0.92, expected: 1.38},
+		{name: "Grams to millilitres", quantity: 515, from: Gram, to: Millilitre, density: 1.03, expected: 500},
+		{name: "Missing density", quantity: 1, from: Litre, to: Kilogram, err: ErrMissingDensity},
+		{name: "Pieces to kilograms", quantity: 1, from: Piece, to: Kilogram, density: 1, err: ErrIncompatibleUnits},
+		{name: "Unknown unit", quantity: 1, from: "cup", to: Litre, err: ErrUnknownUnit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Convert(tt.quantity, tt.from, tt.to, tt.density)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to convert: %v", err)
+			}
+			if math.Abs(got-tt.expected) > 1e-9 {
+				t.Fatalf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	if u, err := Parse(" KG "); err != nil || u != Kilogram {
+		t.Fatalf("Expected kg, got %q (%v)", u, err)
+	}
+	if _, err := Parse("cup"); !errors.Is(err, ErrUnknownUnit) {
+		t.Fatalf("Expected an unknown unit, got %v", err)
+	}
+}
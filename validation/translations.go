@@ -0,0 +1,146 @@
+package validation
+
+import (
+	"reflect"
+	"time"
+
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+)
+
+// Messages of the tags the validator translations don't cover, by locale
+var extraTranslations = map[string]map[string]string{
+	"en": {
+		"iso4217":            "{0} must be an ISO 4217 currency code",
+		"unit":               "{0} must be a known unit",
+		"bcp47_language_tag": "{0} must be a BCP 47 language tag",
+	},
+	"fr": {
+		"required_with":      "{0} est obligatoire quand {1} est renseigné",
+		"iso4217":            "{0} doit être un code de devise ISO 4217",
+		"unit":               "{0} doit être une unité connue",
+		"bcp47_language_tag": "{0} doit être une étiquette de langue BCP 47",
+	},
+}
+
+// The validator doesn't provide German translations, these cover the tags
+// used by the API.
+var germanTranslations = map[string]string{
+	"required":           "{0} ist ein Pflichtfeld",
+	"required_with":      "{0} ist ein Pflichtfeld, wenn {1} angegeben ist",
+	"oneof":              "{0} muss einer der folgenden Werte sein: [{1}]",
+	"iso4217":            "{0} muss ein ISO-4217-Währungscode sein",
+	"unit":               "{0} muss eine bekannte Einheit sein",
+	"bcp47_language_tag": "{0} muss ein BCP-47-Sprachcode sein",
+	"latitude":           "{0} muss einen gültigen Breitengrad enthalten",
+	"longitude":          "{0} muss einen gültigen Längengrad enthalten",
+	"nefield":            "{0} darf nicht gleich {1} sein",
+	"eqfield":            "{0} muss gleich {1} sein",
+	"email":              "{0} muss eine gültige E-Mail-Adresse sein",
+	"url":                "{0} muss eine gültige URL sein",
+}
+
+// The messages of the sized tags depend on the kind of the field
+var germanSizedTranslations = map[string]map[string]string{
+	"min": {
+		"string": "{0} muss mindestens {1} Zeichen lang sein",
+		"items":  "{0} muss mindestens {1} Elemente enthalten",
+		"number": "{0} muss mindestens {1} sein",
+	},
+	"max": {
+		"string": "{0} darf höchstens {1} Zeichen lang sein",
+		"items":  "{0} darf höchstens {1} Elemente enthalten",
+		"number": "{0} darf höchstens {1} sein",
+	},
+	"len": {
+		"string": "{0} muss genau {1} Zeichen lang sein",
+		"items":  "{0} muss genau {1} Elemente enthalten",
+		"number": "{0} muss gleich {1} sein",
+	},
+	"gt": {
+		"string":   "{0} muss länger als {1} Zeichen sein",
+		"items":    "{0} muss mehr als {1} Elemente enthalten",
+		"number":   "{0} muss größer als {1} sein",
+		"datetime": "{0} muss in der Zukunft liegen",
+	},
+	"gte": {
+		"string":   "{0} muss mindestens {1} Zeichen lang sein",
+		"items":    "{0} muss mindestens {1} Elemente enthalten",
+		"number":   "{0} muss größer oder gleich {1} sein",
+		"datetime": "{0} darf nicht in der Vergangenheit liegen",
+	},
+	"lt": {
+		"string":   "{0} muss kürzer als {1} Zeichen sein",
+		"items":    "{0} muss weniger als {1} Elemente enthalten",
+		"number":   "{0} muss kleiner als {1} sein",
+		"datetime": "{0} muss in der Vergangenheit liegen",
+	},
+	"lte": {
+		"string":   "{0} darf höchstens {1} Zeichen lang sein",
+		"items":    "{0} darf höchstens {1} Elemente enthalten",
+		"number":   "{0} muss kleiner oder gleich {1} sein",
+		"datetime": "{0} darf nicht in der Zukunft liegen",
+	},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func registerExtraTranslations(validate *validator.Validate, trans ut.Translator, locale string) error {
+	for tag, text := range extraTranslations[locale] {
+		if err := registerTranslation(validate, trans, tag, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerGermanTranslations(validate *validator.Validate, trans ut.Translator) error {
+	for tag, text := range germanTranslations {
+		if err := registerTranslation(validate, trans, tag, text); err != nil {
+			return err
+		}
+	}
+
+	for tag, texts := range germanSizedTranslations {
+		tag, texts := tag, texts
+		err := validate.RegisterTranslation(tag, trans, func(ut ut.Translator) error {
+			for kind, text := range texts {
+				if err := ut.Add(tag+"-"+kind, text, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, func(ut ut.Translator, fe validator.FieldError) string {
+			kind := "number"
+			switch {
+			case fe.Type() == timeType:
+				kind = "datetime"
+			case fe.Kind() == reflect.String:
+				kind = "string"
+			case fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map || fe.Kind() == reflect.Array:
+				kind = "items"
+			}
+			text, err := ut.T(tag+"-"+kind, fe.Field(), fe.Param())
+			if err != nil {
+				return fe.Error()
+			}
+			return text
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerTranslation(validate *validator.Validate, trans ut.Translator, tag, text string) error {
+	return validate.RegisterTranslation(tag, trans, func(ut ut.Translator) error {
+		return ut.Add(tag, text, true)
+	}, func(ut ut.Translator, fe validator.FieldError) string {
+		text, err := ut.T(fe.Tag(), fe.Field(), fe.Param())
+		if err != nil {
+			return fe.Error()
+		}
+		return text
+	})
+}
@@ -2,33 +2,107 @@ package validation
 
 import (
 	"catalog/configuration"
+	"catalog/money"
+	"catalog/units"
+	"fmt"
+	"reflect"
+	"strings"
 
+	"github.com/go-playground/locales/de"
 	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
 	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
+	"golang.org/x/text/language"
 
 	en_translations "github.com/go-playground/validator/v10/translations/en"
+	fr_translations "github.com/go-playground/validator/v10/translations/fr"
 )
 
+// The locales of the validation messages, the first one is the default
+var supportedLanguages = []language.Tag{language.English, language.French, language.German}
+
 type Validation struct {
 	Validate *validator.Validate
-	Trans    ut.Translator
+	// The default, English, translator. Nil when the translation is disabled.
+	Trans ut.Translator
+	uni   *ut.UniversalTranslator
 }
 
-func New(conf *configuration.Configuration) *Validation {
+// New returns the validator of the requests, with the translations of its
+// messages when enabled. It fails when a translation can't be registered.
+func New(conf *configuration.Configuration) (*Validation, error) {
 
 	var trans ut.Translator
 	validate := validator.New()
+	// Report the fields by the names the clients send
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		for _, tag := range []string{"json", "query", "param"} {
+			name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+			if name == "-" {
+				return ""
+			}
+			if len(name) > 0 {
+				return name
+			}
+		}
+		return field.Name
+	})
+	// Validate the amounts on their scaled value, so gt=0 works as expected
+	validate.RegisterCustomTypeFunc(func(v reflect.Value) interface{} {
+		return v.Interface().(money.Amount).Scaled()
+	}, money.Amount{})
+	validate.RegisterValidation("unit", func(fl validator.FieldLevel) bool {
+		return units.Unit(fl.Field().String()).Valid()
+	})
 
+	var uni *ut.UniversalTranslator
 	if conf.TranslateValidation {
-		en := en.New()
-		uni := ut.New(en, en)
+		uni = ut.New(en.New(), en.New(), fr.New(), de.New())
 		trans, _ = uni.GetTranslator("en")
-		en_translations.RegisterDefaultTranslations(validate, trans)
+		if err := en_translations.RegisterDefaultTranslations(validate, trans); err != nil {
+			return nil, fmt.Errorf("failed to register the en translations: %w", err)
+		}
+		if err := registerExtraTranslations(validate, trans, "en"); err != nil {
+			return nil, fmt.Errorf("failed to register the en translations: %w", err)
+		}
+
+		frTrans, _ := uni.GetTranslator("fr")
+		if err := fr_translations.RegisterDefaultTranslations(validate, frTrans); err != nil {
+			return nil, fmt.Errorf("failed to register the fr translations: %w", err)
+		}
+		if err := registerExtraTranslations(validate, frTrans, "fr"); err != nil {
+			return nil, fmt.Errorf("failed to register the fr translations: %w", err)
+		}
+
+		deTrans, _ := uni.GetTranslator("de")
+		if err := registerGermanTranslations(validate, deTrans); err != nil {
+			return nil, fmt.Errorf("failed to register the de translations: %w", err)
+		}
 	}
 
 	return &Validation{
 		Validate: validate,
 		Trans:    trans,
+		uni:      uni,
+	}, nil
+}
+
+// Translator returns the translator of the language preferred by the
+// Accept-Language header, English by default. Nil when the translation is disabled.
+func (v *Validation) Translator(acceptLanguage string) ut.Translator {
+	if v.uni == nil {
+		return nil
+	}
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return v.Trans
+	}
+	_, index, confidence := language.NewMatcher(supportedLanguages).Match(tags...)
+	if confidence == language.No {
+		return v.Trans
 	}
+	base, _ := supportedLanguages[index].Base()
+	trans, _ := v.uni.GetTranslator(base.String())
+	return trans
 }
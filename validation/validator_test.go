@@ -0,0 +1,93 @@
+package validation
+
+import (
+	"catalog/configuration"
+	"errors"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+)
+
+type testRequest struct {
+	Name     string   `json:"name" validate:"required"`
+	Type     string   `json:"type" validate:"oneof=vegetable fruit"`
+	Quantity float64  `json:"quantity" validate:"gt=0"`
+	Tags     []string `json:"tags" validate:"min=1"`
+	Unit     string   `json:"unit" validate:"unit"`
+}
+
+func newTestValidation(t *testing.T) *Validation {
+	t.Helper()
+	v, err := New(&configuration.Configuration{TranslateValidation: true})
+	if err != nil {
+		t.Fatalf("Failed to create the validation: %v", err)
+	}
+	return v
+}
+
+func TestTranslator(t *testing.T) {
+	v := newTestValidation(t)
+
+	tests := []struct {
+		acceptLanguage string
+		locale         string
+	}{
+		{"", "en"},
+		{"de", "de"},
+		{"de-CH", "de"},
+		{"fr-CA,fr;q=0.9,en;q=0.8", "fr"},
+		{"es,de;q=0.5,fr;q=0.4", "de"},
+		{"en-GB;q=0.5,de;q=0.8", "de"},
+		{"ja", "en"},
+		{"*", "en"},
+		{";;invalid", "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptLanguage, func(t *testing.T) {
+			if locale := v.Translator(tt.acceptLanguage).Locale(); locale != tt.locale {
+				t.Fatalf("Expected %s, got %s", tt.locale, locale)
+			}
+		})
+	}
+
+	disabled, err := New(&configuration.Configuration{})
+	if err != nil {
+		t.Fatalf("Failed to create the validation: %v", err)
+	}
+	if disabled.Translator("de") != nil || disabled.Trans != nil {
+		t.Fatal("Expected no translator when the translation is disabled")
+	}
+}
+
+func TestGermanTranslations(t *testing.T) {
+	v := newTestValidation(t)
+
+	err := v.Validate.Struct(&testRequest{Type: "meat", Quantity: -1, Unit: "parsec"})
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected validation errors, got %v", err)
+	}
+	expected := map[string]string{
+		"name":     "name ist ein Pflichtfeld",
+		"type":     "type muss einer der folgenden Werte sein: [vegetable fruit]",
+		"quantity": "quantity muss größer als 0 sein",
+		"tags":     "tags muss mindestens 1 Elemente enthalten",
+		"unit":     "unit muss eine bekannte Einheit sein",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), errs)
+	}
+	trans := v.Translator("de-DE")
+	for _, e := range errs {
+		if message := e.Translate(trans); message != expected[e.Field()] {
+			t.Fatalf("Expected %q for %s, got %q", expected[e.Field()], e.Field(), message)
+		}
+	}
+
+	// The French messages don't fall back to the English errors either
+	for _, e := range errs {
+		if message := e.Translate(v.Translator("fr")); message == e.Error() {
+			t.Fatalf("Missing French translation of %s", e.Tag())
+		}
+	}
+}